@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// adminTemplate lists recent messages, with forms to retry or discard failed
+// messages.
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{"join": strings.Join}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Paperless Mailhook</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ccc; padding: 0.4em; text-align: left; vertical-align: top; }
+ul { margin: 0; padding-left: 1em; }
+form { display: inline; }
+.failed { color: #b00; }
+.filtered { color: #777; }
+</style>
+</head>
+<body>
+<h1>Recent messages</h1>
+{{if .Messages}}
+<table>
+<tr><th>Received</th><th>From</th><th>Subject</th><th>Status</th><th>Attachments</th><th>Documents</th><th></th></tr>
+{{range .Messages}}
+<tr>
+<td>{{.Received.Format "2006-01-02 15:04:05"}}<br><small>{{.Source}}</small></td>
+<td>{{.From}}<br><small>to {{join .To ", "}}{{if .Target}} ({{.Target}}){{end}}</small></td>
+<td>{{.Subject}}</td>
+<td class="{{.Status}}">{{.Status}}{{if .Reason}}<br><small>{{.Reason}}</small>{{end}}{{if gt .Attempts 1}}<br><small>{{.Attempts}} attempts</small>{{end}}</td>
+<td>{{if .Attachments}}<ul>{{range .Attachments}}<li>{{.}}</li>{{end}}</ul>{{end}}</td>
+<td>{{if .Documents}}<ul>{{range .Documents}}<li>{{.Filename}}{{if .TaskID}}<br><small>task {{.TaskID}}</small>{{end}}{{if .DocumentID}}<br><small>document {{.DocumentID}}</small>{{end}}{{if .Error}}<br><small class="failed">{{.Error}}</small>{{end}}</li>{{end}}</ul>{{end}}</td>
+<td>{{if .Failed}}
+<form method="post" action="/admin/retry"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="id" value="{{.ID}}"><button>Retry</button></form>
+<form method="post" action="/admin/discard"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="id" value="{{.ID}}"><button>Discard</button></form>
+{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No messages have been received.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// Admin serves a web interface listing recent messages and their outcome,
+// where failed messages can be retried or discarded, and a JSON API to manage
+// them from scripts.
+type Admin struct {
+	Username string
+	Password string
+	History  *History
+
+	// Handler returns the handler used to retry messages, so retries use the
+	// latest configuration.
+	Handler func() *EmailHandler
+
+	// token is included in forms so they can't be submitted from other sites,
+	// which browsers would do with saved credentials.
+	token string
+}
+
+// NewAdmin creates the admin interface for a history, requiring a username and
+// password.
+func NewAdmin(username, password string, history *History, handler func() *EmailHandler) *Admin {
+	return &Admin{
+		Username: username,
+		Password: password,
+		History:  history,
+		Handler:  handler,
+		token:    randomHex(16),
+	}
+}
+
+// ServeHTTP checks the credentials of a request, then serves the page or
+// action for its path.
+func (admin *Admin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !admin.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Paperless Mailhook", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+		return
+	}
+
+	switch req.URL.Path {
+	case "/admin", "/admin/":
+		admin.index(w, req)
+	case "/admin/retry":
+		admin.action(w, req, admin.retry)
+	case "/admin/discard":
+		admin.action(w, req, admin.History.Discard)
+	default:
+		if strings.HasPrefix(req.URL.Path, "/admin/api/") {
+			admin.api(w, req)
+		} else {
+			http.NotFound(w, req)
+		}
+	}
+}
+
+// authorized checks the credentials of a request.
+func (admin *Admin) authorized(req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(admin.Username)) == 1
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(admin.Password)) == 1
+
+	return usernameMatches && passwordMatches
+}
+
+// index lists recent messages.
+func (admin *Admin) index(w http.ResponseWriter, req *http.Request) {
+	data := struct {
+		Messages []Message
+		Token    string
+	}{admin.History.Messages(), admin.token}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminTemplate.Execute(w, data); err != nil {
+		log.Errorf("could not render admin page: %s", err.Error())
+	}
+}
+
+// action performs an action on the message from a submitted form, then
+// returns to the list of messages.
+func (admin *Admin) action(w http.ResponseWriter, req *http.Request, fn func(id string) error) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.PostFormValue("token")), []byte(admin.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusForbidden)
+
+		return
+	}
+
+	err := fn(req.PostFormValue("id"))
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errMessageNotFailed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Redirect(w, req, "/admin", http.StatusSeeOther)
+	}
+}
+
+// retry processes a failed message again with the current handler. The
+// outcome is recorded in the message rather than returned.
+func (admin *Admin) retry(id string) error {
+	message, err := admin.History.Retry(id)
+	if err != nil {
+		return err
+	}
+
+	admin.process(admin.Handler(), message)
+
+	return nil
+}
+
+// process processes a message from the history again, recording the outcome
+// in the message.
+func (admin *Admin) process(handler *EmailHandler, message *Message) {
+	logCtx := log.WithFields(log.Fields{
+		"message": message.ID,
+		"from":    message.From,
+		"to":      message.To,
+	})
+	logCtx.Info("reprocessing email")
+
+	_ = handler.withMessage(message).receive(logCtx, message.From, message.To, message.raw, nil)
+
+	logCtx.Info("finished handling email")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	client, documents := newTestPaperless(t)
+
+	history := NewHistory(10, 0)
+	handler := &EmailHandler{
+		AllowList:        AllowList{[]string{"me@example.com"}, ""},
+		ProcessingLimits: ProcessingLimits{MaxSize: 10},
+		paperless:        client,
+		History:          history,
+	}
+
+	_ = handler.track("sendgrid", "me@example.com", nil, []byte(dryRunEmail)).receive(log.WithField("test", t.Name()), "me@example.com", nil, []byte(dryRunEmail), nil)
+	failed := history.Messages()[0]
+	require.Equal(t, MessageFailed, failed.Status)
+
+	admin := NewAdmin("admin", "secret", history, func() *EmailHandler {
+		return &EmailHandler{
+			AllowList: AllowList{[]string{"me@example.com"}, ""},
+			paperless: client,
+		}
+	})
+
+	request := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "secret")
+
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+
+		return w
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.SetBasicAuth("admin", "wrong")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "wrong credentials should be rejected")
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+
+	w = request(http.MethodGet, "/admin", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Invoice")
+	assert.Contains(t, w.Body.String(), errProcessingLimit.Error())
+	assert.Contains(t, w.Body.String(), `action="/admin/retry"`, "failed messages should be retryable")
+
+	w = request(http.MethodGet, "/admin/retry", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = request(http.MethodPost, "/admin/retry", url.Values{"id": {failed.ID}})
+	assert.Equal(t, http.StatusForbidden, w.Code, "forms without the token should be rejected")
+
+	w = request(http.MethodPost, "/admin/retry", url.Values{"id": {failed.ID}, "token": {admin.token}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	message, ok := history.Get(failed.ID)
+	require.True(t, ok)
+	assert.Equal(t, MessageProcessed, message.Status, "the retry should use the current handler")
+	assert.Equal(t, 2, message.Attempts)
+	assert.Len(t, *documents, 1)
+
+	w = request(http.MethodPost, "/admin/retry", url.Values{"id": {failed.ID}, "token": {admin.token}})
+	assert.Equal(t, http.StatusConflict, w.Code, "processed messages should not be retried")
+
+	w = request(http.MethodPost, "/admin/discard", url.Values{"id": {"unknown"}, "token": {admin.token}})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	history.messages[0].finish(MessageFailed, "paperless was down")
+	w = request(http.MethodPost, "/admin/discard", url.Values{"id": {failed.ID}, "token": {admin.token}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Empty(t, history.Messages())
+}
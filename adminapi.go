@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// replayRequest is the optional body of a request to replay a message.
+type replayRequest struct {
+	// Tags replace the tags documents are uploaded with, resolved on the
+	// target the message is addressed to.
+	Tags []string `json:"tags"`
+}
+
+// api serves the JSON management API for messages:
+//
+//	GET    /admin/api/messages[?status=]    list messages, newest first
+//	DELETE /admin/api/messages[?status=]    purge messages
+//	GET    /admin/api/messages/{id}         get a message and its outcome
+//	DELETE /admin/api/messages/{id}         delete a message
+//	POST   /admin/api/messages/{id}/replay  process a message again
+func (admin *Admin) api(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/admin/api/messages")
+	if path == req.URL.Path {
+		writeAPIError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	var parts []string
+	if path = strings.Trim(path, "/"); path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	replay := len(parts) == 2 && parts[1] == "replay"
+
+	switch {
+	case len(parts) == 0 && req.Method == http.MethodGet:
+		admin.listMessages(w, req)
+	case len(parts) == 0 && req.Method == http.MethodDelete:
+		admin.purgeMessages(w, req)
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		admin.getMessage(w, parts[0])
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		admin.deleteMessage(w, parts[0])
+	case replay && req.Method == http.MethodPost:
+		admin.replayMessage(w, req, parts[0])
+	case len(parts) <= 1:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	case replay:
+		writeMethodNotAllowed(w, http.MethodPost)
+	default:
+		writeAPIError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// listMessages writes every message, or those with the requested status.
+func (admin *Admin) listMessages(w http.ResponseWriter, req *http.Request) {
+	status, err := statusFilter(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	messages := []Message{}
+	for _, message := range admin.History.Messages() {
+		if status == "" || message.Status == status {
+			messages = append(messages, message)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// purgeMessages deletes every message, or those with the requested status.
+func (admin *Admin) purgeMessages(w http.ResponseWriter, req *http.Request) {
+	status, err := statusFilter(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	purged := admin.History.Purge(status)
+	log.WithField("status", status).Infof("purged %d messages", purged)
+
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// getMessage writes a message and the outcome of processing it.
+func (admin *Admin) getMessage(w http.ResponseWriter, id string) {
+	message, ok := admin.History.Get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errMessageNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, message)
+}
+
+// deleteMessage deletes a single message.
+func (admin *Admin) deleteMessage(w http.ResponseWriter, id string) {
+	if !admin.History.Remove(id) {
+		writeAPIError(w, http.StatusNotFound, errMessageNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replayMessage processes a message again, then writes its new outcome.
+func (admin *Admin) replayMessage(w http.ResponseWriter, req *http.Request, id string) {
+	// Requiring JSON means browsers must ask before sending the request from
+	// another site, like the token does for forms.
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return
+	}
+
+	// The body is optional.
+	var body replayRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	message, ok := admin.History.Get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errMessageNotFound)
+		return
+	}
+
+	handler := admin.Handler()
+	if body.Tags != nil {
+		var err error
+		if handler, err = withTags(handler, message.To, body.Tags); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	replayed, err := admin.History.Replay(id)
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	case errors.Is(err, errMessageRunning):
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+
+	admin.process(handler, replayed)
+
+	message, _ = admin.History.Get(id)
+	writeJSON(w, http.StatusOK, message)
+}
+
+// withTags returns the handler for the target of a message, uploading with
+// the given tags instead of those configured. If the message isn't addressed
+// to any target, the handler is returned unchanged so the message is filtered
+// as usual.
+func withTags(handler *EmailHandler, to []string, tags []string) (*EmailHandler, error) {
+	target, err := handler.route(to)
+	if err != nil {
+		return handler, nil
+	}
+
+	ids, err := ResolveTags(target.paperless, tags)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve tags: %w", err)
+	}
+
+	h := *target
+	h.Tags = ids
+
+	return &h, nil
+}
+
+// statusFilter returns the status requested by the status query parameter,
+// if any.
+func statusFilter(req *http.Request) (MessageStatus, error) {
+	status := MessageStatus(req.URL.Query().Get("status"))
+	switch status {
+	case "", MessageProcessing, MessageProcessed, MessageFiltered, MessageFailed:
+		return status, nil
+	default:
+		return "", fmt.Errorf("unknown status %s", status)
+	}
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("could not write api response: %s", err.Error())
+	}
+}
+
+// writeAPIError writes an error as a JSON response.
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeMethodNotAllowed responds that the request's method isn't one of the
+// allowed methods.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
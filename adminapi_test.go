@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+func TestAdminAPI(t *testing.T) {
+	available := false
+	var uploadedTags [][]string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/tags/":
+			if req.URL.Query().Get("name__iexact") == "urgent" {
+				fmt.Fprint(w, `{"results": [{"id": 9}]}`)
+			} else {
+				fmt.Fprint(w, `{"results": []}`)
+			}
+		case "/api/documents/post_document/":
+			if !available {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			if !assert.NoError(t, req.ParseMultipartForm(MaxMemory)) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			uploadedTags = append(uploadedTags, req.MultipartForm.Value["tags"])
+			fmt.Fprint(w, "OK")
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	history := NewHistory(10, 0)
+	handler := &EmailHandler{
+		AllowList: AllowList{[]string{"me@example.com"}, ""},
+		Tags:      []int{3},
+		paperless: paperless.New(ts.URL, "apiKey", http.DefaultClient),
+		History:   history,
+	}
+	admin := NewAdmin("admin", "secret", history, func() *EmailHandler { return handler })
+
+	for _, from := range []string{"me@example.com", "me@example.com", "spam@example.com"} {
+		_ = handler.track("sendgrid", from, nil, []byte(dryRunEmail)).receive(log.WithField("test", t.Name()), from, nil, []byte(dryRunEmail), nil)
+	}
+
+	request := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.SetBasicAuth("admin", "secret")
+
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+
+		return w
+	}
+
+	decode := func(w *httptest.ResponseRecorder, v interface{}) {
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(w.Body).Decode(v))
+	}
+
+	var messages []Message
+	w := request(http.MethodGet, "/admin/api/messages?status=failed", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decode(w, &messages)
+	require.Len(t, messages, 2, "only failed messages should be listed")
+	assert.Equal(t, "Invoice", messages[0].Subject)
+	assert.Contains(t, messages[0].Reason, "503")
+
+	w = request(http.MethodGet, "/admin/api/messages?status=unknown", "", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var message Message
+	w = request(http.MethodGet, "/admin/api/messages/"+messages[0].ID, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decode(w, &message)
+	assert.Equal(t, messages[0].ID, message.ID)
+
+	w = request(http.MethodGet, "/admin/api/messages/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "lost on restart", "missing messages should explain why")
+
+	available = true
+
+	w = request(http.MethodPost, "/admin/api/messages/"+messages[0].ID+"/replay", "text/plain", "")
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "replays must be json so they can't be sent by forms on other sites")
+
+	w = request(http.MethodPost, "/admin/api/messages/"+messages[0].ID+"/replay", "application/json", `{"tags": ["missing"]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "unknown tags should be rejected")
+
+	w = request(http.MethodPost, "/admin/api/messages/"+messages[0].ID+"/replay", "application/json", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decode(w, &message)
+	assert.Equal(t, MessageProcessed, message.Status)
+	assert.Equal(t, 2, message.Attempts)
+
+	w = request(http.MethodPost, "/admin/api/messages/"+messages[1].ID+"/replay", "application/json", `{"tags": ["urgent"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	decode(w, &message)
+	assert.Equal(t, MessageProcessed, message.Status)
+
+	assert.Equal(t, [][]string{{"3"}, {"9"}}, uploadedTags, "replayed documents should use the overridden tags")
+
+	w = request(http.MethodGet, "/admin/api/messages/"+messages[1].ID+"/replay", "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, http.MethodPost, w.Header().Get("Allow"))
+
+	w = request(http.MethodDelete, "/admin/api/messages/"+messages[1].ID, "", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	var purged map[string]int
+	w = request(http.MethodDelete, "/admin/api/messages?status=filtered", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	decode(w, &purged)
+	assert.Equal(t, map[string]int{"purged": 1}, purged)
+
+	w = request(http.MethodGet, "/admin/api/messages", "", "")
+	decode(w, &messages)
+	assert.Len(t, messages, 1)
+
+	req := httptest.NewRequest(http.MethodDelete, "/admin/api/messages", nil)
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "the api should require credentials")
+}
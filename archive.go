@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errArchiveLimit    = errors.New("archive exceeded extraction limits")
+	errArchiveFormat   = errors.New("unknown archive format")
+	errArchivePassword = errors.New("archive could not be decrypted with any password")
+)
+
+// archiveExtensions are file extensions treated as archives.
+var archiveExtensions = []string{".zip", ".7z", ".tar", ".tgz", ".gz", ".tbz", ".tbz2", ".bz2"}
+
+// archiveTypes are MIME types treated as archives.
+var archiveTypes = []string{
+	"application/zip",
+	"application/x-zip-compressed",
+	"application/x-7z-compressed",
+	"application/x-tar",
+	"application/x-gtar",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+}
+
+// ArchiveLimits restrict how much may be extracted from an attached archive,
+// including any archives nested within it. A limit of 0 is unlimited.
+type ArchiveLimits struct {
+	// MaxDepth is how many levels of nested archives may be extracted.
+	MaxDepth int
+	// MaxSize is the total number of uncompressed bytes that may be extracted.
+	MaxSize int64
+	// MaxFiles is the total number of files that may be extracted.
+	MaxFiles int
+}
+
+// ArchiveMember is a file extracted from an archive.
+type ArchiveMember struct {
+	Name    string
+	Content []byte
+}
+
+// IsArchiveAttachment checks if an attachment is an archive based on its
+// extension or MIME type.
+//
+// Office documents are often ZIP files, so the contents are never inspected.
+func IsArchiveAttachment(attachment *email.Attachment) bool {
+	if isArchiveName(attachment.Filename) {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(attachment.ContentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range archiveTypes {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isArchiveName checks if a filename has an archive extension.
+func isArchiveName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, archiveExt := range archiveExtensions {
+		if ext == archiveExt {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UploadArchive extracts every file from an archive and processes each as if
+// it was an individual attachment. If the archive can't be extracted, it is
+// uploaded as-is.
+//
+// A file that fails doesn't stop the others from being processed, but the
+// first error is returned once they have been.
+func (handler *EmailHandler) UploadArchive(r io.Reader, filename string) error {
+	logCtx := log.WithField("filename", filename)
+	logCtx.Info("extracting archive")
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	members, err := ExtractArchive(filename, data, handler.ArchiveLimits, handler.ArchivePasswords)
+	if err != nil {
+		logCtx.WithError(err).Warn("could not extract archive, uploading original")
+		return handler.upload(bytes.NewReader(data), handler.attachmentFilename(filename), handler.Tags)
+	}
+
+	logCtx.Debugf("archive contained %d files", len(members))
+
+	var firstErr error
+	for _, member := range members {
+		attachment := &email.Attachment{
+			Filename:    path.Base(member.Name),
+			ContentType: mime.TypeByExtension(path.Ext(member.Name)),
+			Header:      textproto.MIMEHeader{},
+			Content:     member.Content,
+		}
+
+		err := handler.UploadAttachment(attachment)
+		if errors.Is(err, errProcessingLimit) {
+			return err
+		} else if err != nil {
+			logCtx.WithField("member", member.Name).Errorf("could not process archive member: %s", err.Error())
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not process %s from %s: %w", member.Name, filename, err)
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// ExtractArchive extracts all files from a ZIP, 7z, tar, gzip, or bzip2
+// archive, including those within nested archives.
+//
+// Extraction fails if any of the limits are exceeded. Encrypted ZIP and 7z
+// archives are tried with each of the passwords.
+func ExtractArchive(name string, data []byte, limits ArchiveLimits, passwords []string) ([]ArchiveMember, error) {
+	x := &archiveExtractor{limits: limits, passwords: passwords}
+	if err := x.extract(name, data, 1); err != nil {
+		return nil, err
+	}
+
+	return x.members, nil
+}
+
+// archiveExtractor tracks the limits shared by an archive and all archives
+// nested within it.
+type archiveExtractor struct {
+	limits    ArchiveLimits
+	passwords []string
+
+	files   int
+	size    int64
+	members []ArchiveMember
+}
+
+// extract determines the format of an archive from its contents and
+// extracts it.
+func (x *archiveExtractor) extract(name string, data []byte, depth int) error {
+	if x.limits.MaxDepth > 0 && depth > x.limits.MaxDepth {
+		return errArchiveLimit
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return x.extractZip(data, depth)
+	case bytes.HasPrefix(data, []byte("7z\xbc\xaf\x27\x1c")):
+		return x.extract7z(data, depth)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		return x.extractCompressed(name, gr, depth)
+	case bytes.HasPrefix(data, []byte("BZh")):
+		return x.extractCompressed(name, bzip2.NewReader(bytes.NewReader(data)), depth)
+	case isTar(data):
+		return x.extractTar(bytes.NewReader(data), depth)
+	default:
+		return errArchiveFormat
+	}
+}
+
+// isTar checks for the ustar magic in a tar header.
+func isTar(data []byte) bool {
+	return len(data) > 262 && bytes.Equal(data[257:262], []byte("ustar"))
+}
+
+// read reads a file from an archive. Sizes in archive headers can't be
+// trusted, so at most one byte more than the remaining size limit is read.
+func (x *archiveExtractor) read(r io.Reader) ([]byte, error) {
+	if x.limits.MaxSize <= 0 {
+		return io.ReadAll(r)
+	}
+
+	return io.ReadAll(io.LimitReader(r, x.limits.MaxSize-x.size+1))
+}
+
+// add reads a file from an archive, extracting it if it is also an archive.
+func (x *archiveExtractor) add(name string, r io.Reader, depth int) error {
+	x.files++
+	if x.limits.MaxFiles > 0 && x.files > x.limits.MaxFiles {
+		return errArchiveLimit
+	}
+
+	data, err := x.read(r)
+	if err != nil {
+		return err
+	}
+
+	x.size += int64(len(data))
+	if x.limits.MaxSize > 0 && x.size > x.limits.MaxSize {
+		return errArchiveLimit
+	}
+
+	if skipArchiveMember(name) {
+		log.WithField("filename", name).Debug("skipping archive member")
+		return nil
+	}
+
+	if isArchiveName(name) {
+		err := x.extract(name, data, depth+1)
+		if !errors.Is(err, errArchiveFormat) {
+			return err
+		}
+
+		log.WithField("filename", name).Debug("archive member was not an archive")
+	}
+
+	x.members = append(x.members, ArchiveMember{name, data})
+	return nil
+}
+
+// skipArchiveMember checks if a file is metadata added by archiving tools
+// rather than a document.
+func skipArchiveMember(name string) bool {
+	if strings.HasPrefix(name, "__MACOSX/") {
+		return true
+	}
+
+	return strings.HasPrefix(path.Base(name), ".")
+}
+
+// extractCompressed handles single-file gzip or bzip2 streams, which usually
+// contain a tar archive.
+func (x *archiveExtractor) extractCompressed(name string, r io.Reader, depth int) error {
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(263); isTar(header) {
+		return x.extractTar(br, depth)
+	}
+
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return x.add(name, br, depth)
+}
+
+func (x *archiveExtractor) extractTar(r io.Reader, depth int) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err = x.add(header.Name, tr, depth); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *archiveExtractor) extractZip(data []byte, depth int) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		var r io.ReadCloser
+		if f.Flags&0x1 != 0 {
+			r, err = x.openEncryptedZip(f, data)
+		} else {
+			r, err = f.Open()
+		}
+		if err != nil {
+			return err
+		}
+
+		err = x.add(f.Name, r, depth)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openEncryptedZip decrypts a file using traditional PKWARE encryption,
+// trying each configured password.
+func (x *archiveExtractor) openEncryptedZip(f *zip.File, data []byte) (io.ReadCloser, error) {
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset+int64(f.CompressedSize64) > int64(len(data)) || f.CompressedSize64 < 12 {
+		return nil, zip.ErrFormat
+	}
+	encrypted := data[offset : offset+int64(f.CompressedSize64)]
+
+	// The last byte of the encryption header is used to check passwords. It
+	// is usually the high byte of the CRC, but is the high byte of the
+	// modification time when the CRC is stored after the file data.
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&0x8 != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+
+	for _, password := range x.passwords {
+		decrypted := zipCryptoDecrypt(encrypted, password)
+		if decrypted[11] != check {
+			continue
+		}
+
+		var r io.Reader
+		switch f.Method {
+		case zip.Store:
+			r = bytes.NewReader(decrypted[12:])
+		case zip.Deflate:
+			r = flate.NewReader(bytes.NewReader(decrypted[12:]))
+		default:
+			return nil, zip.ErrAlgorithm
+		}
+
+		contents, err := x.read(r)
+		if err != nil || crc32.ChecksumIEEE(contents) != f.CRC32 {
+			continue
+		}
+
+		return io.NopCloser(bytes.NewReader(contents)), nil
+	}
+
+	return nil, errArchivePassword
+}
+
+// zipCryptoDecrypt decrypts data with traditional PKWARE encryption. The
+// first 12 bytes of the result are the encryption header.
+func zipCryptoDecrypt(data []byte, password string) []byte {
+	keys := [3]uint32{305419896, 591751049, 878082192}
+
+	update := func(b byte) {
+		keys[0] = crc32.IEEETable[(keys[0]^uint32(b))&0xff] ^ (keys[0] >> 8)
+		keys[1] = (keys[1]+(keys[0]&0xff))*134775813 + 1
+		keys[2] = crc32.IEEETable[(keys[2]^(keys[1]>>24))&0xff] ^ (keys[2] >> 8)
+	}
+
+	for i := 0; i < len(password); i++ {
+		update(password[i])
+	}
+
+	out := make([]byte, len(data))
+	for i, c := range data {
+		temp := keys[2] | 2
+		out[i] = c ^ byte((temp*(temp^1))>>8)
+		update(out[i])
+	}
+
+	return out
+}
+
+func (x *archiveExtractor) extract7z(data []byte, depth int) error {
+	// Keep track of the state before trying each password so a failed attempt
+	// doesn't count towards the limits.
+	files, size, members := x.files, x.size, len(x.members)
+
+	var err error
+	for _, password := range append([]string{""}, x.passwords...) {
+		x.files, x.size, x.members = files, size, x.members[:members]
+
+		if err = x.try7z(data, password, depth); err == nil || errors.Is(err, errArchiveLimit) {
+			return err
+		}
+	}
+
+	if len(x.passwords) > 0 {
+		return fmt.Errorf("%w: %s", errArchivePassword, err.Error())
+	}
+
+	return err
+}
+
+func (x *archiveExtractor) try7z(data []byte, password string, depth int) error {
+	zr, err := sevenzip.NewReaderWithPassword(bytes.NewReader(data), int64(len(data)), password)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		err = x.add(f.Name, r, depth)
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+var testArchiveLimits = ArchiveLimits{MaxDepth: 2, MaxSize: 1024, MaxFiles: 10}
+
+// buildZip creates a ZIP archive containing the given files.
+func buildZip(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		require.Nil(t, err, "should be able to create zip file")
+		_, err = w.Write(contents)
+		require.Nil(t, err, "should be able to write zip file")
+	}
+
+	require.Nil(t, zw.Close(), "should be able to close zip")
+	return buf.Bytes()
+}
+
+// buildTarGz creates a gzipped tar archive containing the given files.
+func buildTarGz(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+
+	for name, contents := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+		require.Nil(t, err, "should be able to write tar header")
+		_, err = tw.Write(contents)
+		require.Nil(t, err, "should be able to write tar file")
+	}
+
+	require.Nil(t, tw.Close(), "should be able to close tar")
+	require.Nil(t, gw.Close(), "should be able to close gzip")
+	return buf.Bytes()
+}
+
+// memberNames returns the names of extracted members.
+func memberNames(members []ArchiveMember) []string {
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+
+	return names
+}
+
+func TestIsArchiveAttachment(t *testing.T) {
+	assert.True(t, IsArchiveAttachment(&email.Attachment{Filename: "bills.ZIP"}))
+	assert.True(t, IsArchiveAttachment(&email.Attachment{Filename: "bills", ContentType: "application/x-7z-compressed"}))
+	assert.False(t, IsArchiveAttachment(&email.Attachment{Filename: "bill.docx", ContentType: "application/octet-stream"}))
+}
+
+func TestExtractArchive(t *testing.T) {
+	nested := buildZip(t, map[string][]byte{"inner.pdf": []byte("inner")})
+	archive := buildZip(t, map[string][]byte{
+		"bill.pdf":            []byte("bill"),
+		"nested.zip":          nested,
+		"folder/":             nil,
+		"__MACOSX/._bill.pdf": []byte("meta"),
+		"fake.zip":            []byte("not an archive"),
+	})
+
+	members, err := ExtractArchive("bills.zip", archive, testArchiveLimits, nil)
+	require.Nil(t, err, "archive should extract")
+	assert.ElementsMatch(t, []string{"bill.pdf", "inner.pdf", "fake.zip"}, memberNames(members))
+
+	archive = buildTarGz(t, map[string][]byte{"docs/bill.pdf": []byte("bill")})
+	members, err = ExtractArchive("bills.tar.gz", archive, testArchiveLimits, nil)
+	require.Nil(t, err, "tar archive should extract")
+	require.Len(t, members, 1)
+	assert.Equal(t, "docs/bill.pdf", members[0].Name)
+	assert.Equal(t, []byte("bill"), members[0].Content)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("bill"))
+	gw.Close()
+	members, err = ExtractArchive("bill.pdf.gz", buf.Bytes(), testArchiveLimits, nil)
+	require.Nil(t, err, "gzip file should extract")
+	assert.Equal(t, []string{"bill.pdf"}, memberNames(members))
+
+	_, err = ExtractArchive("bill.zip", []byte("nope"), testArchiveLimits, nil)
+	assert.ErrorIs(t, err, errArchiveFormat)
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	files := map[string][]byte{}
+	for _, name := range []string{"a", "b", "c"} {
+		files[name] = bytes.Repeat([]byte("a"), 400)
+	}
+	archive := buildZip(t, files)
+
+	_, err := ExtractArchive("big.zip", archive, testArchiveLimits, nil)
+	assert.ErrorIs(t, err, errArchiveLimit, "total size should be limited")
+
+	_, err = ExtractArchive("many.zip", archive, ArchiveLimits{MaxDepth: 1, MaxSize: 4096, MaxFiles: 2}, nil)
+	assert.ErrorIs(t, err, errArchiveLimit, "file count should be limited")
+
+	nested := buildZip(t, map[string][]byte{"bill.pdf": []byte("bill")})
+	for i := 0; i < 2; i++ {
+		nested = buildZip(t, map[string][]byte{"nested.zip": nested})
+	}
+
+	_, err = ExtractArchive("deep.zip", nested, testArchiveLimits, nil)
+	assert.ErrorIs(t, err, errArchiveLimit, "depth should be limited")
+
+	members, err := ExtractArchive("deep.zip", nested, ArchiveLimits{}, nil)
+	require.NoError(t, err, "limits of 0 should be unlimited")
+	assert.Equal(t, []ArchiveMember{{Name: "bill.pdf", Content: []byte("bill")}}, members)
+
+	members, err = ExtractArchive("big.zip", archive, ArchiveLimits{}, nil)
+	require.NoError(t, err)
+	assert.Len(t, members, 3)
+}
+
+func TestExtractEncryptedArchive(t *testing.T) {
+	tests := []struct {
+		filename string
+		name     string
+		contents string
+	}{
+		{"encrypted.zip", "invoice.txt", "invoice contents\ninvoice contents\ninvoice contents\n"},
+		{"encrypted-stream.zip", "-", "stored"},
+	}
+
+	for _, test := range tests {
+		data, err := os.ReadFile("testdata/archive/" + test.filename)
+		require.Nil(t, err, "should be able to read fixture")
+
+		_, err = ExtractArchive(test.filename, data, testArchiveLimits, []string{"wrong"})
+		assert.ErrorIs(t, err, errArchivePassword, "wrong password should not decrypt")
+
+		members, err := ExtractArchive(test.filename, data, testArchiveLimits, []string{"wrong", "secret"})
+		require.Nil(t, err, "correct password should decrypt")
+		require.Len(t, members, 1)
+		assert.Equal(t, test.name, members[0].Name)
+		assert.Equal(t, test.contents, string(members[0].Content))
+	}
+}
+
+func TestExtract7z(t *testing.T) {
+	data, err := os.ReadFile("testdata/archive/files.7z")
+	require.Nil(t, err, "should be able to read fixture")
+
+	members, err := ExtractArchive("files.7z", data, testArchiveLimits, nil)
+	require.Nil(t, err, "7z archive should extract")
+	assert.ElementsMatch(t, []string{"foo", "bar"}, memberNames(members))
+}
+
+func TestUploadArchive(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	handler := EmailHandler{
+		ExtractArchives: true,
+		ArchiveLimits:   testArchiveLimits,
+		paperless:       paperless,
+	}
+
+	attachment := &email.Attachment{
+		Filename: "bills.zip",
+		Content:  buildZip(t, map[string][]byte{"2021/bill.pdf": []byte("bill")}),
+	}
+
+	err := handler.UploadAttachment(attachment)
+	require.Nil(t, err, "archive should be uploaded")
+
+	require.Len(t, *documents, 1, "archive member should be uploaded")
+	assert.Equal(t, "bill.pdf", (*documents)[0].Filename)
+	assert.Equal(t, "bill", (*documents)[0].Contents)
+
+	encrypted, err := os.ReadFile("testdata/archive/encrypted.zip")
+	require.Nil(t, err, "should be able to read fixture")
+
+	files := map[string][]byte{}
+	for _, name := range []string{"a", "b", "c"} {
+		files[name] = bytes.Repeat([]byte("a"), 400)
+	}
+
+	for name, content := range map[string][]byte{
+		"broken.zip":    []byte("not an archive"),
+		"encrypted.zip": encrypted,
+		"big.zip":       buildZip(t, files),
+	} {
+		*documents = nil
+		attachment.Filename = name
+		attachment.Content = content
+
+		err = handler.UploadAttachment(attachment)
+		require.Nil(t, err, "archives that can't be extracted should not fail the email")
+		require.Len(t, *documents, 1)
+		assert.Equal(t, name, (*documents)[0].Filename)
+		assert.Equal(t, string(content), (*documents)[0].Contents, "original archive should be uploaded")
+	}
+}
+
+func TestUploadArchiveMemberFailure(t *testing.T) {
+	var uploaded []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, header, err := req.FormFile("document")
+		if !assert.NoError(t, err) || header.Filename == "a.pdf" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		uploaded = append(uploaded, header.Filename)
+		fmt.Fprint(w, "OK")
+	}))
+	t.Cleanup(ts.Close)
+
+	handler := EmailHandler{
+		ExtractArchives: true,
+		ArchiveLimits:   testArchiveLimits,
+		paperless:       paperless.New(ts.URL, "apiKey", http.DefaultClient),
+	}
+
+	attachment := &email.Attachment{
+		Filename: "bills.zip",
+		Content:  buildZip(t, map[string][]byte{"a.pdf": []byte("a"), "b.pdf": []byte("b")}),
+	}
+
+	err := handler.UploadAttachment(attachment)
+	assert.Error(t, err, "failed members should still fail the email")
+	assert.Equal(t, []string{"b.pdf"}, uploaded, "other members should be uploaded")
+}
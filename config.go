@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig reads the configuration from environment variables prefixed with
+// MAILHOOK_ and, if MAILHOOK_CONFIGFILE is set, a YAML file. Environment
+// variables take precedence over the file.
+func LoadConfig() (Config, error) {
+	var cfg Config
+	if err := envconfig.Process("mailhook", &cfg); err != nil {
+		return cfg, err
+	}
+
+	var targetNames []string
+	targetNodes := map[string]*yaml.Node{}
+
+	if cfg.ConfigFile != "" {
+		root, err := readConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return cfg, fmt.Errorf("could not read config file: %w", err)
+		}
+
+		// Targets may be a list of names configured by environment variables,
+		// or a mapping of names to their settings.
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			key, value := root.Content[i], root.Content[i+1]
+			if !strings.EqualFold(key.Value, "targets") || value.Kind != yaml.MappingNode {
+				continue
+			}
+
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name := value.Content[j].Value
+				targetNames = append(targetNames, name)
+				targetNodes[name] = value.Content[j+1]
+			}
+
+			root.Content = append(root.Content[:i:i], root.Content[i+2:]...)
+			break
+		}
+
+		if err = applyConfig(&cfg, "mailhook", root); err != nil {
+			return cfg, fmt.Errorf("invalid config file: %w", err)
+		}
+	}
+
+	for _, name := range cfg.Targets {
+		if _, ok := targetNodes[name]; !ok {
+			targetNames = append(targetNames, name)
+		}
+	}
+
+	for _, name := range targetNames {
+		target, err := loadTargetConfig(name, targetNodes[name])
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TargetConfigs = append(cfg.TargetConfigs, target)
+	}
+
+	// The default Paperless instance is optional when every email is routed
+	// to a target.
+	if cfg.PaperlessEndpoint != "" || cfg.PaperlessAPIKey != "" || len(cfg.TargetConfigs) == 0 {
+		if cfg.PaperlessEndpoint == "" || cfg.PaperlessAPIKey == "" || len(cfg.AllowedEmails) == 0 {
+			return cfg, errors.New("required key MAILHOOK_PAPERLESSENDPOINT, MAILHOOK_PAPERLESSAPIKEY or MAILHOOK_ALLOWEDEMAILS missing value")
+		}
+	}
+
+	// Senders are matched in lowercase, as when reading them from a file.
+	owners := make(OwnerRules, len(cfg.Owners))
+	for sender, rule := range cfg.Owners {
+		owners[strings.ToLower(sender)] = rule
+	}
+	cfg.Owners = owners
+
+	passwords := make(PDFPasswords, len(cfg.PDFPasswords))
+	for sender, values := range cfg.PDFPasswords {
+		passwords[strings.ToLower(sender)] = values
+	}
+	cfg.PDFPasswords = passwords
+
+	return cfg, nil
+}
+
+// loadTargetConfig reads a target's settings from the environment and the
+// node from the configuration file, if any.
+func loadTargetConfig(name string, node *yaml.Node) (TargetConfig, error) {
+	target := TargetConfig{Name: name}
+	if !targetName.MatchString(name) {
+		return target, target.validate()
+	}
+
+	prefix := "mailhook_target_" + name
+	if err := envconfig.Process(prefix, &target); err != nil {
+		return target, fmt.Errorf("could not load target %s: %w", name, err)
+	}
+
+	if node != nil {
+		if err := applyConfig(&target, prefix, node); err != nil {
+			return target, fmt.Errorf("invalid config for target %s: %w", name, err)
+		}
+	}
+
+	return target, target.validate()
+}
+
+// readConfigFile parses a YAML file, returning its top level mapping.
+func readConfigFile(name string) (*yaml.Node, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	// An empty file has no content.
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+
+	return doc.Content[0], nil
+}
+
+// applyConfig sets the fields of spec from the keys of a YAML mapping, which
+// match field names ignoring case. Fields set by an environment variable with
+// the prefix are skipped, so the environment overrides the file.
+func applyConfig(spec interface{}, prefix string, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping of settings", node.Line)
+	}
+
+	s := reflect.ValueOf(spec).Elem()
+	t := s.Type()
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		index := -1
+		for j := 0; j < t.NumField(); j++ {
+			if strings.EqualFold(t.Field(j).Name, key.Value) {
+				index = j
+				break
+			}
+		}
+		if index < 0 || t.Field(index).Tag.Get("yaml") == "-" {
+			return fmt.Errorf("line %d: unknown setting %s", key.Line, key.Value)
+		}
+
+		field := t.Field(index)
+		if field.Tag.Get("ignored") != "true" {
+			if _, ok := os.LookupEnv(strings.ToUpper(prefix + "_" + field.Name)); ok {
+				continue
+			}
+		}
+
+		if err := decodeConfigValue(s.Field(index), value); err != nil {
+			return fmt.Errorf("line %d: invalid %s: %w", value.Line, key.Value, err)
+		}
+	}
+
+	return nil
+}
+
+// decodeConfigValue decodes a YAML value into a field. Types that validate
+// environment variables also validate the file, and lists may be written as
+// comma separated strings like in environment variables.
+func decodeConfigValue(field reflect.Value, value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		if decoder, ok := field.Addr().Interface().(envconfig.Decoder); ok {
+			return decoder.Decode(value.Value)
+		}
+
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+			var values []string
+			for _, v := range strings.Split(value.Value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					values = append(values, v)
+				}
+			}
+			field.Set(reflect.ValueOf(values).Convert(field.Type()))
+			return nil
+		}
+	}
+
+	return value.Decode(field.Addr().Interface())
+}
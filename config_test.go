@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfig writes a configuration file and points MAILHOOK_CONFIGFILE at it.
+func writeConfig(t *testing.T, contents string) {
+	name := filepath.Join(t.TempDir(), "mailhook.yaml")
+	require.NoError(t, os.WriteFile(name, []byte(contents), 0600))
+	setenv(t, map[string]string{"MAILHOOK_CONFIGFILE": name})
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	writeConfig(t, `
+paperlessEndpoint: http://file
+paperlessAPIKey: fileKey
+allowedEmails:
+  - me@example.com
+  - you@example.com
+archivePasswords: one, two
+bodyPolicy: both
+emailMaxDepth: 2
+owners:
+  Me@example.com:
+    owner: me
+    view: [family]
+pdfPasswords:
+  "@Bank.example": [secret]
+targets:
+  office:
+    paperlessEndpoint: http://office
+    paperlessAPIKey: officeKey
+    allowedEmails: boss@example.com
+    toAddress: office@
+`)
+	setenv(t, map[string]string{
+		"MAILHOOK_PAPERLESSENDPOINT":             "http://env",
+		"MAILHOOK_TARGET_OFFICE_PAPERLESSAPIKEY": "envKey",
+	})
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+
+	assert.Equal(t, "http://env", cfg.PaperlessEndpoint, "environment should override file")
+	assert.Equal(t, "fileKey", cfg.PaperlessAPIKey)
+	assert.Equal(t, []string{"me@example.com", "you@example.com"}, cfg.AllowedEmails)
+	assert.Equal(t, []string{"one", "two"}, cfg.ArchivePasswords, "lists may be comma separated")
+	assert.Equal(t, BodyAndAttachments, cfg.BodyPolicy)
+	assert.Equal(t, 2, cfg.EmailMaxDepth)
+	assert.Equal(t, 3, cfg.ArchiveMaxDepth, "defaults should apply to unset values")
+	assert.Equal(t, OwnerRules{"me@example.com": {Owner: "me", View: []string{"family"}}}, cfg.Owners)
+	assert.Equal(t, PDFPasswords{"@bank.example": {"secret"}}, cfg.PDFPasswords)
+
+	assert.Equal(t, []TargetConfig{{
+		Name:              "office",
+		PaperlessEndpoint: "http://office",
+		PaperlessAPIKey:   "envKey",
+		AllowedEmails:     []string{"boss@example.com"},
+		ToAddress:         "office@",
+	}}, cfg.TargetConfigs)
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown setting": "paperlessEndpoint: http://file\nunknown: true\n",
+		"bad policy":      "bodyPolicy: sometimes\n",
+		"bad type":        "emailMaxDepth: deep\n",
+		"config file":     "configFile: other.yaml\n",
+		"missing keys":    "paperlessEndpoint: http://file\n",
+		"bad target":      "paperlessEndpoint: http://file\npaperlessAPIKey: key\nallowedEmails: me@example.com\ntargets:\n  office:\n    paperlessEndpoint: http://office\n",
+		"not a mapping":   "- paperlessEndpoint\n",
+	}
+
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			writeConfig(t, contents)
+
+			_, err := LoadConfig()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mailhook.yaml")
+	require.NoError(t, os.WriteFile(name, []byte("debug: false\n"), 0600))
+
+	reloads := make(chan struct{}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go WatchConfig(ctx, name, 5*time.Millisecond, func() {
+		reloads <- struct{}{}
+	})
+
+	// Give the watcher time to record the original modification time.
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, os.WriteFile(name, []byte("debug: true\n"), 0600))
+	require.NoError(t, os.Chtimes(name, time.Now(), time.Now().Add(time.Minute)))
+
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Error("configuration was not reloaded after the file changed")
+	}
+}
+
+func TestHandlerSwap(t *testing.T) {
+	first, firstDocuments := newTestPaperless(t)
+	second, secondDocuments := newTestPaperless(t)
+
+	var handlers HandlerSwap
+	handlers.Store(&EmailHandler{AllowList: AllowList{[]string{"me@example.com"}, ""}, paperless: first})
+
+	raw := "From: me@example.com\r\nSubject: Test\r\nContent-Type: text/plain\r\n\r\nBody\r\n"
+
+	w := httptest.NewRecorder()
+	handlers.sendGrid(w, newSendGridRequest(t, "me@example.com", []string{"home@example.com"}, raw))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	handlers.Store(&EmailHandler{AllowList: AllowList{[]string{"me@example.com"}, ""}, paperless: second})
+
+	w = httptest.NewRecorder()
+	handlers.sendGrid(w, newSendGridRequest(t, "me@example.com", []string{"home@example.com"}, raw))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Len(t, *firstDocuments, 1)
+	assert.Len(t, *secondDocuments, 1, "requests after a reload should use the new handler")
+}
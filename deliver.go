@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+// Exit codes from sysexits.h, which mail transfer agents use to decide if a
+// message should be bounced or retried later.
+const (
+	exitOK       = 0
+	exitUsage    = 64 // EX_USAGE
+	exitDataErr  = 65 // EX_DATAERR
+	exitIOErr    = 74 // EX_IOERR
+	exitTempFail = 75 // EX_TEMPFAIL
+	exitConfig   = 78 // EX_CONFIG
+)
+
+// deliverTaskTimeout is how long to wait for Paperless to consume uploaded
+// documents so their owner can be set. Mail servers kill and retry commands
+// that take too long, which would upload every document again.
+const deliverTaskTimeout = time.Minute
+
+// deliverCommand runs the deliver subcommand, processing a single message
+// from stdin and returning the exit code.
+func deliverCommand(args []string, stdin io.Reader, stdout io.Writer) int {
+	flags := flag.NewFlagSet("deliver", flag.ContinueOnError)
+	sender := flags.String("sender", os.Getenv("SENDER"), "envelope sender, defaults to $SENDER or the From header")
+	recipient := flags.String("recipient", os.Getenv("RECIPIENT"), "comma separated envelope recipients, defaults to $RECIPIENT or the To and Cc headers")
+	dryRun := flags.Bool("dry-run", false, "write a report of the documents that would be uploaded without uploading them")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s deliver [flags] < message\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		if err == nil {
+			flags.Usage()
+		}
+		return exitUsage
+	}
+
+	raw, err := io.ReadAll(stdin)
+	if err != nil {
+		log.Errorf("could not read message: %s", err.Error())
+		return exitIOErr
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Error(err.Error())
+		return exitConfig
+	}
+	setLogLevel(cfg.Debug)
+
+	// Only retry the message if Paperless couldn't be reached to resolve tags
+	// or owners, since an invalid configuration won't fix itself.
+	handler, err := NewEmailHandler(cfg, &http.Client{Transport: newAddHeaderTransport(nil)})
+	if err != nil {
+		log.Error(err.Error())
+		if temporaryError(err) {
+			return exitTempFail
+		}
+		return exitConfig
+	}
+
+	from, to := deliveryEnvelope(raw)
+	if *sender != "" {
+		from = *sender
+	}
+	if *recipient != "" {
+		to = splitRecipients(*recipient)
+	}
+
+	logCtx := log.WithFields(log.Fields{
+		"from": from,
+		"to":   to,
+	})
+	logCtx.Info("got email")
+
+	var report *DryRunReport
+	if *dryRun || handler.DryRun {
+		logCtx = logCtx.WithField("dry_run", true)
+		report = &DryRunReport{From: from, To: to, Documents: []DryRunDocument{}}
+	}
+
+	incomingEmails.Inc()
+	err = handler.receive(logCtx, from, to, raw, report)
+	if !waitForTasks(deliverTaskTimeout) {
+		logCtx.Warn("paperless did not consume documents in time, document owners may not be set")
+	}
+
+	if report != nil {
+		if err := json.NewEncoder(stdout).Encode(report); err != nil {
+			log.Errorf("could not write dry run report: %s", err.Error())
+		}
+	}
+
+	logCtx.Info("finished handling email")
+
+	return deliveryExitCode(err)
+}
+
+// deliveryExitCode returns the exit code for the result of processing a
+// message. Messages that can never be processed are rejected, while anything
+// else is assumed to be temporary so the message is retried.
+func deliveryExitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	if errors.Is(err, errInvalidEmail) || errors.Is(err, errProcessingLimit) {
+		return exitDataErr
+	}
+
+	// Paperless rejecting a document won't change on retrying, unless it was
+	// rate limited.
+	var paperlessError *paperless.PaperlessError
+	if errors.As(err, &paperlessError) && paperlessError.StatusCode >= 400 && paperlessError.StatusCode < 500 && paperlessError.StatusCode != http.StatusTooManyRequests {
+		return exitDataErr
+	}
+
+	return exitTempFail
+}
+
+// splitRecipients splits a comma separated list of recipients.
+func splitRecipients(value string) []string {
+	var recipients []string
+	for _, recipient := range strings.Split(value, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+
+	return recipients
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+func TestDeliveryExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, exitOK},
+		{fmt.Errorf("%w: bad header", errInvalidEmail), exitDataErr},
+		{fmt.Errorf("%w: too many attachments", errProcessingLimit), exitDataErr},
+		{&paperless.PaperlessError{StatusCode: http.StatusBadRequest}, exitDataErr},
+		{&paperless.PaperlessError{StatusCode: http.StatusTooManyRequests}, exitTempFail},
+		{&paperless.PaperlessError{StatusCode: http.StatusBadGateway}, exitTempFail},
+		{errors.New("connection refused"), exitTempFail},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.code, deliveryExitCode(test.err), "%v", test.err)
+	}
+}
+
+func TestDeliverCommand(t *testing.T) {
+	status := http.StatusOK
+	var uploads []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, header, err := req.FormFile("document")
+		if err == nil {
+			uploads = append(uploads, header.Filename)
+		}
+
+		w.WriteHeader(status)
+		fmt.Fprint(w, `"task"`)
+	}))
+	t.Cleanup(ts.Close)
+
+	setenv(t, map[string]string{
+		"MAILHOOK_PAPERLESSENDPOINT": ts.URL,
+		"MAILHOOK_PAPERLESSAPIKEY":   "apiKey",
+		"MAILHOOK_ALLOWEDEMAILS":     "me@example.com",
+		"SENDER":                     "me@example.com",
+		"RECIPIENT":                  "home@example.com",
+	})
+
+	raw := "From: someone@example.com\r\nSubject: Invoice\r\nContent-Type: text/plain\r\n\r\nBody\r\n"
+
+	code := deliverCommand(nil, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, []string{"Invoice.pdf"}, uploads, "sender should be taken from the environment")
+
+	code = deliverCommand([]string{"-sender", "someone@example.com"}, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitOK, code, "emails that aren't allowed should be accepted")
+	assert.Len(t, uploads, 1, "flags should override the environment")
+
+	status = http.StatusServiceUnavailable
+	code = deliverCommand(nil, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitTempFail, code, "unavailable paperless should be retried")
+
+	status = http.StatusBadRequest
+	code = deliverCommand(nil, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitDataErr, code, "rejected documents should not be retried")
+
+	var output bytes.Buffer
+	code = deliverCommand([]string{"-dry-run"}, strings.NewReader(raw), &output)
+	assert.Equal(t, exitOK, code)
+	assert.Contains(t, output.String(), `"filename":"Invoice.pdf"`)
+
+	code = deliverCommand([]string{"extra"}, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitUsage, code)
+}
+
+func TestDeliverCommandConfig(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"results": []}`)
+	}))
+	t.Cleanup(ts.Close)
+
+	raw := "From: me@example.com\r\nSubject: Invoice\r\nContent-Type: text/plain\r\n\r\nBody\r\n"
+
+	setenv(t, map[string]string{
+		"MAILHOOK_PAPERLESSENDPOINT":   ts.URL,
+		"MAILHOOK_PAPERLESSAPIKEY":     "apiKey",
+		"MAILHOOK_ALLOWEDEMAILS":       "me@example.com",
+		"MAILHOOK_MAILDIRPOLLINTERVAL": "often",
+	})
+	code := deliverCommand(nil, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitConfig, code, "invalid settings should not be retried")
+
+	setenv(t, map[string]string{
+		"MAILHOOK_PAPERLESSENDPOINT":   ts.URL,
+		"MAILHOOK_PAPERLESSAPIKEY":     "apiKey",
+		"MAILHOOK_ALLOWEDEMAILS":       "me@example.com",
+		"MAILHOOK_PAPERLESSTAGS":       "missing",
+		"MAILHOOK_MAILDIRPOLLINTERVAL": "30s",
+	})
+	code = deliverCommand(nil, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitConfig, code, "tags that don't exist should not be retried")
+
+	ts.Close()
+	code = deliverCommand(nil, strings.NewReader(raw), &bytes.Buffer{})
+	assert.Equal(t, exitTempFail, code, "unavailable paperless should be retried")
+}
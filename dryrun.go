@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+// DryRunHeader enables a dry run for a single request when set to true.
+const DryRunHeader = "X-Mailhook-Dry-Run"
+
+// DryRunReport describes what would have been uploaded for an email during a
+// dry run.
+type DryRunReport struct {
+	From      string           `json:"from"`
+	To        []string         `json:"to"`
+	Target    string           `json:"target,omitempty"`
+	Allowed   bool             `json:"allowed"`
+	Error     string           `json:"error,omitempty"`
+	Documents []DryRunDocument `json:"documents"`
+}
+
+// DryRunDocument is a document that would have been uploaded, with the
+// metadata it would have been uploaded with.
+type DryRunDocument struct {
+	Filename      string     `json:"filename"`
+	ContentType   string     `json:"content_type"`
+	Size          int        `json:"size"`
+	Tags          []int      `json:"tags"`
+	Created       *time.Time `json:"created,omitempty"`
+	Correspondent int        `json:"correspondent,omitempty"`
+
+	Owner       int                    `json:"owner,omitempty"`
+	Permissions *paperless.Permissions `json:"permissions,omitempty"`
+}
+
+// isDryRun checks if a request should be evaluated without uploading.
+func (handler *EmailHandler) isDryRun(req *http.Request) bool {
+	if handler.DryRun {
+		return true
+	}
+
+	dryRun, _ := strconv.ParseBool(req.Header.Get(DryRunHeader))
+	return dryRun
+}
+
+// withReport returns a copy of the handler that records documents in the
+// report instead of uploading them.
+func (handler *EmailHandler) withReport(report *DryRunReport) *EmailHandler {
+	h := *handler
+	h.report = report
+
+	return &h
+}
+
+// record adds a document to the dry run report.
+func (handler *EmailHandler) record(r io.Reader, filename string, metadata paperless.DocumentMetadata) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	document := DryRunDocument{
+		Filename:      filename,
+		ContentType:   http.DetectContentType(data),
+		Size:          len(data),
+		Tags:          metadata.Tags,
+		Correspondent: metadata.Correspondent,
+	}
+	if document.Tags == nil {
+		document.Tags = []int{}
+	}
+	if !metadata.Created.IsZero() {
+		document.Created = &metadata.Created
+	}
+	if owner, ok := handler.currentOwner(); ok {
+		document.Owner = owner.owner
+		document.Permissions = &owner.permissions
+	}
+
+	log.WithFields(log.Fields{
+		"filename": filename,
+		"size":     document.Size,
+		"tags":     document.Tags,
+	}).Info("dry run, not uploading document")
+
+	handler.report.Documents = append(handler.report.Documents, document)
+
+	return nil
+}
+
+// fail records why an email was not processed, if there is a report.
+func (report *DryRunReport) fail(err error) {
+	if report != nil {
+		report.Error = err.Error()
+	}
+}
+
+// respond finishes a webhook request, writing the report for dry runs.
+func respond(w http.ResponseWriter, report *DryRunReport) {
+	if report == nil {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorf("could not write dry run report: %s", err.Error())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dryRunEmail = "From: me@example.com\r\n" +
+	"Subject: Invoice\r\n" +
+	"Date: Tue, 02 Mar 2021 10:00:00 +0000\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"\r\n" +
+	"%PDF-1.4 invoice\r\n" +
+	"--b--\r\n"
+
+func TestSendGridDryRun(t *testing.T) {
+	client, documents := newTestPaperless(t)
+
+	handler := &EmailHandler{
+		AllowList:  AllowList{[]string{"me@example.com"}, ""},
+		Tags:       []int{3},
+		SetCreated: true,
+		paperless:  client,
+		owners:     map[string]documentOwner{"@example.com": {owner: 7}},
+	}
+
+	req := newSendGridRequest(t, "me@example.com", []string{"home@example.com"}, dryRunEmail)
+	req.Header.Set(DryRunHeader, "true")
+
+	w := httptest.NewRecorder()
+	handler.sendGrid(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Empty(t, *documents, "nothing should be uploaded during a dry run")
+
+	var report DryRunReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+
+	assert.True(t, report.Allowed)
+	assert.Empty(t, report.Error)
+	assert.Equal(t, "me@example.com", report.From)
+	require.Len(t, report.Documents, 1)
+
+	document := report.Documents[0]
+	assert.Equal(t, "invoice.pdf", document.Filename)
+	assert.Equal(t, "application/pdf", document.ContentType)
+	assert.Equal(t, len("%PDF-1.4 invoice"), document.Size)
+	assert.Equal(t, []int{3}, document.Tags)
+	require.NotNil(t, document.Created)
+	assert.Equal(t, 2021, document.Created.Year())
+	assert.Equal(t, 7, document.Owner)
+
+	w = httptest.NewRecorder()
+	handler.sendGrid(w, newSendGridRequest(t, "me@example.com", []string{"home@example.com"}, dryRunEmail))
+
+	assert.Equal(t, "OK", w.Body.String())
+	assert.Len(t, *documents, 1, "requests without the header should upload")
+}
+
+func TestSendGridDryRunSetting(t *testing.T) {
+	client, documents := newTestPaperless(t)
+
+	handler := &EmailHandler{
+		AllowList: AllowList{[]string{"me@example.com"}, ""},
+		DryRun:    true,
+		paperless: client,
+	}
+
+	w := httptest.NewRecorder()
+	handler.sendGrid(w, newSendGridRequest(t, "other@example.com", []string{"home@example.com"}, dryRunEmail))
+
+	var report DryRunReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.False(t, report.Allowed, "report should show the sender was not allowed")
+	assert.Empty(t, report.Documents)
+
+	w = httptest.NewRecorder()
+	handler.sendGrid(w, newSendGridRequest(t, "me@example.com", []string{"home@example.com"}, dryRunEmail))
+
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Allowed)
+	assert.Len(t, report.Documents, 1)
+	assert.Empty(t, *documents, "nothing should be uploaded when dry run is enabled")
+}
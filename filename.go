@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxFilenameLength is the longest filename in bytes that will be uploaded,
+// leaving room for Paperless to add its own suffixes within common filesystem
+// limits.
+const maxFilenameLength = 200
+
+// replyPrefix matches reply and forward prefixes at the start of a subject,
+// including common translations and counters such as "Re[2]:".
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|fw|fwd|aw|wg|sv|vs|tr|antw|rif|enc)\s*(\[\d+\]|\(\d+\))?\s*:\s*`)
+
+// unsafeFilenameChars are characters that are not allowed in filenames on
+// common filesystems.
+var unsafeFilenameChars = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f\x7f]+`)
+
+// spaces matches runs of whitespace.
+var spaces = regexp.MustCompile(`\s+`)
+
+// DocumentName contains the fields made available to filename templates.
+type DocumentName struct {
+	// Subject is the email's subject without any reply or forward prefixes.
+	Subject string
+	// From is the sender's name, or their address if they had no name.
+	From string
+	// FromAddress is the sender's email address.
+	FromAddress string
+	// Date is when the email was sent, or the current time if it wasn't set.
+	Date time.Time
+	// ForwardedBy is the sender of a forwarded email, whose original sender is
+	// used for the other fields.
+	ForwardedBy string
+
+	// Filename is the original filename of an attachment, with Name and Ext
+	// being the filename without its extension and the extension.
+	Filename string
+	Name     string
+	Ext      string
+	// Index counts the attachments uploaded from an email, starting at 1.
+	Index int
+}
+
+// FilenameTemplates are Go templates for the names of uploaded documents. If a
+// template isn't set, the subject is used for emails and the original filename
+// for attachments.
+type FilenameTemplates struct {
+	Content    *template.Template
+	Attachment *template.Template
+}
+
+// ParseFilenameTemplates parses the templates used for email content and
+// attachment filenames. Empty templates use the defaults.
+func ParseFilenameTemplates(content, attachment string) (FilenameTemplates, error) {
+	var templates FilenameTemplates
+	var err error
+
+	if content != "" {
+		if templates.Content, err = template.New("content").Option("missingkey=error").Parse(content); err != nil {
+			return templates, err
+		}
+	}
+
+	if attachment != "" {
+		if templates.Attachment, err = template.New("attachment").Option("missingkey=error").Parse(attachment); err != nil {
+			return templates, err
+		}
+	}
+
+	return templates, nil
+}
+
+// NewDocumentName extracts the template fields from an email.
+func NewDocumentName(email *email.Email) DocumentName {
+	if email == nil {
+		return DocumentName{Date: time.Now()}
+	}
+
+	return originDocumentName(NewEmailOrigin(email))
+}
+
+// originDocumentName returns the template fields for the origin of an email.
+func originDocumentName(origin EmailOrigin) DocumentName {
+	name := DocumentName{Date: time.Now()}
+	name.Subject = StripReplyPrefixes(origin.Subject)
+	name.From = origin.From
+	name.FromAddress = origin.From
+	if address, err := mail.ParseAddress(origin.From); err == nil {
+		name.FromAddress = address.Address
+		name.From = address.Address
+		if address.Name != "" {
+			name.From = address.Name
+		}
+	}
+
+	if !origin.Date.IsZero() {
+		name.Date = origin.Date
+	}
+	name.ForwardedBy = origin.ForwardedBy
+
+	return name
+}
+
+// ForContent returns the filename for the converted content of an email.
+func (templates FilenameTemplates) ForContent(email *email.Email) string {
+	if templates.Content == nil {
+		return ContentFilename(email)
+	}
+
+	return templates.renderContent(email, NewDocumentName(email))
+}
+
+// renderContent renders the content filename template.
+func (templates FilenameTemplates) renderContent(email *email.Email, fields DocumentName) string {
+	name, err := render(templates.Content, fields)
+	if err != nil {
+		log.Warnf("could not render content filename, using default: %s", err.Error())
+		return ContentFilename(email)
+	}
+
+	return withExtension(name, ".pdf", "Email")
+}
+
+// ForAttachment returns the filename for an attachment of an email. The
+// original extension is added if the template didn't include it.
+func (templates FilenameTemplates) ForAttachment(email *email.Email, filename string, index int) string {
+	if templates.Attachment == nil {
+		ext := filepath.Ext(filename)
+		return withExtension(strings.TrimSuffix(filename, ext), ext, "attachment")
+	}
+
+	return templates.renderAttachment(NewDocumentName(email), filename, index)
+}
+
+// renderAttachment renders the attachment filename template.
+func (templates FilenameTemplates) renderAttachment(name DocumentName, filename string, index int) string {
+	ext := filepath.Ext(filename)
+	name.Filename = filename
+	name.Name = strings.TrimSuffix(filename, ext)
+	name.Ext = ext
+	name.Index = index
+
+	rendered, err := render(templates.Attachment, name)
+	if err != nil {
+		log.Warnf("could not render attachment filename, using original: %s", err.Error())
+		rendered = name.Name
+	}
+
+	return withExtension(rendered, ext, "attachment")
+}
+
+// render executes a filename template.
+func render(tmpl *template.Template, name DocumentName) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, name); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// ContentFilename is the default filename used for converted email content.
+func ContentFilename(email *email.Email) string {
+	return withExtension(StripReplyPrefixes(email.Subject), ".pdf", "Email")
+}
+
+// StripReplyPrefixes removes any number of reply and forward prefixes, such as
+// "Re:" or "Fwd:", from a subject.
+func StripReplyPrefixes(subject string) string {
+	for {
+		loc := replyPrefix.FindStringIndex(subject)
+		if loc == nil {
+			return strings.TrimSpace(subject)
+		}
+
+		subject = subject[loc[1]:]
+	}
+}
+
+// SanitizeFilename replaces characters that can't be used in filenames,
+// collapses whitespace, and limits the length of a filename.
+func SanitizeFilename(name string) string {
+	name = spaces.ReplaceAllString(name, " ")
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+
+	// Leading and trailing dots would hide the file or be removed by Windows.
+	name = strings.Trim(name, " .")
+
+	return truncate(name, maxFilenameLength)
+}
+
+// withExtension sanitizes a name and adds an extension, using the fallback if
+// nothing was left of the name.
+func withExtension(name, ext, fallback string) string {
+	ext = SanitizeFilename(ext)
+	if ext != "" {
+		ext = "." + ext
+	}
+
+	name = SanitizeFilename(name)
+	if strings.EqualFold(filepath.Ext(name), ext) {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	if name == "" {
+		name = fallback
+	}
+
+	return strings.TrimRight(truncate(name, maxFilenameLength-len(ext)), " .") + ext
+}
+
+// truncate shortens a string to at most n bytes without splitting a UTF-8
+// character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// attachmentFilename returns the filename to upload an attachment of the
+// email being processed as.
+func (handler *EmailHandler) attachmentFilename(filename string) string {
+	var current *email.Email
+	index := 1
+	if handler.processing != nil {
+		handler.processing.documents++
+		current = handler.processing.current()
+		index = handler.processing.documents
+	}
+
+	if handler.Filenames.Attachment == nil || current == nil {
+		return handler.Filenames.ForAttachment(current, filename, index)
+	}
+
+	return handler.Filenames.renderAttachment(originDocumentName(handler.emailOrigin(current)), filename, index)
+}
+
+// contentFilename returns the filename to upload the converted content of an
+// email as.
+func (handler *EmailHandler) contentFilename(email *email.Email) string {
+	if handler.Filenames.Content == nil {
+		return ContentFilename(email)
+	}
+
+	return handler.Filenames.renderContent(email, originDocumentName(handler.emailOrigin(email)))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripReplyPrefixes(t *testing.T) {
+	tests := []struct {
+		subject  string
+		expected string
+	}{
+		{"Invoice", "Invoice"},
+		{"Re: Invoice", "Invoice"},
+		{"RE: Fwd: FW: Invoice", "Invoice"},
+		{"Re[2]: Invoice", "Invoice"},
+		{"AW: WG: Rechnung", "Rechnung"},
+		{"  fwd :Invoice", "Invoice"},
+		{"Return: Invoice", "Return: Invoice"},
+		{"Invoice Re: March", "Invoice Re: March"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, StripReplyPrefixes(test.subject), test.subject)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Invoice 2021/03", "Invoice 2021_03"},
+		{`a\b:c*d?e"f<g>h|i`, "a_b_c_d_e_f_g_h_i"},
+		{"tab\tand\r\nnewline", "tab and newline"},
+		{"  .hidden.  ", "hidden"},
+		{"many    spaces", "many spaces"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, SanitizeFilename(test.name), test.name)
+	}
+
+	long := SanitizeFilename(strings.Repeat("é", 150))
+	assert.LessOrEqual(t, len(long), maxFilenameLength)
+	assert.True(t, strings.HasPrefix(strings.Repeat("é", 150), long), "truncation must not split characters")
+}
+
+func TestContentFilename(t *testing.T) {
+	tests := []struct {
+		subject  string
+		expected string
+	}{
+		{"Invoice", "Invoice.pdf"},
+		{"Fwd: Invoice 03/21", "Invoice 03_21.pdf"},
+		{"report.pdf", "report.pdf"},
+		{"", "Email.pdf"},
+		{"Re:", "Email.pdf"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ContentFilename(&email.Email{Subject: test.subject}), test.subject)
+	}
+
+	filename := ContentFilename(&email.Email{Subject: strings.Repeat("a", 300)})
+	assert.Len(t, filename, maxFilenameLength)
+	assert.True(t, strings.HasSuffix(filename, ".pdf"))
+}
+
+func newFilenameEmail() *email.Email {
+	return &email.Email{
+		From:    "Jane Doe <jane@example.com>",
+		Subject: "Re: Fwd: Invoice",
+		Headers: textproto.MIMEHeader{"Date": {"Tue, 02 Mar 2021 10:00:00 +0000"}},
+	}
+}
+
+func TestFilenameTemplates(t *testing.T) {
+	templates, err := ParseFilenameTemplates(
+		`{{.Date.Format "2006-01-02"}} {{.From}} - {{.Subject}}`,
+		`{{.Date.Format "2006-01-02"}} {{.FromAddress}} {{.Index}} {{.Name}}`,
+	)
+	require.NoError(t, err)
+
+	e := newFilenameEmail()
+
+	assert.Equal(t, "2021-03-02 Jane Doe - Invoice.pdf", templates.ForContent(e))
+	assert.Equal(t, "2021-03-02 jane@example.com 2 document.pdf", templates.ForAttachment(e, "document.pdf", 2))
+	assert.Equal(t, "2021-03-02 jane@example.com 1 notes", templates.ForAttachment(e, "notes", 1))
+}
+
+func TestFilenameTemplatesExtension(t *testing.T) {
+	templates, err := ParseFilenameTemplates("", `{{.Filename}}`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "document.pdf", templates.ForAttachment(newFilenameEmail(), "document.pdf", 1), "extension should not be repeated")
+}
+
+func TestFilenameTemplatesDefault(t *testing.T) {
+	var templates FilenameTemplates
+
+	e := newFilenameEmail()
+
+	assert.Equal(t, "Invoice.pdf", templates.ForContent(e))
+	assert.Equal(t, "a_b.pdf", templates.ForAttachment(e, "a:b.pdf", 1))
+	assert.Equal(t, "attachment", templates.ForAttachment(e, "", 1))
+}
+
+func TestFilenameTemplatesInvalid(t *testing.T) {
+	_, err := ParseFilenameTemplates("{{.Subject", "")
+	assert.Error(t, err)
+
+	// Fields that don't exist are only detected when rendering.
+	templates, err := ParseFilenameTemplates("{{.Missing}}", "{{.Missing}}")
+	require.NoError(t, err)
+
+	e := newFilenameEmail()
+	assert.Equal(t, "Invoice.pdf", templates.ForContent(e))
+	assert.Equal(t, "document.pdf", templates.ForAttachment(e, "document.pdf", 1))
+}
+
+func TestProcessEmailFilenames(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	templates, err := ParseFilenameTemplates(`{{.Subject}}`, `{{.Subject}} {{.Index}}`)
+	require.NoError(t, err)
+
+	handler := &EmailHandler{paperless: paperless, Filenames: templates, BodyPolicy: BodyAndAttachments}
+
+	e := newFilenameEmail()
+	e.Text = []byte("See attached.")
+	e.Attachments = []*email.Attachment{
+		{Filename: "document.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: []byte("first")},
+		{Filename: "document.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: []byte("second")},
+	}
+
+	require.NoError(t, handler.ProcessEmail(e))
+
+	require.Len(t, *documents, 3)
+	assert.Equal(t, "Invoice 1.pdf", (*documents)[0].Filename)
+	assert.Equal(t, "Invoice 2.pdf", (*documents)[1].Filename)
+	assert.Equal(t, "Invoice.pdf", (*documents)[2].Filename)
+}
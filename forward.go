@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxForwardHeaderLines is how many lines after a forward marker are searched
+// for the original message's header.
+const maxForwardHeaderLines = 15
+
+// forwardMarker matches the line Gmail, Apple Mail, and Thunderbird insert
+// before an inline forwarded message.
+var forwardMarker = regexp.MustCompile(`(?im)^[>\s]*(-+\s*Forwarded message\s*-+|Begin forwarded message:)\s*$`)
+
+// outlookSeparator matches the line Outlook inserts before both forwarded and
+// replied to messages, so it is only used if the subject is a forward.
+var outlookSeparator = regexp.MustCompile(`(?im)^[>\s]*(-+\s*Original Message\s*-+|_{10,})\s*$`)
+
+// forwardSubject matches forward prefixes at the start of a subject.
+var forwardSubject = regexp.MustCompile(`(?i)^\s*(fw|fwd|wg|tr|rv|enc)\s*:`)
+
+// forwardFields are the fields of a forwarded message's header.
+var forwardFields = map[string]bool{"from": true, "date": true, "sent": true, "subject": true, "to": true, "cc": true}
+
+// forwardHeaderLine matches a field of a forwarded message's header, allowing
+// for quoting and the bold markers Gmail adds to plain text.
+var forwardHeaderLine = regexp.MustCompile(`^[>\s]*\*?([A-Za-z]+)\*?:\*?\s*(.*?)\s*$`)
+
+// htmlTag matches HTML tags, which are removed to find forward markers in HTML
+// bodies.
+var htmlTag = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// htmlLineBreak matches HTML elements that start a new line.
+var htmlLineBreak = regexp.MustCompile(`(?i)<(br|/p|/div|/tr)[^>]*>`)
+
+// htmlRule matches horizontal rules, which Outlook uses as a forward marker in
+// HTML emails.
+var htmlRule = regexp.MustCompile(`(?i)<hr[^>]*>`)
+
+// mailtoBracket matches the "[mailto:address]" Outlook uses in place of angle
+// brackets.
+var mailtoBracket = regexp.MustCompile(`\[mailto:([^\]]+)\]`)
+
+// forwardWeekday matches a weekday at the start of a date.
+var forwardWeekday = regexp.MustCompile(`^[A-Za-z]+,\s*`)
+
+// forwardZone matches a time zone after a 12 hour time, such as "GMT+1".
+var forwardZone = regexp.MustCompile(`([AP]M)\s+\S+$`)
+
+// forwardDateLayouts are the date formats used by mail clients when quoting a
+// forwarded message, after removing weekdays, "at", and time zones.
+var forwardDateLayouts = []string{
+	"Jan 2, 2006 3:04 PM",
+	"Jan 2, 2006 3:04:05 PM",
+	"January 2, 2006 3:04 PM",
+	"January 2, 2006 3:04:05 PM",
+	"2 January 2006 15:04",
+	"2 Jan 2006 15:04",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+}
+
+// EmailOrigin describes who originally sent an email. For forwarded emails
+// this is the sender of the forwarded message instead of the forwarder.
+type EmailOrigin struct {
+	From    string
+	Date    time.Time
+	Subject string
+
+	// ForwardedBy is the sender of the email if it was a forward.
+	ForwardedBy string
+}
+
+// NewEmailOrigin returns the origin of an email, detecting inline forwards and
+// forwarded attachments. The date is zero if it wasn't known.
+func NewEmailOrigin(e *email.Email) EmailOrigin {
+	if origin, ok := DetectForward(e); ok {
+		return origin
+	}
+
+	origin := EmailOrigin{From: e.From, Subject: e.Subject}
+	if date, err := mail.ParseDate(e.Headers.Get("Date")); err == nil {
+		origin.Date = date
+	}
+
+	return origin
+}
+
+// emailOrigin returns the origin of an email, only detecting forwards once for
+// each email being processed.
+func (handler *EmailHandler) emailOrigin(e *email.Email) EmailOrigin {
+	if handler.processing == nil {
+		return NewEmailOrigin(e)
+	}
+
+	origin, ok := handler.processing.origins[e]
+	if !ok {
+		origin = NewEmailOrigin(e)
+		handler.processing.origins[e] = origin
+	}
+
+	return origin
+}
+
+// DetectForward finds the sender, date and subject of a forwarded message,
+// either quoted in the body or as the only attached email.
+func DetectForward(e *email.Email) (EmailOrigin, bool) {
+	body := e.Text
+	if len(bytes.TrimSpace(body)) == 0 && e.HTML != nil {
+		body = htmlText(e.HTML)
+	}
+
+	origin, ok := parseForwardBlock(body, e.Subject)
+	if !ok {
+		origin, ok = forwardedAttachment(e)
+	}
+	if !ok {
+		return EmailOrigin{}, false
+	}
+
+	origin.ForwardedBy = e.From
+	log.WithFields(log.Fields{
+		"from":         origin.From,
+		"forwarded_by": origin.ForwardedBy,
+	}).Debug("detected forwarded email")
+
+	return origin, true
+}
+
+// parseForwardBlock parses the header quoted after the first forward marker in
+// a body. The header must start right after the marker.
+func parseForwardBlock(body []byte, subject string) (EmailOrigin, bool) {
+	loc := forwardMarker.FindIndex(body)
+	if loc == nil && forwardSubject.MatchString(subject) {
+		loc = outlookSeparator.FindIndex(body)
+	}
+	if loc == nil {
+		return EmailOrigin{}, false
+	}
+
+	var origin EmailOrigin
+	fields := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(body[loc[1]:]))
+	for lines := 0; scanner.Scan() && lines < maxForwardHeaderLines; lines++ {
+		line := scanner.Text()
+		if strings.TrimSpace(strings.TrimLeft(line, ">")) == "" {
+			// The header ends at the first blank line after any fields.
+			if origin.From != "" {
+				break
+			}
+			continue
+		}
+
+		match := forwardHeaderLine.FindStringSubmatch(line)
+		if match == nil || !forwardFields[strings.ToLower(match[1])] {
+			// Text before any fields means the marker wasn't followed by a
+			// quoted header.
+			if fields == 0 {
+				return EmailOrigin{}, false
+			}
+			continue
+		}
+		fields++
+
+		value := match[2]
+		switch strings.ToLower(match[1]) {
+		case "from":
+			origin.From = forwardAddress(value)
+		case "date", "sent":
+			origin.Date = parseForwardDate(value)
+		case "subject":
+			origin.Subject = value
+		}
+	}
+
+	// Anything without an address is more likely to be a signature or quote.
+	return origin, strings.Contains(origin.From, "@")
+}
+
+// forwardedAttachment uses the header of an email's only attached email.
+func forwardedAttachment(e *email.Email) (EmailOrigin, bool) {
+	var attached *email.Attachment
+	for _, attachment := range e.Attachments {
+		if strings.ToLower(attachment.ContentType) != "message/rfc822" {
+			continue
+		}
+		if attached != nil {
+			return EmailOrigin{}, false
+		}
+		attached = attachment
+	}
+	if attached == nil {
+		return EmailOrigin{}, false
+	}
+
+	raw, err := io.ReadAll(NewAttachmentReader(attached))
+	if err != nil {
+		return EmailOrigin{}, false
+	}
+
+	header, _ := splitMessage(bytes.TrimLeft(raw, " \t\r\n"))
+	parsed, err := parseHeader(header)
+	if err != nil || parsed.Get("From") == "" {
+		return EmailOrigin{}, false
+	}
+
+	origin := EmailOrigin{
+		From:    decodeHeader(parsed.Get("From")),
+		Subject: decodeHeader(parsed.Get("Subject")),
+	}
+	if date, err := mail.ParseDate(parsed.Get("Date")); err == nil {
+		origin.Date = date
+	}
+
+	return origin, true
+}
+
+// forwardAddress normalizes a quoted sender, removing bold markers and
+// converting Outlook's mailto brackets into an address.
+func forwardAddress(value string) string {
+	value = strings.ReplaceAll(value, "*", "")
+	value = mailtoBracket.ReplaceAllString(value, "<$1>")
+	value = strings.TrimSpace(value)
+
+	if address, err := mail.ParseAddress(value); err == nil && address.Name != "" {
+		return address.Name + " <" + address.Address + ">"
+	} else if err == nil {
+		return address.Address
+	}
+
+	return value
+}
+
+// parseForwardDate parses the date of a quoted message, returning the zero time
+// if it couldn't be parsed.
+func parseForwardDate(value string) time.Time {
+	if date, err := mail.ParseDate(value); err == nil {
+		return date
+	}
+
+	value = forwardWeekday.ReplaceAllString(value, "")
+	value = strings.Replace(value, " at ", " ", 1)
+	value = forwardZone.ReplaceAllString(value, "$1")
+	value = strings.Join(strings.Fields(value), " ")
+
+	for _, layout := range forwardDateLayouts {
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return date
+		}
+	}
+
+	return time.Time{}
+}
+
+// htmlText roughly converts HTML into text, keeping line breaks and replacing
+// horizontal rules with the line of underscores Outlook uses in plain text.
+func htmlText(body []byte) []byte {
+	text := htmlRule.ReplaceAll(body, []byte("\n"+strings.Repeat("_", 32)+"\n"))
+	text = htmlLineBreak.ReplaceAll(text, []byte("\n$0"))
+	text = htmlTag.ReplaceAll(text, nil)
+
+	return []byte(html.UnescapeString(string(text)))
+}
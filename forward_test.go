@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+func TestDetectForward(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		html    string
+		from    string
+		subject string
+		date    time.Time
+	}{
+		{
+			name:    "gmail",
+			text:    "FYI\r\n\r\n---------- Forwarded message ---------\r\nFrom: Example Bank <billing@bank.example>\r\nDate: Tue, Mar 2, 2021 at 10:00 AM\r\nSubject: Your statement\r\nTo: <me@example.com>\r\n\r\nStatement attached.\r\n",
+			from:    "Example Bank <billing@bank.example>",
+			subject: "Your statement",
+			date:    time.Date(2021, 3, 2, 10, 0, 0, 0, time.Local),
+		},
+		{
+			name:    "gmail bold",
+			text:    "---------- Forwarded message ---------\nFrom: *Example Bank* <billing@bank.example>\nDate: Tue, Mar 2, 2021 at 10:00 AM\nSubject: Your statement\n",
+			from:    "Example Bank <billing@bank.example>",
+			subject: "Your statement",
+			date:    time.Date(2021, 3, 2, 10, 0, 0, 0, time.Local),
+		},
+		{
+			name:    "outlook",
+			text:    "-----Original Message-----\nFrom: Example Bank [mailto:billing@bank.example]\nSent: Tuesday, March 2, 2021 10:00 AM\nTo: Me\nSubject: Your statement\n",
+			from:    "Example Bank <billing@bank.example>",
+			subject: "Your statement",
+			date:    time.Date(2021, 3, 2, 10, 0, 0, 0, time.Local),
+		},
+		{
+			name:    "outlook html",
+			html:    `<html><body><p>See below</p><hr style="display:inline-block"><div id="divRplyFwdMsg"><b>From:</b> Example Bank &lt;billing@bank.example&gt;<br><b>Sent:</b> Tuesday, March 2, 2021 10:00 AM<br><b>Subject:</b> Your statement</div></body></html>`,
+			from:    "Example Bank <billing@bank.example>",
+			subject: "Your statement",
+			date:    time.Date(2021, 3, 2, 10, 0, 0, 0, time.Local),
+		},
+		{
+			name:    "apple mail",
+			text:    "Begin forwarded message:\n\n> From: Example Bank <billing@bank.example>\n> Subject: Your statement\n> Date: March 2, 2021 at 10:00:00 AM GMT+1\n> To: me@example.com\n",
+			from:    "Example Bank <billing@bank.example>",
+			subject: "Your statement",
+			date:    time.Date(2021, 3, 2, 10, 0, 0, 0, time.Local),
+		},
+		{
+			name:    "thunderbird",
+			text:    "-------- Forwarded Message --------\nSubject: \tYour statement\nDate: \tTue, 2 Mar 2021 10:00:00 +0000\nFrom: \tbilling@bank.example\nTo: \tme@example.com\n",
+			from:    "billing@bank.example",
+			subject: "Your statement",
+			date:    time.Date(2021, 3, 2, 10, 0, 0, 0, time.FixedZone("", 0)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &email.Email{From: "me@example.com", Subject: "Fwd: Your statement"}
+			if test.text != "" {
+				e.Text = []byte(test.text)
+			}
+			if test.html != "" {
+				e.HTML = []byte(test.html)
+			}
+
+			origin, ok := DetectForward(e)
+			require.True(t, ok, "forward should be detected")
+
+			assert.Equal(t, test.from, origin.From)
+			assert.Equal(t, test.subject, origin.Subject)
+			assert.True(t, test.date.Equal(origin.Date), "expected date %s, got %s", test.date, origin.Date)
+			assert.Equal(t, "me@example.com", origin.ForwardedBy)
+		})
+	}
+}
+
+func TestDetectForwardAttachment(t *testing.T) {
+	e := &email.Email{
+		From: "me@example.com",
+		Text: []byte("Forwarding as attachment."),
+		Attachments: []*email.Attachment{{
+			Filename:    "statement.eml",
+			ContentType: "message/rfc822",
+			Header:      textproto.MIMEHeader{},
+			Content:     []byte("From: =?utf-8?q?B=C3=A4nk?= <billing@bank.example>\r\nDate: Tue, 2 Mar 2021 10:00:00 +0000\r\nSubject: Your statement\r\n\r\nBody"),
+		}},
+	}
+
+	origin, ok := DetectForward(e)
+	require.True(t, ok, "forwarded attachment should be detected")
+
+	assert.Equal(t, "Bänk <billing@bank.example>", origin.From)
+	assert.Equal(t, "Your statement", origin.Subject)
+	assert.Equal(t, 2021, origin.Date.Year())
+
+	e.Attachments = append(e.Attachments, e.Attachments[0])
+	_, ok = DetectForward(e)
+	assert.False(t, ok, "multiple attached emails should not be treated as a forward")
+}
+
+func TestDetectForwardNone(t *testing.T) {
+	tests := []struct {
+		subject string
+		text    string
+	}{
+		{"Hello", "Just a normal email."},
+		{"Fwd: Hello", "Thanks,\n__________________\nFrom: the accounts team\nwww.example.com\n"},
+		{"Fwd: Hello", "---------- Forwarded message ---------\n"},
+		{"RE: Your statement", "Thanks!\n\n-----Original Message-----\nFrom: Example Bank [mailto:billing@bank.example]\nSent: Tuesday, March 2, 2021 10:00 AM\nSubject: Your statement\n"},
+		{"RE: Your statement", "Thanks!\n\n________________________________\nFrom: Example Bank <billing@bank.example>\nSent: Tuesday, March 2, 2021 10:00 AM\n"},
+		{"Fwd: Hello", "---------- Forwarded message ---------\nSee the note from billing@bank.example below\nFrom: Example Bank <billing@bank.example>\n"},
+	}
+
+	for _, test := range tests {
+		_, ok := DetectForward(&email.Email{From: "me@example.com", Subject: test.subject, Text: []byte(test.text)})
+		assert.False(t, ok, test.text)
+	}
+}
+
+func TestNewEmailOrigin(t *testing.T) {
+	e := &email.Email{
+		From:    "me@example.com",
+		Subject: "Invoice",
+		Headers: textproto.MIMEHeader{"Date": {"Tue, 02 Mar 2021 10:00:00 +0000"}},
+	}
+
+	origin := NewEmailOrigin(e)
+	assert.Equal(t, "me@example.com", origin.From)
+	assert.Equal(t, "Invoice", origin.Subject)
+	assert.Equal(t, 2021, origin.Date.Year())
+	assert.Empty(t, origin.ForwardedBy)
+}
+
+func TestProcessEmailForwardMetadata(t *testing.T) {
+	var created, correspondent string
+	var filenames []string
+	var lookups int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/correspondents/" {
+			lookups++
+			if req.URL.Query().Get("name__iexact") == "billing@bank.example" {
+				fmt.Fprint(w, `{"results": [{"id": 3}]}`)
+			} else {
+				fmt.Fprint(w, `{"results": []}`)
+			}
+			return
+		}
+
+		if !assert.NoError(t, req.ParseMultipartForm(MaxMemory)) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		created = req.FormValue("created")
+		correspondent = req.FormValue("correspondent")
+		_, header, err := req.FormFile("document")
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		filenames = append(filenames, header.Filename)
+	}))
+	t.Cleanup(ts.Close)
+
+	templates, err := ParseFilenameTemplates("", `{{.FromAddress}} {{.Name}}`)
+	require.NoError(t, err)
+
+	handler := &EmailHandler{
+		AllowList:        AllowList{AllowedEmails: []string{"me@example.com"}},
+		Filenames:        templates,
+		SetCreated:       true,
+		SetCorrespondent: true,
+		paperless:        paperless.New(ts.URL, "apiKey", http.DefaultClient),
+	}
+
+	e := &email.Email{
+		From:    "me@example.com",
+		Subject: "Fwd: Your statement",
+		Text:    []byte("---------- Forwarded message ---------\nFrom: Example Bank <billing@bank.example>\nDate: Tue, 2 Mar 2021 10:00:00 +0000\n\n"),
+		Headers: textproto.MIMEHeader{"Date": {"Mon, 08 Mar 2021 09:00:00 +0000"}},
+		Attachments: []*email.Attachment{
+			{Filename: "statement.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: []byte("pdf")},
+			{Filename: "terms.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: []byte("pdf")},
+		},
+	}
+
+	assert.True(t, handler.IsAllowedEmail(e.From, nil), "the forwarder should still be checked")
+	assert.False(t, handler.IsAllowedEmail("billing@bank.example", nil))
+
+	require.NoError(t, handler.ProcessEmail(e))
+
+	assert.Equal(t, "2021-03-02T10:00:00Z", created)
+	assert.Equal(t, "3", correspondent)
+	assert.Equal(t, []string{"billing@bank.example statement.pdf", "billing@bank.example terms.pdf"}, filenames)
+	assert.Equal(t, 2, lookups, "the correspondent should only be looked up once per email")
+}
+
+func TestEmailOriginCached(t *testing.T) {
+	e := &email.Email{
+		From:    "me@example.com",
+		Subject: "Fwd: Your statement",
+		Text:    []byte("---------- Forwarded message ---------\nFrom: Example Bank <billing@bank.example>\n"),
+	}
+
+	handler := (&EmailHandler{}).withProcessing()
+	assert.Equal(t, "Example Bank <billing@bank.example>", handler.emailOrigin(e).From)
+
+	e.Text = nil
+	assert.Equal(t, "Example Bank <billing@bank.example>", handler.emailOrigin(e).From, "forwards should only be detected once per email")
+	assert.Equal(t, "me@example.com", (&EmailHandler{}).emailOrigin(e).From)
+}
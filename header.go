@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"net/mail"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// DefaultHeaderTemplate is the HTML inserted before the body of converted
+// emails when no custom template was configured.
+const DefaultHeaderTemplate = `<div style="font-family: sans-serif; font-size: 12px; border-bottom: 1px solid #ccc; margin-bottom: 16px; padding-bottom: 8px;">
+<table>
+<tr><th align="left">From</th><td>{{.From}}</td></tr>
+{{if .To}}<tr><th align="left">To</th><td>{{join .To ", "}}</td></tr>{{end}}
+{{if .Cc}}<tr><th align="left">Cc</th><td>{{join .Cc ", "}}</td></tr>{{end}}
+{{if not .Date.IsZero}}<tr><th align="left">Date</th><td>{{.Date.Format "Mon, 02 Jan 2006 15:04:05 -0700"}}</td></tr>{{end}}
+<tr><th align="left">Subject</th><td>{{.Subject}}</td></tr>
+</table>
+</div>
+`
+
+// defaultHeaderTemplate is the parsed DefaultHeaderTemplate.
+var defaultHeaderTemplate = htmltemplate.Must(htmltemplate.New("header").Funcs(htmltemplate.FuncMap{"join": strings.Join}).Parse(DefaultHeaderTemplate))
+
+// textHeaderTemplate is the plain-text version of the default header.
+var textHeaderTemplate = template.Must(template.New("header").Funcs(template.FuncMap{"join": strings.Join}).Parse(
+	`From: {{.From}}
+{{if .To}}To: {{join .To ", "}}
+{{end}}{{if .Cc}}Cc: {{join .Cc ", "}}
+{{end}}{{if not .Date.IsZero}}Date: {{.Date.Format "Mon, 02 Jan 2006 15:04:05 -0700"}}
+{{end}}Subject: {{.Subject}}
+
+`))
+
+// bodyTag matches the opening body tag of an HTML document.
+var bodyTag = regexp.MustCompile(`(?i)<body(\s[^>]*)?>`)
+
+// EmailHeader contains the fields of an email made available to the header
+// template.
+type EmailHeader struct {
+	From    string
+	To      []string
+	Cc      []string
+	Date    time.Time
+	Subject string
+}
+
+// NewEmailHeader extracts the header fields from an email.
+func NewEmailHeader(email *email.Email) EmailHeader {
+	header := EmailHeader{
+		From:    email.From,
+		To:      email.To,
+		Cc:      email.Cc,
+		Subject: email.Subject,
+	}
+
+	if date, err := mail.ParseDate(email.Headers.Get("Date")); err == nil {
+		header.Date = date
+	}
+
+	return header
+}
+
+// ParseHeaderTemplate parses an HTML header template, using the default
+// template if contents are empty.
+func ParseHeaderTemplate(contents string) (*htmltemplate.Template, error) {
+	if contents == "" {
+		return defaultHeaderTemplate, nil
+	}
+
+	return htmltemplate.New("header").Funcs(htmltemplate.FuncMap{"join": strings.Join}).Parse(contents)
+}
+
+// InjectHTMLHeader renders the header template and inserts it immediately
+// after the opening body tag, or at the start of the document if there was no
+// body tag.
+func InjectHTMLHeader(tmpl *htmltemplate.Template, header EmailHeader, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, header); err != nil {
+		return nil, err
+	}
+
+	loc := bodyTag.FindIndex(body)
+	if loc == nil {
+		return append(buf.Bytes(), body...), nil
+	}
+
+	out := make([]byte, 0, len(body)+buf.Len())
+	out = append(out, body[:loc[1]]...)
+	out = append(out, buf.Bytes()...)
+	out = append(out, body[loc[1]:]...)
+
+	return out, nil
+}
+
+// InjectTextHeader prepends a plain-text version of the header to the body.
+// Custom templates are rendered and reduced to their text content, while the
+// default template has a dedicated plain-text version.
+func InjectTextHeader(tmpl *htmltemplate.Template, header EmailHeader, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if tmpl == nil || tmpl == defaultHeaderTemplate {
+		if err := textHeaderTemplate.Execute(&buf, header); err != nil {
+			return nil, err
+		}
+
+		return append(buf.Bytes(), body...), nil
+	}
+
+	if err := tmpl.Execute(&buf, header); err != nil {
+		return nil, err
+	}
+
+	text := HTMLToText(buf.Bytes())
+	if text == "" {
+		return body, nil
+	}
+
+	return append([]byte(text+"\n\n"), body...), nil
+}
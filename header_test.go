@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEmailHeader(t *testing.T) {
+	headers := textproto.MIMEHeader{}
+	headers.Add("Date", "Fri, 03 Sep 2021 10:00:00 +0000")
+
+	e := &email.Email{From: "test@example.com", To: []string{"input@example.com"}, Subject: "Bill", Headers: headers}
+	header := NewEmailHeader(e)
+
+	assert.Equal(t, "test@example.com", header.From)
+	assert.Equal(t, []string{"input@example.com"}, header.To)
+	assert.Equal(t, "Bill", header.Subject)
+	assert.True(t, header.Date.Equal(time.Date(2021, 9, 3, 10, 0, 0, 0, time.UTC)), "date should be parsed from headers")
+
+	header = NewEmailHeader(&email.Email{Headers: textproto.MIMEHeader{}})
+	assert.True(t, header.Date.IsZero(), "missing date should be left empty")
+}
+
+func TestInjectHTMLHeader(t *testing.T) {
+	tmpl, err := ParseHeaderTemplate("<p>{{.From}}</p>")
+	require.Nil(t, err, "template should parse")
+
+	header := EmailHeader{From: "<test@example.com>"}
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{"<html><BODY class=\"a\">content</BODY></html>", "<html><BODY class=\"a\"><p>&lt;test@example.com&gt;</p>content</BODY></html>"},
+		{"content", "<p>&lt;test@example.com&gt;</p>content"},
+		{"<bodyfoo>a</bodyfoo><body>content</body>", "<bodyfoo>a</bodyfoo><body><p>&lt;test@example.com&gt;</p>content</body>"},
+		{"<body\nclass=\"a\">content</body>", "<body\nclass=\"a\"><p>&lt;test@example.com&gt;</p>content</body>"},
+	}
+
+	for _, test := range tests {
+		out, err := InjectHTMLHeader(tmpl, header, []byte(test.body))
+		require.Nil(t, err, "header should render")
+		assert.Equal(t, test.expected, string(out))
+	}
+}
+
+func TestDefaultHeaderTemplate(t *testing.T) {
+	tmpl, err := ParseHeaderTemplate("")
+	require.Nil(t, err, "default template should parse")
+
+	header := EmailHeader{From: "test@example.com", To: []string{"a@example.com", "b@example.com"}, Subject: "Bill"}
+	out, err := InjectHTMLHeader(tmpl, header, []byte("<body></body>"))
+	require.Nil(t, err, "default template should render")
+
+	assert.Contains(t, string(out), "a@example.com, b@example.com")
+	assert.Contains(t, string(out), "Bill")
+	assert.NotContains(t, string(out), "Date", "empty date should be omitted")
+}
+
+func TestInjectTextHeader(t *testing.T) {
+	header := EmailHeader{From: "test@example.com", Subject: "Bill", Date: time.Date(2021, 9, 3, 10, 0, 0, 0, time.UTC)}
+
+	tmpl, err := ParseHeaderTemplate("")
+	require.Nil(t, err, "default template should parse")
+
+	out, err := InjectTextHeader(tmpl, header, []byte("content"))
+	require.Nil(t, err, "header should render")
+
+	assert.Equal(t, "From: test@example.com\nDate: Fri, 03 Sep 2021 10:00:00 +0000\nSubject: Bill\n\ncontent", string(out))
+
+	tmpl, err = ParseHeaderTemplate("<style>p { color: red; }</style><p>Sent by {{.From}}</p><p>{{.Subject}}</p>")
+	require.Nil(t, err, "custom template should parse")
+
+	out, err = InjectTextHeader(tmpl, header, []byte("content"))
+	require.Nil(t, err, "custom header should render")
+
+	assert.Equal(t, "Sent by test@example.com\n\nBill\n\ncontent", string(out), "custom templates should be used for plain text")
+}
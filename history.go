@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/mail"
+	"sync"
+	"time"
+)
+
+var (
+	// Messages are only kept in memory, so any received before a restart are
+	// not found.
+	errMessageNotFound  = errors.New("message was not found, it may have been dropped from the history or lost on restart")
+	errMessageNotFailed = errors.New("message has not failed")
+	errMessageRunning   = errors.New("message is still being processed")
+)
+
+// MessageStatus is the outcome of processing a received message.
+type MessageStatus string
+
+const (
+	MessageProcessing MessageStatus = "processing"
+	MessageProcessed  MessageStatus = "processed"
+	MessageFiltered   MessageStatus = "filtered"
+	MessageFailed     MessageStatus = "failed"
+)
+
+// Message is a received email and the outcome of processing it.
+type Message struct {
+	ID       string    `json:"id"`
+	Received time.Time `json:"received"`
+	// Source is how the message was received, such as sendgrid or maildir.
+	Source  string   `json:"source"`
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Target  string   `json:"target,omitempty"`
+
+	Status MessageStatus `json:"status"`
+	// Reason explains why a message was filtered or failed.
+	Reason      string            `json:"reason,omitempty"`
+	Attachments []string          `json:"attachments"`
+	Documents   []MessageDocument `json:"documents"`
+	Attempts    int               `json:"attempts"`
+
+	raw     []byte
+	history *History
+}
+
+// Failed checks if processing the message failed, so it can be retried.
+func (message Message) Failed() bool {
+	return message.Status == MessageFailed
+}
+
+// MessageDocument is a document uploaded for a message, with the document
+// created once Paperless consumed it.
+type MessageDocument struct {
+	Filename   string `json:"filename"`
+	TaskID     string `json:"task_id,omitempty"`
+	DocumentID int    `json:"document_id,omitempty"`
+	// Error is set if Paperless could not consume the document.
+	Error string `json:"error,omitempty"`
+}
+
+// History keeps the most recent messages, including their contents so failed
+// messages can be retried.
+type History struct {
+	size    int
+	maxSize int64
+
+	mu       sync.Mutex
+	messages []*Message
+	// used is the total size of the messages' contents.
+	used int64
+}
+
+// NewHistory creates a history keeping up to size messages, with up to
+// maxSize bytes of contents. A maxSize of 0 doesn't limit the contents.
+func NewHistory(size int, maxSize int64) *History {
+	return &History{size: size, maxSize: maxSize}
+}
+
+// Add records a received message, dropping the oldest messages beyond the
+// history size or contents size. The newest message is kept even if its
+// contents are larger. If there is no history, nothing is recorded.
+func (history *History) Add(source, from string, to []string, raw []byte) *Message {
+	if history == nil {
+		return nil
+	}
+
+	message := &Message{
+		ID:          randomHex(8),
+		Received:    time.Now(),
+		Source:      source,
+		From:        from,
+		To:          to,
+		Subject:     messageSubject(raw),
+		Status:      MessageProcessing,
+		Attachments: []string{},
+		Documents:   []MessageDocument{},
+		Attempts:    1,
+		raw:         raw,
+		history:     history,
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	history.messages = append(history.messages, message)
+	history.used += int64(len(raw))
+
+	drop := 0
+	for kept := len(history.messages); kept > history.size ||
+		kept > 1 && history.maxSize > 0 && history.used > history.maxSize; kept-- {
+		history.used -= int64(len(history.messages[drop].raw))
+		drop++
+	}
+	if drop > 0 {
+		history.messages = append([]*Message(nil), history.messages[drop:]...)
+	}
+
+	return message
+}
+
+// Messages returns a copy of each message, newest first.
+func (history *History) Messages() []Message {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	messages := make([]Message, 0, len(history.messages))
+	for i := len(history.messages) - 1; i >= 0; i-- {
+		messages = append(messages, history.messages[i].copy())
+	}
+
+	return messages
+}
+
+// Get returns a copy of a message.
+func (history *History) Get(id string) (Message, bool) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	if i := history.find(id); i >= 0 {
+		return history.messages[i].copy(), true
+	}
+
+	return Message{}, false
+}
+
+// Remove deletes a message, returning if it existed.
+func (history *History) Remove(id string) bool {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	i := history.find(id)
+	if i < 0 {
+		return false
+	}
+
+	history.remove(i)
+	return true
+}
+
+// Discard deletes a failed message.
+func (history *History) Discard(id string) error {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	i := history.find(id)
+	if i < 0 {
+		return errMessageNotFound
+	}
+	if !history.messages[i].Failed() {
+		return errMessageNotFailed
+	}
+
+	history.remove(i)
+	return nil
+}
+
+// Purge deletes every message with a status, or every message if the status
+// is empty, returning how many were deleted.
+func (history *History) Purge(status MessageStatus) int {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	kept := history.messages[:0]
+	for _, message := range history.messages {
+		if status != "" && message.Status != status {
+			kept = append(kept, message)
+		} else {
+			history.used -= int64(len(message.raw))
+		}
+	}
+
+	purged := len(history.messages) - len(kept)
+	for i := len(kept); i < len(history.messages); i++ {
+		history.messages[i] = nil
+	}
+	history.messages = kept
+
+	return purged
+}
+
+// Retry resets a failed message so it can be processed again, returning the
+// message to record the new outcome in.
+func (history *History) Retry(id string) (*Message, error) {
+	return history.restart(id, func(message *Message) error {
+		if !message.Failed() {
+			return errMessageNotFailed
+		}
+
+		return nil
+	})
+}
+
+// Replay resets a message that isn't being processed so it can be processed
+// again, returning the message to record the new outcome in.
+func (history *History) Replay(id string) (*Message, error) {
+	return history.restart(id, func(message *Message) error {
+		if message.Status == MessageProcessing {
+			return errMessageRunning
+		}
+
+		return nil
+	})
+}
+
+// restart resets a message to be processed again if check allows it.
+func (history *History) restart(id string, check func(message *Message) error) (*Message, error) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	i := history.find(id)
+	if i < 0 {
+		return nil, errMessageNotFound
+	}
+
+	message := history.messages[i]
+	if err := check(message); err != nil {
+		return nil, err
+	}
+
+	message.Status = MessageProcessing
+	message.Reason = ""
+	message.Attachments = []string{}
+	message.Documents = []MessageDocument{}
+	message.Attempts++
+
+	return message, nil
+}
+
+// remove deletes the message at an index. The lock must be held.
+func (history *History) remove(i int) {
+	history.used -= int64(len(history.messages[i].raw))
+	history.messages = append(history.messages[:i], history.messages[i+1:]...)
+}
+
+// find returns the index of a message, or -1 if it doesn't exist. The lock
+// must be held.
+func (history *History) find(id string) int {
+	for i, message := range history.messages {
+		if message.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// copy returns a copy of the message that can be used without holding the
+// lock.
+func (message *Message) copy() Message {
+	c := *message
+	c.To = append([]string(nil), message.To...)
+	c.Attachments = append([]string{}, message.Attachments...)
+	c.Documents = append([]MessageDocument{}, message.Documents...)
+
+	return c
+}
+
+// update modifies a message while holding the history's lock. Nothing happens
+// if the message isn't being recorded.
+func (message *Message) update(fn func(message *Message)) {
+	if message == nil {
+		return
+	}
+
+	message.history.mu.Lock()
+	defer message.history.mu.Unlock()
+
+	fn(message)
+}
+
+// finish records the outcome of processing a message.
+func (message *Message) finish(status MessageStatus, reason string) {
+	message.update(func(message *Message) {
+		message.Status = status
+		message.Reason = reason
+	})
+}
+
+// addDocument records an uploaded document, returning a reference used to
+// record the document Paperless creates for it.
+func (message *Message) addDocument(filename, taskID string) *documentRef {
+	if message == nil {
+		return nil
+	}
+
+	ref := &documentRef{message: message}
+	message.update(func(message *Message) {
+		message.Documents = append(message.Documents, MessageDocument{Filename: filename, TaskID: taskID})
+		ref.attempt = message.Attempts
+		ref.index = len(message.Documents) - 1
+	})
+
+	return ref
+}
+
+// documentRef identifies a document uploaded during an attempt at processing
+// a message.
+type documentRef struct {
+	message *Message
+	attempt int
+	index   int
+}
+
+// consumed records the result of Paperless consuming the document. Results
+// from earlier attempts are ignored.
+func (ref *documentRef) consumed(documentID int, err error) {
+	if ref == nil {
+		return
+	}
+
+	ref.message.update(func(message *Message) {
+		if message.Attempts != ref.attempt {
+			return
+		}
+
+		message.Documents[ref.index].DocumentID = documentID
+		if err != nil {
+			message.Documents[ref.index].Error = err.Error()
+		}
+	})
+}
+
+// randomHex returns size random bytes encoded as hex.
+func randomHex(size int) string {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(data)
+}
+
+// messageSubject returns the decoded subject of a raw message, if it can be
+// read.
+func messageSubject(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+
+	subject := msg.Header.Get("Subject")
+	if decoded, err := headerDecoder.DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+
+	return subject
+}
+
+// track records a received message in the history, if enabled, returning a
+// handler that records the outcome of processing it.
+func (handler *EmailHandler) track(source, from string, to []string, raw []byte) *EmailHandler {
+	if handler.History == nil {
+		return handler
+	}
+
+	return handler.withMessage(handler.History.Add(source, from, to, raw))
+}
+
+// withMessage returns a copy of the handler that records the outcome of
+// processing in the message.
+func (handler *EmailHandler) withMessage(message *Message) *EmailHandler {
+	h := *handler
+	h.message = message
+
+	return &h
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+func TestHistory(t *testing.T) {
+	var history *History
+	assert.Nil(t, history.Add("sendgrid", "me@example.com", nil, nil), "messages should not be recorded without a history")
+
+	history = NewHistory(2, 0)
+	first := history.Add("sendgrid", "me@example.com", []string{"home@example.com"}, []byte("Subject: First\r\n\r\nBody"))
+	second := history.Add("maildir", "me@example.com", nil, []byte("Subject: =?UTF-8?Q?Rechnung_f=C3=BCr_M=C3=A4rz?=\r\n\r\nBody"))
+	third := history.Add("sendgrid", "me@example.com", nil, []byte("not an email"))
+
+	messages := history.Messages()
+	require.Len(t, messages, 2, "the oldest message should be dropped")
+	assert.Equal(t, third.ID, messages[0].ID, "messages should be newest first")
+	assert.Equal(t, "Rechnung für März", messages[1].Subject, "subjects should be decoded")
+	assert.Equal(t, MessageProcessing, messages[1].Status)
+
+	_, ok := history.Get(first.ID)
+	assert.False(t, ok)
+
+	_, err := history.Retry(second.ID)
+	assert.ErrorIs(t, err, errMessageNotFailed, "only failed messages should be retried")
+	assert.ErrorIs(t, history.Discard(second.ID), errMessageNotFailed, "only failed messages should be discarded")
+
+	second.finish(MessageFailed, "paperless was down")
+	document := second.addDocument("First.pdf", "task-1")
+
+	retried, err := history.Retry(second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, second, retried)
+
+	document.consumed(12, nil)
+	message, ok := history.Get(second.ID)
+	require.True(t, ok)
+	assert.Equal(t, MessageProcessing, message.Status)
+	assert.Equal(t, 2, message.Attempts)
+	assert.Empty(t, message.Reason)
+	assert.Empty(t, message.Documents, "documents from earlier attempts should be ignored")
+
+	second.finish(MessageFailed, "paperless was down")
+	assert.NoError(t, history.Discard(second.ID))
+	assert.ErrorIs(t, history.Discard(second.ID), errMessageNotFound)
+
+	assert.True(t, history.Remove(third.ID))
+	assert.False(t, history.Remove(third.ID))
+	assert.Empty(t, history.Messages())
+}
+
+func TestHistoryMaxSize(t *testing.T) {
+	history := NewHistory(10, 10)
+	first := history.Add("sendgrid", "me@example.com", nil, []byte("12345"))
+	second := history.Add("sendgrid", "me@example.com", nil, []byte("12345"))
+	assert.Len(t, history.Messages(), 2, "messages within the size should be kept")
+
+	third := history.Add("sendgrid", "me@example.com", nil, []byte("123"))
+	messages := history.Messages()
+	require.Len(t, messages, 2, "the oldest message should be dropped")
+	assert.Equal(t, third.ID, messages[0].ID)
+	assert.Equal(t, second.ID, messages[1].ID)
+
+	_, ok := history.Get(first.ID)
+	assert.False(t, ok)
+
+	assert.True(t, history.Remove(second.ID))
+	fourth := history.Add("sendgrid", "me@example.com", nil, []byte("1234567"))
+	assert.Len(t, history.Messages(), 2, "removed messages should not count towards the size")
+
+	large := history.Add("sendgrid", "me@example.com", nil, []byte("123456789012"))
+	messages = history.Messages()
+	require.Len(t, messages, 1, "the newest message should be kept even if it is too large")
+	assert.Equal(t, large.ID, messages[0].ID)
+
+	_, ok = history.Get(fourth.ID)
+	assert.False(t, ok)
+
+	history.Purge("")
+	history.Add("sendgrid", "me@example.com", nil, []byte("12345"))
+	history.Add("sendgrid", "me@example.com", nil, []byte("12345"))
+	assert.Len(t, history.Messages(), 2, "purged messages should not count towards the size")
+}
+
+func TestReceiveRecordsMessage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/documents/post_document/":
+			fmt.Fprint(w, `"task-1"`)
+		case "/api/tasks/":
+			fmt.Fprint(w, `[{"status": "SUCCESS", "related_document": "12"}]`)
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	client := paperless.New(ts.URL, "apiKey", http.DefaultClient)
+	client.TaskPollInterval = time.Millisecond
+
+	history := NewHistory(10, 0)
+	handler := &EmailHandler{
+		AllowList: AllowList{[]string{"me@example.com"}, ""},
+		paperless: client,
+		History:   history,
+	}
+
+	receive := func(from, raw string) error {
+		return handler.track("test", from, nil, []byte(raw)).receive(log.WithField("test", t.Name()), from, nil, []byte(raw), nil)
+	}
+
+	require.NoError(t, receive("me@example.com", dryRunEmail))
+	pendingTasks.Wait()
+
+	require.NoError(t, receive("spam@example.com", dryRunEmail))
+
+	handler.ProcessingLimits = ProcessingLimits{MaxSize: 10}
+	require.Error(t, receive("me@example.com", dryRunEmail))
+
+	messages := history.Messages()
+	require.Len(t, messages, 3)
+
+	assert.Equal(t, MessageFailed, messages[0].Status)
+	assert.Contains(t, messages[0].Reason, errProcessingLimit.Error())
+
+	assert.Equal(t, MessageFiltered, messages[1].Status)
+	assert.Equal(t, "email was not allowed", messages[1].Reason)
+
+	processed := messages[2]
+	assert.Equal(t, "test", processed.Source)
+	assert.Equal(t, "Invoice", processed.Subject)
+	assert.Equal(t, MessageProcessed, processed.Status)
+	assert.Equal(t, []string{"invoice.pdf"}, processed.Attachments)
+	assert.Equal(t, []MessageDocument{{Filename: "invoice.pdf", TaskID: "task-1", DocumentID: 12}}, processed.Documents)
+}
+
+func TestHistoryPurge(t *testing.T) {
+	history := NewHistory(10, 0)
+	failed := history.Add("sendgrid", "me@example.com", nil, nil)
+	failed.finish(MessageFailed, "paperless was down")
+	processed := history.Add("sendgrid", "me@example.com", nil, nil)
+	processed.finish(MessageProcessed, "")
+	running := history.Add("sendgrid", "me@example.com", nil, nil)
+
+	_, err := history.Replay(running.ID)
+	assert.ErrorIs(t, err, errMessageRunning, "messages being processed should not be replayed")
+	_, err = history.Replay(processed.ID)
+	assert.NoError(t, err, "processed messages should be replayed")
+
+	assert.Equal(t, 1, history.Purge(MessageFailed))
+	_, ok := history.Get(failed.ID)
+	assert.False(t, ok)
+
+	assert.Equal(t, 2, history.Purge(""), "every message should be purged without a status")
+	assert.Empty(t, history.Messages())
+}
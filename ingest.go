@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+)
+
+// Ingester processes stored emails, writing the result of each one.
+type Ingester struct {
+	Handler *EmailHandler
+	// Route selects a target by the recipients of each email, otherwise every
+	// email is uploaded with Handler.
+	Route  bool
+	DryRun bool
+	Output io.Writer
+
+	Succeeded int
+	Failed    int
+}
+
+// ingestCommand runs the ingest subcommand, returning the exit code.
+func ingestCommand(args []string) int {
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	target := flags.String("target", "", "upload to this target instead of selecting one by recipient")
+	dryRun := flags.Bool("dry-run", false, "list the documents that would be uploaded without uploading them")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s ingest [flags] <file|dir|mbox>...\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+	setLogLevel(cfg.Debug)
+
+	handler, err := NewEmailHandler(cfg, &http.Client{Transport: newAddHeaderTransport(nil)})
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+
+	ingester := &Ingester{Handler: handler, Route: true, DryRun: *dryRun || cfg.DryRun, Output: os.Stdout}
+	if *target != "" {
+		if ingester.Handler = handler.target(*target); ingester.Handler == nil {
+			log.Errorf("unknown target %s", *target)
+			return 1
+		}
+		ingester.Route = false
+	}
+
+	for _, path := range flags.Args() {
+		if err = ingester.IngestPath(path); err != nil {
+			log.Errorf("could not ingest %s: %s", path, err.Error())
+			ingester.Failed++
+		}
+	}
+
+	fmt.Fprintf(ingester.Output, "%d emails ingested, %d failed\n", ingester.Succeeded, ingester.Failed)
+	pendingTasks.Wait()
+
+	if ingester.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// IngestPath ingests an email file, each message within an mbox file, or every
+// file within a directory. Hidden files and directories are skipped.
+func (ingester *Ingester) IngestPath(path string) error {
+	return filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name != path && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		return ingester.ingestFile(name)
+	})
+}
+
+// ingestFile ingests a single email, or each message if it is an mbox file.
+func (ingester *Ingester) ingestFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if start, _ := r.Peek(len(mboxFrom)); !IsMbox(start) {
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		ingester.Ingest(name, raw)
+		return nil
+	}
+
+	mbox := NewMboxReader(r)
+	for i := 1; ; i++ {
+		raw, err := mbox.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ingester.Ingest(fmt.Sprintf("%s#%d", name, i), raw)
+	}
+}
+
+// Ingest processes a raw email, writing the result with the source it was
+// read from.
+func (ingester *Ingester) Ingest(source string, raw []byte) {
+	report, subject, err := ingester.process(raw)
+	if err != nil {
+		ingester.Failed++
+		fmt.Fprintf(ingester.Output, "failed\t%s\t%s\n", source, err.Error())
+		return
+	}
+
+	ingester.Succeeded++
+	fmt.Fprintf(ingester.Output, "ok\t%s\t%s\n", source, subject)
+
+	if report != nil {
+		for _, document := range report.Documents {
+			fmt.Fprintf(ingester.Output, "\t%s (%s, %d bytes)\n", document.Filename, document.ContentType, document.Size)
+		}
+	}
+}
+
+// process prepares and processes a raw email with the selected handler.
+func (ingester *Ingester) process(raw []byte) (*DryRunReport, string, error) {
+	from := headerFrom(raw)
+
+	e, err := ingester.Handler.PrepareEmail(raw, from)
+	if err != nil {
+		return nil, "", err
+	}
+
+	handler := ingester.Handler
+	if ingester.Route {
+		if handler, err = handler.route(recipients(e)); err != nil {
+			return nil, e.Subject, err
+		}
+	}
+	// Files have no envelope, so the From header is trusted instead.
+	handler = handler.withSender(from)
+
+	var report *DryRunReport
+	if ingester.DryRun {
+		report = &DryRunReport{From: from, To: recipients(e), Target: handler.Target, Allowed: true}
+		handler = handler.withReport(report)
+	}
+
+	return report, e.Subject, handler.ProcessEmail(e)
+}
+
+// headerFrom returns the address in the From header of a raw email, or an
+// empty string if it has none.
+func headerFrom(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+
+	address, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return ""
+	}
+
+	return address.Address
+}
+
+// recipients returns the addresses an email was sent to.
+func recipients(e *email.Email) []string {
+	var addresses []string
+	for _, recipient := range append(append([]string{}, e.To...), e.Cc...) {
+		if address, err := mail.ParseAddress(recipient); err == nil {
+			addresses = append(addresses, address.Address)
+		} else {
+			addresses = append(addresses, recipient)
+		}
+	}
+
+	return addresses
+}
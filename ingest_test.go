@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestPath(t *testing.T) {
+	dir := t.TempDir()
+
+	eml := "From: billing@bank.example\r\nTo: home@example.com\r\nSubject: Statement\r\nContent-Type: text/plain\r\n\r\nBody\r\n"
+	mbox := "From billing@bank.example Tue Mar  2 10:00:00 2021\n" +
+		"From: billing@bank.example\nTo: office@example.com\nSubject: January\nContent-Type: text/plain\n\nBody\n\n" +
+		"From billing@bank.example Tue Mar  2 10:00:00 2021\n" +
+		"From: billing@bank.example\nTo: other@example.com\nSubject: February\nContent-Type: text/plain\n\nBody\n"
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bills", ".hidden"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bills", "statement.eml"), []byte(eml), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bills", ".hidden", "skipped.eml"), []byte(eml), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "archive.mbox"), []byte(mbox), 0600))
+
+	homePaperless, homeDocuments := newTestPaperless(t)
+	officePaperless, officeDocuments := newTestPaperless(t)
+
+	handler := &EmailHandler{
+		Targets: []*EmailHandler{
+			{AllowList: AllowList{ToAddress: "home@"}, Target: "home", paperless: homePaperless},
+			{AllowList: AllowList{ToAddress: "office@"}, Target: "office", paperless: officePaperless},
+		},
+	}
+
+	var output bytes.Buffer
+	ingester := &Ingester{Handler: handler, Route: true, Output: &output}
+	require.NoError(t, ingester.IngestPath(dir))
+
+	assert.Equal(t, 2, ingester.Succeeded)
+	assert.Equal(t, 1, ingester.Failed, "emails not addressed to a target should fail")
+
+	require.Len(t, *homeDocuments, 1)
+	assert.Equal(t, "Statement.pdf", (*homeDocuments)[0].Filename)
+	require.Len(t, *officeDocuments, 1)
+	assert.Equal(t, "January.pdf", (*officeDocuments)[0].Filename)
+
+	assert.Contains(t, output.String(), "ok\t"+filepath.Join(dir, "bills", "statement.eml")+"\tStatement\n")
+	assert.Contains(t, output.String(), "ok\t"+filepath.Join(dir, "archive.mbox")+"#1\tJanuary\n")
+	assert.Contains(t, output.String(), "failed\t"+filepath.Join(dir, "archive.mbox")+"#2\t")
+}
+
+func TestIngestDryRun(t *testing.T) {
+	client, documents := newTestPaperless(t)
+
+	var output bytes.Buffer
+	ingester := &Ingester{Handler: &EmailHandler{paperless: client}, DryRun: true, Output: &output}
+	ingester.Ingest("invoice.eml", []byte(dryRunEmail))
+
+	assert.Equal(t, 1, ingester.Succeeded)
+	assert.Empty(t, *documents, "nothing should be uploaded during a dry run")
+	assert.Equal(t, "ok\tinvoice.eml\tInvoice\n\tinvoice.pdf (application/pdf, 16 bytes)\n", output.String())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+)
+
+var errProcessingLimit = errors.New("email exceeded processing limits")
+
+// ProcessingLimits restrict how much work a single incoming email may cause,
+// including any emails nested within it. A limit of 0 is unlimited.
+type ProcessingLimits struct {
+	// MaxDepth is how many levels of attached emails may be processed.
+	MaxDepth int
+	// MaxSize is the total number of attachment bytes that may be processed.
+	MaxSize int64
+	// MaxAttachments is the total number of attachments that may be processed.
+	MaxAttachments int
+}
+
+// processingState tracks the limits shared by an email and everything nested
+// within it.
+type processingState struct {
+	limits ProcessingLimits
+
+	depth       int
+	size        int64
+	attachments int
+	// documents is how many attachments have been named for upload.
+	documents int
+	// emails are the email being processed and each email it is nested in.
+	emails []*email.Email
+	// attachedEmails are the hashes of attached emails that were already
+	// processed.
+	attachedEmails map[[sha256.Size]byte]bool
+	// correspondents are the correspondents already looked up for each
+	// sender, so Paperless is only asked once per email.
+	correspondents map[string]int
+	// origins are the origins of each email, so forwards are only detected
+	// once per email.
+	origins map[*email.Email]EmailOrigin
+}
+
+// withProcessing returns a copy of the handler tracking the limits of a new
+// email, or the handler itself if it is already processing an email.
+func (handler *EmailHandler) withProcessing() *EmailHandler {
+	if handler.processing != nil {
+		return handler
+	}
+
+	h := *handler
+	h.processing = &processingState{
+		limits:         handler.ProcessingLimits,
+		attachedEmails: map[[sha256.Size]byte]bool{},
+		correspondents: map[string]int{},
+		origins:        map[*email.Email]EmailOrigin{},
+	}
+
+	return &h
+}
+
+// enter records that an email is being processed, failing if it is nested too
+// deeply. Each call must be followed by a call to exit.
+func (state *processingState) enter(email *email.Email) error {
+	state.depth++
+	state.emails = append(state.emails, email)
+	if state.limits.MaxDepth > 0 && state.depth > state.limits.MaxDepth {
+		return fmt.Errorf("%w: emails were nested more than %d deep", errProcessingLimit, state.limits.MaxDepth)
+	}
+
+	return nil
+}
+
+// exit records that processing an email has finished.
+func (state *processingState) exit() {
+	state.depth--
+	state.emails = state.emails[:len(state.emails)-1]
+}
+
+// current returns the innermost email being processed.
+func (state *processingState) current() *email.Email {
+	if len(state.emails) == 0 {
+		return nil
+	}
+
+	return state.emails[len(state.emails)-1]
+}
+
+// senders returns the senders of the email and each email it is nested in.
+func (state *processingState) senders() []string {
+	senders := make([]string, 0, len(state.emails))
+	for _, email := range state.emails {
+		senders = append(senders, email.From)
+	}
+
+	return senders
+}
+
+// add records an attachment, failing if too many attachments or bytes have
+// been processed.
+func (state *processingState) add(attachment *email.Attachment) error {
+	state.attachments++
+	if state.limits.MaxAttachments > 0 && state.attachments > state.limits.MaxAttachments {
+		return fmt.Errorf("%w: more than %d attachments", errProcessingLimit, state.limits.MaxAttachments)
+	}
+
+	state.size += int64(len(attachment.Content))
+	if state.limits.MaxSize > 0 && state.size > state.limits.MaxSize {
+		return fmt.Errorf("%w: more than %d bytes of attachments", errProcessingLimit, state.limits.MaxSize)
+	}
+
+	return nil
+}
+
+// seen checks if an identical attached email was already processed, so the
+// same message attached repeatedly is only uploaded once.
+func (state *processingState) seen(attachment *email.Attachment) bool {
+	hash := sha256.Sum256(attachment.Content)
+	if state.attachedEmails[hash] {
+		log.WithField("filename", attachment.Filename).Warn("attached email was already processed, skipping")
+		return true
+	}
+
+	state.attachedEmails[hash] = true
+	return false
+}
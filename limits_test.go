@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nestedEmail creates an email with the given number of emails nested within
+// it, the innermost of which has a PDF attachment.
+func nestedEmail(t *testing.T, depth int) *email.Email {
+	e := email.NewEmail()
+	e.From = "sender@example.com"
+	e.Subject = "Bill"
+	e.Text = []byte("See attached")
+
+	if depth == 0 {
+		e.Attachments = []*email.Attachment{{Filename: "bill.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: []byte("pdf")}}
+		return e
+	}
+
+	contents, err := nestedEmail(t, depth-1).Bytes()
+	require.Nil(t, err, "nested email should serialize")
+
+	e.Attachments = []*email.Attachment{{Filename: "forwarded.eml", ContentType: "message/rfc822", Header: textproto.MIMEHeader{}, Content: contents}}
+	return e
+}
+
+func TestProcessEmailDepthLimit(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+	handler := EmailHandler{paperless: paperless, BodyPolicy: BodyAttachmentsOnly, ProcessingLimits: ProcessingLimits{MaxDepth: 3}}
+
+	err := handler.ProcessEmail(nestedEmail(t, 2))
+	require.Nil(t, err, "email within depth limit should be processed")
+	require.Len(t, *documents, 1)
+	assert.Equal(t, "bill.pdf", (*documents)[0].Filename)
+
+	err = handler.ProcessEmail(nestedEmail(t, 3))
+	assert.True(t, errors.Is(err, errProcessingLimit), "deeply nested email should exceed limits")
+	assert.Len(t, *documents, 1, "nothing should be uploaded past the depth limit")
+	assert.Nil(t, handler.processing, "handler should not keep processing state")
+}
+
+func TestProcessEmailAttachmentLimits(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+	handler := EmailHandler{paperless: paperless, BodyPolicy: BodyAttachmentsOnly, ProcessingLimits: ProcessingLimits{MaxAttachments: 2}}
+
+	e := email.NewEmail()
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		e.Attachments = append(e.Attachments, &email.Attachment{Filename: name, Header: textproto.MIMEHeader{}, Content: []byte("pdf")})
+	}
+
+	err := handler.ProcessEmail(e)
+	assert.True(t, errors.Is(err, errProcessingLimit), "too many attachments should exceed limits")
+	assert.Len(t, *documents, 2)
+
+	// Each email is tracked separately.
+	e.Attachments = e.Attachments[:2]
+	assert.Nil(t, handler.ProcessEmail(e), "email within limits should be processed")
+
+	handler.ProcessingLimits = ProcessingLimits{MaxSize: 5}
+	err = handler.ProcessEmail(e)
+	assert.True(t, errors.Is(err, errProcessingLimit), "too many bytes should exceed limits")
+}
+
+func TestProcessEmailDuplicateEmails(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+	handler := EmailHandler{paperless: paperless, BodyPolicy: BodyAttachmentsOnly}
+
+	e := nestedEmail(t, 1)
+	e.Attachments = append(e.Attachments, e.Attachments[0])
+
+	err := handler.ProcessEmail(e)
+	require.Nil(t, err, "email should be processed")
+	assert.Len(t, *documents, 1, "identical attached emails should only be processed once")
+}
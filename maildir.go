@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+// MaildirWatcher processes messages delivered to the new directory of a
+// Maildir, moving them to cur once processed or to the failure folder if they
+// could not be processed. Messages that failed because Paperless, Gotenberg,
+// or the network were unavailable are left in new to be tried again.
+type MaildirWatcher struct {
+	Path string
+	// FailurePath is a Maildir for messages that could not be processed.
+	FailurePath string
+	// PollInterval is how often new messages are checked for, in addition to
+	// watching for them where supported.
+	PollInterval time.Duration
+
+	// Handler returns the handler used for each message, so messages use the
+	// latest configuration.
+	Handler func() *EmailHandler
+
+	// reported are the messages in new that were already reported during a
+	// dry run.
+	reported map[string]bool
+	// retrying are the recorded messages in new that failed temporarily, so
+	// trying them again doesn't record them again.
+	retrying map[string]*Message
+}
+
+// Run processes messages until the context is done.
+func (watcher *MaildirWatcher) Run(ctx context.Context) error {
+	for _, path := range []string{watcher.Path, watcher.FailurePath} {
+		for _, dir := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+				return err
+			}
+		}
+	}
+
+	events, err := watchDir(ctx, filepath.Join(watcher.Path, "new"))
+	if err != nil {
+		log.Warnf("could not watch maildir, polling for new messages: %s", err.Error())
+	}
+
+	ticker := time.NewTicker(watcher.PollInterval)
+	defer ticker.Stop()
+
+	log.Infof("watching maildir %s", watcher.Path)
+
+	for {
+		watcher.processNew()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNew processes every message in the new directory.
+func (watcher *MaildirWatcher) processNew() {
+	entries, err := os.ReadDir(filepath.Join(watcher.Path, "new"))
+	if err != nil {
+		log.Errorf("could not read maildir: %s", err.Error())
+		return
+	}
+
+	present := map[string]bool{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		present[entry.Name()] = true
+		watcher.processMessage(entry.Name())
+	}
+
+	// Forget messages that were removed from new by something else.
+	for name := range watcher.reported {
+		if !present[name] {
+			delete(watcher.reported, name)
+		}
+	}
+	for name := range watcher.retrying {
+		if !present[name] {
+			delete(watcher.retrying, name)
+		}
+	}
+}
+
+// processMessage processes a single message and moves it out of the new
+// directory, unless it failed temporarily. During a dry run, the report is
+// logged and the message is left in new so it is processed once dry runs are
+// disabled.
+func (watcher *MaildirWatcher) processMessage(name string) {
+	handler := watcher.Handler()
+	if handler.DryRun && watcher.reported[name] {
+		return
+	}
+
+	start := time.Now()
+	incomingEmails.Inc()
+
+	path := filepath.Join(watcher.Path, "new", name)
+	logCtx := log.WithField("message", name)
+
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		from, to := deliveryEnvelope(raw)
+		logCtx = logCtx.WithFields(log.Fields{
+			"from": from,
+			"to":   to,
+		})
+		logCtx.Info("got email")
+
+		if handler.DryRun {
+			logCtx = logCtx.WithField("dry_run", true)
+			report := &DryRunReport{From: from, To: to, Documents: []DryRunDocument{}}
+			_ = handler.receive(logCtx, from, to, raw, report)
+
+			watcher.report(logCtx, name, report)
+			return
+		}
+
+		handler = watcher.track(handler, name, from, to, raw)
+		if err = handler.receive(logCtx, from, to, raw, nil); err != nil && temporaryError(err) {
+			logCtx.Warnf("leaving message in new to try again: %s", err.Error())
+			if handler.message != nil {
+				if watcher.retrying == nil {
+					watcher.retrying = map[string]*Message{}
+				}
+				watcher.retrying[name] = handler.message
+			}
+			return
+		}
+	} else {
+		logCtx.Errorf("could not read message: %s", err.Error())
+	}
+
+	// Messages are marked as seen once processed, and left unseen in the
+	// failure folder so they stand out.
+	dest := filepath.Join(watcher.Path, "cur", name+":2,S")
+	if err != nil {
+		dest = filepath.Join(watcher.FailurePath, "cur", name+":2,")
+	}
+
+	if err = os.Rename(path, dest); err != nil {
+		logCtx.Errorf("could not move message: %s", err.Error())
+		return
+	}
+	delete(watcher.reported, name)
+	delete(watcher.retrying, name)
+
+	logCtx.Info("finished handling email")
+	emailProcessingTime.UpdateDuration(start)
+}
+
+// track records a message in the history, reusing the message recorded when
+// it last failed temporarily if it is still in the history.
+func (watcher *MaildirWatcher) track(handler *EmailHandler, name, from string, to []string, raw []byte) *EmailHandler {
+	if message, ok := watcher.retrying[name]; ok && handler.History != nil {
+		if message, err := handler.History.Retry(message.ID); err == nil {
+			return handler.withMessage(message)
+		}
+	}
+
+	return handler.track("maildir", from, to, raw)
+}
+
+// temporaryError checks if processing failed because Paperless, Gotenberg, or
+// the network were unavailable, so trying again later may succeed.
+func temporaryError(err error) bool {
+	var netError net.Error
+	if errors.As(err, &netError) {
+		return true
+	}
+
+	var paperlessError *paperless.PaperlessError
+	if errors.As(err, &paperlessError) {
+		return paperlessError.StatusCode >= 500 || paperlessError.StatusCode == http.StatusTooManyRequests
+	}
+
+	var gotenbergError *gotenbergError
+	if errors.As(err, &gotenbergError) {
+		return gotenbergError.StatusCode >= 500 || gotenbergError.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+// report logs the dry run report for a message and remembers that it was
+// reported.
+func (watcher *MaildirWatcher) report(logCtx *log.Entry, name string, report *DryRunReport) {
+	if watcher.reported == nil {
+		watcher.reported = map[string]bool{}
+	}
+	watcher.reported[name] = true
+
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		logCtx.Errorf("could not encode dry run report: %s", err.Error())
+		return
+	}
+
+	logCtx.WithField("report", string(encoded)).Info("dry run, leaving message in new")
+}
+
+// deliveryEnvelope returns the sender and recipients of a delivered message,
+// from the headers added by the delivery agent if possible.
+func deliveryEnvelope(raw []byte) (string, []string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", nil
+	}
+
+	from := strings.Trim(msg.Header.Get("Return-Path"), "<> ")
+	if from == "" {
+		if address, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			from = address.Address
+		}
+	}
+
+	var to []string
+	for _, key := range []string{"Delivered-To", "X-Original-To"} {
+		for _, value := range msg.Header[key] {
+			to = append(to, strings.Trim(value, "<> "))
+		}
+	}
+
+	if len(to) == 0 {
+		for _, key := range []string{"To", "Cc"} {
+			addresses, _ := msg.Header.AddressList(key)
+			for _, address := range addresses {
+				to = append(to, address.Address)
+			}
+		}
+	}
+
+	return from, to
+}
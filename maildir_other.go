@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchDir is not supported on this platform, so directories are polled.
+func watchDir(ctx context.Context, dir string) (<-chan struct{}, error) {
+	return nil, errors.New("watching directories is not supported on this platform")
+}
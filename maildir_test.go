@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+func TestDeliveryEnvelope(t *testing.T) {
+	from, to := deliveryEnvelope([]byte("Return-Path: <bounce@example.com>\r\nDelivered-To: home@example.com\r\nFrom: Me <me@example.com>\r\nTo: other@example.com\r\n\r\nBody"))
+	assert.Equal(t, "bounce@example.com", from)
+	assert.Equal(t, []string{"home@example.com"}, to)
+
+	from, to = deliveryEnvelope([]byte("From: Me <me@example.com>\r\nTo: Home <home@example.com>\r\nCc: office@example.com\r\n\r\nBody"))
+	assert.Equal(t, "me@example.com", from, "the from header should be used without a return path")
+	assert.Equal(t, []string{"home@example.com", "office@example.com"}, to)
+}
+
+func TestMaildirWatcher(t *testing.T) {
+	dir := t.TempDir()
+	client, documents := newTestPaperless(t)
+
+	handler := &EmailHandler{
+		AllowList:        AllowList{[]string{"me@example.com"}, ""},
+		ProcessingLimits: ProcessingLimits{MaxSize: 10},
+		paperless:        client,
+	}
+
+	watcher := &MaildirWatcher{
+		Path:         filepath.Join(dir, "Maildir"),
+		FailurePath:  filepath.Join(dir, "Maildir", ".Failed"),
+		PollInterval: 10 * time.Millisecond,
+		Handler:      func() *EmailHandler { return handler },
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- watcher.Run(ctx)
+	}()
+	// The watcher must have stopped before reading the uploaded documents.
+	stopped := false
+	stop := func() {
+		if !stopped {
+			stopped = true
+			cancel()
+			require.NoError(t, <-done)
+		}
+	}
+	t.Cleanup(stop)
+
+	deliver := func(name, contents string) {
+		tmp := filepath.Join(watcher.Path, "tmp", name)
+		require.NoError(t, os.WriteFile(tmp, []byte(contents), 0600))
+		require.NoError(t, os.Rename(tmp, filepath.Join(watcher.Path, "new", name)))
+	}
+
+	// Wait for the watcher to create the Maildir.
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(watcher.Path, "tmp"))
+		return err == nil
+	}, time.Second, time.Millisecond)
+
+	deliver("1.allowed", "From: me@example.com\r\nSubject: Allowed\r\nContent-Type: text/plain\r\n\r\nBody\r\n")
+	deliver("2.filtered", "From: spam@example.com\r\nSubject: Spam\r\nContent-Type: text/plain\r\n\r\nBody\r\n")
+	deliver("3.large", dryRunEmail)
+
+	assert.Eventually(t, func() bool {
+		entries, err := os.ReadDir(filepath.Join(watcher.Path, "new"))
+		return err == nil && len(entries) == 0
+	}, time.Second, time.Millisecond, "messages should be moved out of new")
+
+	assert.FileExists(t, filepath.Join(watcher.Path, "cur", "1.allowed:2,S"))
+	assert.FileExists(t, filepath.Join(watcher.Path, "cur", "2.filtered:2,S"), "emails that aren't allowed are not failures")
+	assert.FileExists(t, filepath.Join(watcher.FailurePath, "cur", "3.large:2,"), "emails that could not be processed should be moved to the failure folder")
+
+	stop()
+	require.Len(t, *documents, 1)
+	assert.Equal(t, "Allowed.pdf", (*documents)[0].Filename)
+}
+
+func TestMaildirWatcherDryRun(t *testing.T) {
+	dir := t.TempDir()
+	client, documents := newTestPaperless(t)
+
+	handler := &EmailHandler{
+		AllowList: AllowList{[]string{"me@example.com"}, ""},
+		DryRun:    true,
+		paperless: client,
+	}
+
+	watcher := &MaildirWatcher{
+		Path:    dir,
+		Handler: func() *EmailHandler { return handler },
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, sub), 0700))
+	}
+
+	message := filepath.Join(dir, "new", "1.allowed")
+	require.NoError(t, os.WriteFile(message, []byte(dryRunEmail), 0600))
+
+	watcher.processNew()
+	watcher.processNew()
+
+	assert.FileExists(t, message, "messages should be left in new during a dry run")
+	assert.Empty(t, *documents, "nothing should be uploaded during a dry run")
+	assert.Equal(t, map[string]bool{"1.allowed": true}, watcher.reported, "messages should only be reported once")
+
+	handler.DryRun = false
+	watcher.processNew()
+
+	assert.FileExists(t, filepath.Join(dir, "cur", "1.allowed:2,S"), "messages should be processed once dry runs are disabled")
+	assert.Len(t, *documents, 1)
+	assert.Empty(t, watcher.reported, "messages moved out of new should be forgotten")
+}
+
+func TestMaildirWatcherTemporaryFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	status := http.StatusServiceUnavailable
+	var uploads int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uploads++
+		w.WriteHeader(status)
+		fmt.Fprint(w, `"task"`)
+	}))
+	t.Cleanup(ts.Close)
+
+	history := NewHistory(10, 0)
+	handler := &EmailHandler{
+		AllowList: AllowList{[]string{"me@example.com"}, ""},
+		History:   history,
+		paperless: paperless.New(ts.URL, "apiKey", http.DefaultClient),
+	}
+
+	watcher := &MaildirWatcher{
+		Path:        dir,
+		FailurePath: filepath.Join(dir, ".Failed"),
+		Handler:     func() *EmailHandler { return handler },
+	}
+	for _, path := range []string{dir, watcher.FailurePath} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(path, sub), 0700))
+		}
+	}
+
+	message := filepath.Join(dir, "new", "1.allowed")
+	require.NoError(t, os.WriteFile(message, []byte("From: me@example.com\r\nSubject: Allowed\r\nContent-Type: text/plain\r\n\r\nBody\r\n"), 0600))
+
+	watcher.processNew()
+	assert.FileExists(t, message, "messages should be left in new while paperless is unavailable")
+	assert.Equal(t, 1, uploads)
+
+	watcher.processNew()
+	assert.FileExists(t, message)
+	assert.Equal(t, 2, uploads, "messages should be tried again")
+
+	messages := history.Messages()
+	require.Len(t, messages, 1, "messages tried again should not be recorded again")
+	assert.Equal(t, MessageFailed, messages[0].Status)
+	assert.Equal(t, 2, messages[0].Attempts)
+
+	status = http.StatusBadRequest
+	watcher.processNew()
+	assert.FileExists(t, filepath.Join(watcher.FailurePath, "cur", "1.allowed:2,"), "messages rejected by paperless should be moved to the failure folder")
+	assert.Empty(t, watcher.retrying, "messages moved out of new should be forgotten")
+}
+
+func TestTemporaryError(t *testing.T) {
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{fmt.Errorf("%w: bad header", errInvalidEmail), false},
+		{fmt.Errorf("%w: too many attachments", errProcessingLimit), false},
+		{&paperless.PaperlessError{StatusCode: http.StatusBadRequest}, false},
+		{fmt.Errorf("upload: %w", &paperless.PaperlessError{StatusCode: http.StatusBadGateway}), true},
+		{&paperless.PaperlessError{StatusCode: http.StatusTooManyRequests}, true},
+		{&gotenbergError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&gotenbergError{StatusCode: http.StatusBadRequest}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{errors.New("unknown"), false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.temporary, temporaryError(test.err), "%v", test.err)
+	}
+}
@@ -2,19 +2,21 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"mime/quotedprintable"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	_ "github.com/joho/godotenv/autoload"
-	"github.com/kelseyhightower/envconfig"
 
 	log "github.com/sirupsen/logrus"
 
@@ -33,50 +35,141 @@ var (
 	emailProcessingTime = metrics.NewHistogram("paperless_mailhook_email_processing_seconds")
 )
 
+var (
+	errUnsignedEmail = errors.New("email was not signed by its sender")
+	errInvalidEmail  = errors.New("email could not be parsed")
+)
+
 type Config struct {
-	PaperlessEndpoint string `required:"true"`
-	PaperlessAPIKey   string `required:"true"`
+	PaperlessEndpoint string
+	PaperlessAPIKey   string
 	PaperlessTags     []string
+	Targets           []string
+	// TargetConfigs are loaded for each of the Targets and any targets in the
+	// configuration file.
+	TargetConfigs     []TargetConfig `ignored:"true" yaml:"-"`
 	GotenbergEndpoint string
+	ConvertOffice     bool
+	OfficeTypes       []string
+	KeepOriginal      bool
+	MergeDocuments    bool
+	BodyPolicy        BodyPolicy `default:"body-if-no-attachments"`
+
+	// Archive and email limits of 0 are unlimited.
+	ExtractArchives  bool
+	ArchiveMaxDepth  int   `default:"3"`
+	ArchiveMaxSize   int64 `default:"104857600"`
+	ArchiveMaxFiles  int   `default:"100"`
+	ArchivePasswords []string
+
+	EmailMaxDepth       int   `default:"5"`
+	EmailMaxSize        int64 `default:"262144000"`
+	EmailMaxAttachments int   `default:"250"`
+
+	PDFPasswordFile string
+	PDFLockedTag    string
+
+	SMIMECertificate      string
+	SMIMEKey              string
+	SMIMERoots            string
+	SMIMERequireSignature bool
+
+	PGPKeyring          []string
+	PGPPassphrase       string
+	PGPRequireSignature bool
 
-	AllowedEmails []string `required:"true"`
+	AllowedEmails []string
 	ToAddress     string
 
+	HeaderTemplate string
+	DisableHeader  bool
+
+	ContentFilename    string
+	AttachmentFilename string
+	SetCreated         bool
+	SetCorrespondent   bool
+
+	OwnerFile string
+
+	DryRun bool
+
+	Maildir             string
+	MaildirFailed       string        `default:".Failed"`
+	MaildirPollInterval time.Duration `default:"30s"`
+
+	AdminUsername    string `default:"admin"`
+	AdminPassword    string
+	AdminHistory     int   `default:"100"`
+	AdminHistorySize int64 `default:"104857600"`
+
+	// Owners and PDFPasswords may only be set in the configuration file. They
+	// are combined with the contents of OwnerFile and PDFPasswordFile.
+	Owners       OwnerRules   `ignored:"true"`
+	PDFPasswords PDFPasswords `ignored:"true"`
+
+	// ConfigFile is a YAML file with any of these settings. Environment
+	// variables take precedence over the file.
+	ConfigFile string `yaml:"-"`
+
 	HTTPHost string `default:"127.0.0.1:5000"`
 	Debug    bool
 }
 
 func main() {
-	var cfg Config
-	if err := envconfig.Process("mailhook", &cfg); err != nil {
-		log.Fatal(err.Error())
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ingest":
+			os.Exit(ingestCommand(os.Args[2:]))
+		case "deliver":
+			os.Exit(deliverCommand(os.Args[2:], os.Stdin, os.Stdout))
+		default:
+			log.Fatalf("unknown command %s", os.Args[1])
+		}
 	}
 
-	if cfg.Debug {
-		log.SetLevel(log.TraceLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err.Error())
 	}
+	setLogLevel(cfg.Debug)
 
 	client := &http.Client{Transport: newAddHeaderTransport(nil)}
 
-	paperless := paperless.New(cfg.PaperlessEndpoint, cfg.PaperlessAPIKey, client)
-
-	var gotenbergClient *gotenberg.Client
-	if cfg.GotenbergEndpoint != "" {
-		log.Info("found gotenberg endpoint, enabling")
-		gotenbergClient = &gotenberg.Client{Hostname: cfg.GotenbergEndpoint, HTTPClient: client}
+	emailHandler, err := NewEmailHandler(cfg, client)
+	if err != nil {
+		log.Fatal(err.Error())
 	}
 
-	tags, err := ResolveTags(paperless, cfg.PaperlessTags)
-	if err != nil {
-		log.Fatalf("could not resolve tags: %s", err.Error())
+	emailHandler.History = NewHistory(cfg.AdminHistory, cfg.AdminHistorySize)
+
+	var handlers HandlerSwap
+	handlers.Store(emailHandler)
+
+	if cfg.ConfigFile != "" {
+		go WatchConfig(context.Background(), cfg.ConfigFile, configPollInterval, func() {
+			reloadConfig(&handlers, client, cfg.HTTPHost)
+		})
 	}
 
-	allowList := AllowList{cfg.AllowedEmails, cfg.ToAddress}
-	emailHandler := EmailHandler{allowList, tags, paperless, gotenbergClient}
+	if cfg.Maildir != "" {
+		watcher := &MaildirWatcher{
+			Path:         cfg.Maildir,
+			FailurePath:  cfg.MaildirFailed,
+			PollInterval: cfg.MaildirPollInterval,
+			Handler:      handlers.Load,
+		}
+		if !filepath.IsAbs(watcher.FailurePath) {
+			watcher.FailurePath = filepath.Join(cfg.Maildir, watcher.FailurePath)
+		}
 
-	http.HandleFunc("/sendgrid", emailHandler.sendGrid)
+		go func() {
+			if err := watcher.Run(context.Background()); err != nil {
+				log.Fatalf("could not watch maildir: %s", err.Error())
+			}
+		}()
+	}
+
+	http.HandleFunc("/sendgrid", handlers.sendGrid)
 	http.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprint(w, "OK")
 	})
@@ -84,18 +177,275 @@ func main() {
 		metrics.WritePrometheus(w, true)
 	})
 
+	if cfg.AdminPassword != "" {
+		admin := NewAdmin(cfg.AdminUsername, cfg.AdminPassword, emailHandler.History, handlers.Load)
+		http.Handle("/admin", admin)
+		http.Handle("/admin/", admin)
+	}
+
 	log.Infof("starting http server on %s", cfg.HTTPHost)
 	if err = http.ListenAndServe(cfg.HTTPHost, nil); err != nil {
 		log.Fatalf("could not start http server: %s", err.Error())
 	}
 }
 
+// setLogLevel enables trace logging in debug mode.
+func setLogLevel(debug bool) {
+	if debug {
+		log.SetLevel(log.TraceLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+}
+
+// NewEmailHandler creates a handler from the configuration, resolving tags and
+// owners on each Paperless instance.
+func NewEmailHandler(cfg Config, client *http.Client) (*EmailHandler, error) {
+	// The default Paperless instance is optional when every email is routed
+	// to a target.
+	var defaultPaperless *paperless.Paperless
+	if cfg.PaperlessEndpoint != "" || cfg.PaperlessAPIKey != "" || len(cfg.TargetConfigs) == 0 {
+		defaultPaperless = paperless.New(cfg.PaperlessEndpoint, cfg.PaperlessAPIKey, client)
+	}
+
+	var gotenbergClient *gotenberg.Client
+	if cfg.GotenbergEndpoint != "" {
+		log.Info("found gotenberg endpoint, enabling")
+		gotenbergClient = &gotenberg.Client{Hostname: cfg.GotenbergEndpoint, HTTPClient: client}
+	}
+
+	var err error
+	var tags []int
+	if defaultPaperless != nil {
+		if tags, err = ResolveTags(defaultPaperless, cfg.PaperlessTags); err != nil {
+			return nil, fmt.Errorf("could not resolve tags: %w", err)
+		}
+	}
+
+	var headerTemplate *template.Template
+	if !cfg.DisableHeader {
+		var contents []byte
+		if cfg.HeaderTemplate != "" {
+			if contents, err = os.ReadFile(cfg.HeaderTemplate); err != nil {
+				return nil, fmt.Errorf("could not read header template: %w", err)
+			}
+		}
+
+		if headerTemplate, err = ParseHeaderTemplate(string(contents)); err != nil {
+			return nil, fmt.Errorf("could not parse header template: %w", err)
+		}
+	}
+
+	filenames, err := ParseFilenameTemplates(cfg.ContentFilename, cfg.AttachmentFilename)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse filename templates: %w", err)
+	}
+
+	var officeTypes []string
+	if cfg.ConvertOffice {
+		if gotenbergClient == nil {
+			log.Warn("office conversion requires gotenberg, ignoring")
+		} else if len(cfg.OfficeTypes) > 0 {
+			officeTypes = cfg.OfficeTypes
+		} else {
+			officeTypes = DefaultOfficeTypes
+		}
+	}
+
+	if cfg.MergeDocuments && gotenbergClient == nil {
+		log.Warn("merging documents requires gotenberg, ignoring")
+	}
+
+	pdfPasswords := PDFPasswords{}
+	for sender, passwords := range cfg.PDFPasswords {
+		pdfPasswords[sender] = append(pdfPasswords[sender], passwords...)
+	}
+	if cfg.PDFPasswordFile != "" {
+		filePasswords, err := LoadPDFPasswords(cfg.PDFPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load pdf passwords: %w", err)
+		}
+		for sender, passwords := range filePasswords {
+			pdfPasswords[sender] = append(pdfPasswords[sender], passwords...)
+		}
+	}
+
+	var pdfLockedTag int
+	if cfg.PDFLockedTag != "" && defaultPaperless != nil {
+		if pdfLockedTag, err = defaultPaperless.ResolveTag(cfg.PDFLockedTag); err != nil {
+			return nil, fmt.Errorf("could not resolve locked pdf tag: %w", err)
+		}
+	}
+
+	ownerRules := OwnerRules{}
+	for sender, rule := range cfg.Owners {
+		ownerRules[sender] = rule
+	}
+	if cfg.OwnerFile != "" {
+		fileRules, err := LoadOwnerRules(cfg.OwnerFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load owner file: %w", err)
+		}
+		for sender, rule := range fileRules {
+			ownerRules[sender] = rule
+		}
+	}
+
+	var smime *SMIME
+	if cfg.SMIMECertificate != "" || cfg.SMIMEKey != "" || cfg.SMIMERoots != "" || cfg.SMIMERequireSignature {
+		if smime, err = LoadSMIME(cfg.SMIMECertificate, cfg.SMIMEKey, cfg.SMIMERoots); err != nil {
+			return nil, fmt.Errorf("could not load s/mime configuration: %w", err)
+		}
+		smime.RequireSignature = cfg.SMIMERequireSignature
+	}
+
+	var pgp *PGP
+	if len(cfg.PGPKeyring) > 0 {
+		if pgp, err = LoadPGP(cfg.PGPKeyring, cfg.PGPPassphrase); err != nil {
+			return nil, fmt.Errorf("could not load pgp keyring: %w", err)
+		}
+		pgp.RequireSignature = cfg.PGPRequireSignature
+	} else if cfg.PGPRequireSignature {
+		return nil, errors.New("requiring pgp signatures needs a keyring")
+	}
+
+	emailHandler := &EmailHandler{
+		AllowList:    AllowList{cfg.AllowedEmails, cfg.ToAddress},
+		Tags:         tags,
+		OfficeTypes:  officeTypes,
+		KeepOriginal: cfg.KeepOriginal,
+
+		BodyPolicy:     cfg.BodyPolicy,
+		MergeDocuments: cfg.MergeDocuments,
+
+		ExtractArchives: cfg.ExtractArchives,
+		ArchiveLimits: ArchiveLimits{
+			MaxDepth: cfg.ArchiveMaxDepth,
+			MaxSize:  cfg.ArchiveMaxSize,
+			MaxFiles: cfg.ArchiveMaxFiles,
+		},
+		ArchivePasswords: cfg.ArchivePasswords,
+
+		ProcessingLimits: ProcessingLimits{
+			MaxDepth:       cfg.EmailMaxDepth,
+			MaxSize:        cfg.EmailMaxSize,
+			MaxAttachments: cfg.EmailMaxAttachments,
+		},
+		PDFPasswords: pdfPasswords,
+		PDFLockedTag: pdfLockedTag,
+
+		SMIME: smime,
+		PGP:   pgp,
+
+		Filenames:        filenames,
+		SetCreated:       cfg.SetCreated,
+		SetCorrespondent: cfg.SetCorrespondent,
+
+		DryRun: cfg.DryRun,
+
+		OwnerRules: ownerRules,
+
+		paperless:       defaultPaperless,
+		gotenbergClient: gotenbergClient,
+		headerTemplate:  headerTemplate,
+	}
+
+	if defaultPaperless != nil {
+		if err = emailHandler.resolveOwners(); err != nil {
+			return nil, fmt.Errorf("could not resolve owners: %w", err)
+		}
+	}
+
+	if len(cfg.TargetConfigs) > 0 {
+		if emailHandler.Targets, err = LoadTargets(cfg.TargetConfigs, emailHandler, client, cfg.PDFLockedTag); err != nil {
+			return nil, err
+		}
+		log.Infof("loaded %d targets", len(emailHandler.Targets))
+	}
+
+	return emailHandler, nil
+}
+
 type EmailHandler struct {
 	AllowList
 	Tags []int
 
+	// Target is the name of the target this handler uploads to, or empty for
+	// the default Paperless instance.
+	Target string
+	// Targets are the handlers for each target, selected by the recipient of
+	// an email.
+	Targets []*EmailHandler
+
+	// OfficeTypes are the extensions and MIME types of attachments that should
+	// be converted to PDF before uploading. KeepOriginal additionally uploads
+	// the unconverted attachment.
+	OfficeTypes  []string
+	KeepOriginal bool
+
+	// BodyPolicy determines if the email body is uploaded alongside or instead
+	// of attachments.
+	BodyPolicy BodyPolicy
+
+	// MergeDocuments combines the email content and PDF or convertible
+	// attachments into a single document.
+	MergeDocuments bool
+
+	// ExtractArchives processes each file within attached archives instead of
+	// uploading the archive itself.
+	ExtractArchives  bool
+	ArchiveLimits    ArchiveLimits
+	ArchivePasswords []string
+
+	// ProcessingLimits restrict nested emails and the total attachments
+	// processed for each incoming email.
+	ProcessingLimits ProcessingLimits
+
+	// PDFPasswords are tried on encrypted PDF attachments. PDFs that can't be
+	// decrypted are uploaded with PDFLockedTag.
+	PDFPasswords PDFPasswords
+	PDFLockedTag int
+
+	// SMIME decrypts and verifies S/MIME messages, if configured.
+	SMIME *SMIME
+	// PGP decrypts and verifies PGP/MIME messages and attachments, if
+	// configured.
+	PGP *PGP
+
+	// Filenames are templates for the names of uploaded documents.
+	Filenames FilenameTemplates
+
+	// SetCreated and SetCorrespondent set the created date and the
+	// correspondent matching the sender on uploaded documents. The original
+	// sender is used for forwarded emails.
+	SetCreated       bool
+	SetCorrespondent bool
+
+	// DryRun evaluates emails without uploading anything, responding with a
+	// report of the documents that would have been uploaded.
+	DryRun bool
+
+	// OwnerRules assign documents to a Paperless user and groups by sender,
+	// resolved into owners on the handler's Paperless instance.
+	OwnerRules OwnerRules
+	owners     map[string]documentOwner
+	// sender is the envelope sender the email was allowed for, which owns
+	// its documents.
+	sender string
+
 	paperless       *paperless.Paperless
 	gotenbergClient *gotenberg.Client
+	headerTemplate  *template.Template
+
+	// processing is set while an email is being processed.
+	processing *processingState
+	// report records documents instead of uploading them during a dry run.
+	report *DryRunReport
+
+	// History records received messages and their outcome, if enabled.
+	History *History
+	// message is the history entry for the email being processed.
+	message *Message
 }
 
 // ProcessEmail evalulates attachments and uploads either the attachments or
@@ -110,25 +460,87 @@ func (handler *EmailHandler) ProcessEmail(email *email.Email) error {
 	})
 	logCtx.Info("processing email")
 
-	if len(email.Attachments) == 0 {
-		logCtx.Debug("email had no attachments")
+	handler = handler.withProcessing()
+	err := handler.processing.enter(email)
+	defer handler.processing.exit()
+	if err != nil {
+		return err
+	}
+
+	if handler.MergeDocuments && handler.gotenbergClient != nil {
+		logCtx.Debug("merging email into single document")
+		return handler.MergeEmail(email)
+	}
+
+	uploadBody, uploadAttachments := handler.BodyPolicy.Evaluate(email)
 
-		if handler.gotenbergClient == nil {
-			logCtx.Warn("got email without attachments and gotenberg is disabled, skipping")
-			return nil
+	if uploadAttachments && len(email.Attachments) > 0 {
+		logCtx.Debug("email has attachments, uploading")
+		for _, attachment := range email.Attachments {
+			if err := handler.UploadAttachment(attachment); err != nil {
+				return err
+			}
 		}
+	}
 
+	if uploadBody {
 		return handler.UploadContent(email)
 	}
 
-	logCtx.Debug("email has attachments, uploading")
-	for _, attachment := range email.Attachments {
-		if err := handler.UploadAttachment(attachment); err != nil {
-			return err
+	return nil
+}
+
+// PrepareEmail decrypts and verifies a raw email, if enabled, then parses it.
+// Signatures are only checked against the sender's address. If signatures are
+// required, either a S/MIME or PGP signature is accepted, including an inline
+// PGP signature on an email with only a text body.
+//
+// S/MIME emails that can't be decrypted fail, rather than uploading the
+// encrypted content.
+func (handler *EmailHandler) PrepareEmail(raw []byte, from string) (*email.Email, error) {
+	signed := false
+	requireSignature := false
+
+	if handler.SMIME != nil {
+		unwrapped, signer, err := handler.SMIME.Unwrap(raw)
+		if errors.Is(err, errSMIMEDecrypt) {
+			return nil, err
+		} else if err != nil {
+			log.Warnf("could not unwrap s/mime message, processing original: %s", err.Error())
+		} else {
+			raw = unwrapped
 		}
+
+		signed = signed || SignedBy(signer, from)
+		requireSignature = requireSignature || handler.SMIME.RequireSignature
 	}
 
-	return nil
+	if handler.PGP != nil {
+		unwrapped, signer, err := handler.PGP.Unwrap(raw)
+		if err != nil {
+			log.Warnf("could not unwrap pgp message, processing original: %s", err.Error())
+		} else {
+			raw = unwrapped
+		}
+
+		signed = signed || PGPSignedBy(signer, from)
+		requireSignature = requireSignature || handler.PGP.RequireSignature
+	}
+
+	email, err := ParseEmail(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	if handler.PGP != nil {
+		signed = signed || PGPSignedBy(handler.PGP.DecryptInline(email), from)
+	}
+
+	if requireSignature && !signed {
+		return nil, errUnsignedEmail
+	}
+
+	return email, nil
 }
 
 // UploadAttachment decodes and upload an email attachment to Paperless.
@@ -136,13 +548,31 @@ func (handler *EmailHandler) UploadAttachment(attachment *email.Attachment) erro
 	logCtx := log.WithField("filename", attachment.Filename)
 	logCtx.Debug("processing attachment")
 
+	handler = handler.withProcessing()
+	if err := handler.processing.add(attachment); err != nil {
+		return err
+	}
+
+	return handler.uploadAttachment(attachment)
+}
+
+// uploadAttachment uploads an attachment that has already been counted
+// towards the processing limits.
+func (handler *EmailHandler) uploadAttachment(attachment *email.Attachment) error {
+	logCtx := log.WithField("filename", attachment.Filename)
+
+	isEmail := strings.ToLower(attachment.ContentType) == "message/rfc822" || IsMsgAttachment(attachment) || IsTNEFAttachment(attachment)
+	if isEmail && handler.processing.seen(attachment) {
+		return nil
+	}
+
 	// We will always need the decoded contents of the attachment.
 	r := NewAttachmentReader(attachment)
 
 	if strings.ToLower(attachment.ContentType) == "message/rfc822" {
 		logCtx.Info("attachment was email, evaluating as new email")
 
-		email, err := email.NewEmailFromReader(r)
+		email, err := ParseEmail(r)
 		if err != nil {
 			return err
 		}
@@ -150,7 +580,31 @@ func (handler *EmailHandler) UploadAttachment(attachment *email.Attachment) erro
 		return handler.ProcessEmail(email)
 	}
 
-	if err := handler.paperless.UploadDocument(r, attachment.Filename, handler.Tags); err != nil {
+	if IsMsgAttachment(attachment) {
+		logCtx.Info("attachment was outlook message, evaluating as new email")
+		return handler.UploadMsg(r, attachment.Filename)
+	}
+
+	if IsTNEFAttachment(attachment) {
+		logCtx.Info("attachment was tnef, evaluating contents as new email")
+		return handler.UploadTNEF(r, attachment.Filename)
+	}
+
+	if handler.ExtractArchives && IsArchiveAttachment(attachment) {
+		return handler.UploadArchive(r, attachment.Filename)
+	}
+
+	filename := handler.attachmentFilename(attachment.Filename)
+
+	if handler.unlocksPDFs() && IsPDFAttachment(attachment) {
+		return handler.UploadPDF(r, filename)
+	}
+
+	if handler.gotenbergClient != nil && IsOfficeAttachment(attachment, handler.OfficeTypes) {
+		return handler.UploadOfficeAttachment(r, filename)
+	}
+
+	if err := handler.upload(r, filename, handler.Tags); err != nil {
 		return err
 	}
 
@@ -159,14 +613,37 @@ func (handler *EmailHandler) UploadAttachment(attachment *email.Attachment) erro
 }
 
 // UploadContent will convert email content to a PDF then upload to Paperless.
+// Without Gotenberg, text that can't be rendered is uploaded as a text file
+// instead.
 //
-// This should only be used when Gotenberg is available.
-//
-// It will use the email's subject for a filename, falling back to 'Email.pdf'
-// if no subject was set.
+// It will use the content filename template, or by default the email's
+// subject without reply prefixes, falling back to 'Email.pdf' if no subject was
+// set.
 func (handler *EmailHandler) UploadContent(email *email.Email) error {
-	if handler.gotenbergClient == nil {
-		return errors.New("gotenberg was unavailable")
+	if uploaded, err := handler.uploadNativeText(email); uploaded || err != nil {
+		return err
+	}
+
+	pdf, err := handler.RenderContent(email)
+	if err != nil {
+		return err
+	}
+	defer pdf.Close()
+
+	if err := handler.upload(pdf, handler.contentFilename(email), handler.Tags); err != nil {
+		return err
+	}
+
+	log.Debug("uploaded email contents")
+	return nil
+}
+
+// RenderContent converts the email content, including the header if enabled,
+// into a PDF using Gotenberg. If Gotenberg is unavailable, a simple text-only
+// PDF is rendered instead.
+func (handler *EmailHandler) RenderContent(email *email.Email) (io.ReadCloser, error) {
+	if email.HTML == nil && email.Text == nil {
+		return nil, errors.New("email was empty")
 	}
 
 	logCtx := log.WithFields(log.Fields{
@@ -176,52 +653,90 @@ func (handler *EmailHandler) UploadContent(email *email.Email) error {
 	})
 	logCtx.Info("converting email to pdf")
 
-	var resp *http.Response
-	if email.HTML != nil {
-		index, err := gotenberg.NewDocumentFromBytes("index.html", email.HTML)
-		if err != nil {
-			return err
-		}
+	header := NewEmailHeader(email)
 
-		req := gotenberg.NewHTMLRequest(index)
-		req.WaitTimeout(30)
-		resp, err = handler.gotenbergClient.Post(req)
-		if err != nil {
-			return err
+	if handler.gotenbergClient == nil {
+		logCtx.Debug("gotenberg is disabled, rendering natively")
+		return handler.renderNative(email, header)
+	}
+
+	if email.HTML == nil {
+		body, err := RenderTextHTML(email.Text, TextCharset(email.Headers.Get("Content-Type")))
+		if err == nil {
+			var pdf io.ReadCloser
+			if pdf, err = handler.renderHTML(body, header); err == nil {
+				return pdf, nil
+			}
 		}
-		defer resp.Body.Close()
-	} else if email.Text != nil {
-		index, err := gotenberg.NewDocumentFromBytes("index.txt", email.Text)
-		if err != nil {
-			return err
+
+		logCtx.Warnf("could not render text as html, falling back to office: %s", err.Error())
+		return handler.renderText(email.Text, header)
+	}
+
+	return handler.renderHTML(email.HTML, header)
+}
+
+// renderHTML converts an HTML document into a PDF with Chromium.
+func (handler *EmailHandler) renderHTML(body []byte, header EmailHeader) (io.ReadCloser, error) {
+	if handler.headerTemplate != nil {
+		var err error
+		if body, err = InjectHTMLHeader(handler.headerTemplate, header, body); err != nil {
+			return nil, err
 		}
+	}
 
-		req := gotenberg.NewOfficeRequest(index)
-		req.WaitTimeout(30)
-		resp, err = handler.gotenbergClient.Post(req)
-		if err != nil {
-			return err
+	index, err := gotenberg.NewDocumentFromBytes("index.html", body)
+	if err != nil {
+		return nil, err
+	}
+
+	req := gotenberg.NewHTMLRequest(index)
+	req.WaitTimeout(30)
+	return handler.postGotenberg(req)
+}
+
+// renderText converts a plain-text document into a PDF with LibreOffice.
+func (handler *EmailHandler) renderText(body []byte, header EmailHeader) (io.ReadCloser, error) {
+	if handler.headerTemplate != nil {
+		var err error
+		if body, err = InjectTextHeader(handler.headerTemplate, header, body); err != nil {
+			return nil, err
 		}
-		defer resp.Body.Close()
-	} else {
-		return errors.New("email was empty")
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("got wrong gotenberg status code: %d", resp.StatusCode)
+	index, err := gotenberg.NewDocumentFromBytes("index.txt", body)
+	if err != nil {
+		return nil, err
 	}
 
-	filename := "Email.pdf"
-	if email.Subject != "" {
-		filename = fmt.Sprintf("%s.pdf", email.Subject)
+	req := gotenberg.NewOfficeRequest(index)
+	req.WaitTimeout(30)
+	return handler.postGotenberg(req)
+}
+
+// postGotenberg sends a conversion request to Gotenberg, returning the body of
+// the resulting PDF if it was successful.
+func (handler *EmailHandler) postGotenberg(req gotenberg.Request) (io.ReadCloser, error) {
+	resp, err := handler.gotenbergClient.Post(req)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := handler.paperless.UploadDocument(resp.Body, filename, handler.Tags); err != nil {
-		return err
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &gotenbergError{StatusCode: resp.StatusCode}
 	}
 
-	log.Debug("uploaded email contents")
-	return nil
+	return resp.Body, nil
+}
+
+// gotenbergError is returned when Gotenberg could not convert a document.
+type gotenbergError struct {
+	StatusCode int
+}
+
+func (err *gotenbergError) Error() string {
+	return fmt.Sprintf("got wrong gotenberg status code: %d", err.StatusCode)
 }
 
 // sendGridEnvelope is the envelope data included in the webhook by SendGrid.
@@ -271,38 +786,122 @@ func (handler *EmailHandler) sendGrid(w http.ResponseWriter, req *http.Request)
 	})
 	logCtx.Info("got email")
 
-	if !handler.IsAllowedEmail(envelope.From, envelope.To) {
-		logCtx.Warn("email was not allowed")
+	var report *DryRunReport
+	if handler.isDryRun(req) {
+		logCtx = logCtx.WithField("dry_run", true)
+		report = &DryRunReport{From: envelope.From, To: envelope.To, Documents: []DryRunDocument{}}
+	}
 
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "OK")
+	emailValue, ok := req.MultipartForm.Value["email"]
+	if !ok {
+		logCtx.Errorf("email was missing content")
+
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "missing email")
 
 		return
 	}
 
-	// Email field should always be set and always have exactly one entry.
-	r := strings.NewReader(req.MultipartForm.Value["email"][0])
-	email, err := email.NewEmailFromReader(r)
+	raw := []byte(emailValue[0])
+	if report == nil {
+		handler = handler.track("sendgrid", envelope.From, envelope.To, raw)
+	}
+
+	// Errors are logged and SendGrid should not retry, so they're ignored.
+	_ = handler.receive(logCtx, envelope.From, envelope.To, raw, report)
+
+	logCtx.Info("finished handling email")
+
+	respond(w, report)
+
+	emailProcessingTime.UpdateDuration(start)
+}
+
+// receive routes, checks, and processes an email with the sender and
+// recipients from its envelope. Emails that weren't addressed to any target,
+// weren't allowed, or weren't signed are ignored. Errors are logged and
+// recorded in the report and message history, if any.
+func (handler *EmailHandler) receive(logCtx *log.Entry, from string, to []string, raw []byte, report *DryRunReport) error {
+	message := handler.message
+
+	handler, err := handler.route(to)
 	if err != nil {
+		logCtx.Warn("email was not addressed to any target")
+		filteredEmails.Inc()
+		report.fail(err)
+		message.finish(MessageFiltered, err.Error())
+
+		return nil
+	}
+	if handler.Target != "" {
+		logCtx = logCtx.WithField("target", handler.Target)
+	}
+	if report != nil {
+		report.Target = handler.Target
+		handler = handler.withReport(report)
+	}
+	if message != nil {
+		message.update(func(message *Message) {
+			message.Target = handler.Target
+		})
+		handler = handler.withMessage(message)
+	}
+
+	if !handler.IsAllowedEmail(from, to) {
+		logCtx.Warn("email was not allowed")
+		message.finish(MessageFiltered, "email was not allowed")
+
+		return nil
+	}
+	if report != nil {
+		report.Allowed = true
+	}
+	handler = handler.withSender(from)
+
+	email, err := handler.PrepareEmail(raw, from)
+	if errors.Is(err, errUnsignedEmail) {
+		logCtx.Warn("email was not signed by sender")
+		filteredEmails.Inc()
+		report.fail(err)
+		message.finish(MessageFiltered, err.Error())
+
+		return nil
+	} else if err != nil {
 		logCtx.Errorf("email could not be parsed: %s", err.Error())
+		report.fail(err)
+
+		err = fmt.Errorf("%w: %s", errInvalidEmail, err.Error())
+		message.finish(MessageFailed, err.Error())
+
+		return err
 	}
 
+	message.update(func(message *Message) {
+		message.Subject = email.Subject
+		for _, attachment := range email.Attachments {
+			message.Attachments = append(message.Attachments, attachment.Filename)
+		}
+	})
+
 	if err = handler.ProcessEmail(email); err != nil {
 		var paperlessError *paperless.PaperlessError
-		if errors.As(err, &paperlessError) {
+		if errors.Is(err, errProcessingLimit) {
+			logCtx.Errorf("email was too large to process: %s", err.Error())
+		} else if errors.As(err, &paperlessError) {
 			logCtx.Errorf("could not upload document to paperless: %s", paperlessError.Error())
 			logCtx.Errorf("full paperless error: %s", string(paperlessError.Body))
 		} else {
 			logCtx.Errorf("could not process email: %s", err.Error())
 		}
-	}
+		report.fail(err)
+		message.finish(MessageFailed, err.Error())
 
-	logCtx.Info("finished handling email")
+		return err
+	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "OK")
+	message.finish(MessageProcessed, "")
 
-	emailProcessingTime.UpdateDuration(start)
+	return nil
 }
 
 // ResolveTags attempts to convert values of tags into their corresponding IDs.
@@ -336,46 +935,23 @@ func IsQuotedPrintable(content []byte) bool {
 	}
 }
 
-// IsBase64 reads the first 1024 bytes to check if content is base-64 encoded.
-func IsBase64(content []byte) bool {
-	buf := make([]byte, 1024)
-	_, err := base64.StdEncoding.Decode(buf, content)
-	return err == nil
-}
-
 // NewAttachmentReader takes an email attachment and returns a reader, decoding
-// the data that it thinks is within.
-func NewAttachmentReader(attachment *email.Attachment) (r io.Reader) {
+// the data with the attachment's Content-Transfer-Encoding. Attachments that
+// were not encoded as described are returned as-is.
+func NewAttachmentReader(attachment *email.Attachment) io.Reader {
 	logCtx := log.WithField("filename", attachment.Filename)
 	logCtx.Trace("decoding email attachment")
 
-	// Look at header to determine how we should decode the contents of this
-	// attachment.
-	cte := strings.ToLower(attachment.Header.Get("Content-Transfer-Encoding"))
+	cte := attachment.Header.Get("Content-Transfer-Encoding")
 	logCtx.Tracef("attachment content-transfer-encoding: %s", cte)
 
-	contentReader := bytes.NewReader(attachment.Content)
-
-	switch cte {
-	case "quoted-printable":
-		if IsQuotedPrintable(attachment.Content) {
-			r = quotedprintable.NewReader(contentReader)
-		} else {
-			logCtx.Warnf("attachment was described as %s but was not, defaulting to plain", cte)
-			r = contentReader
-		}
-	case "base64":
-		if IsBase64(attachment.Content) {
-			r = base64.NewDecoder(base64.StdEncoding, contentReader)
-		} else {
-			logCtx.Warnf("attachment was described as %s but was not, defaulting to plain", cte)
-			r = contentReader
-		}
-	default:
-		r = contentReader
+	data, err := DecodeTransferEncoding(cte, attachment.Content)
+	if err != nil {
+		logCtx.Warnf("attachment was described as %s but was not, defaulting to plain", cte)
+		return bytes.NewReader(attachment.Content)
 	}
 
-	return r
+	return bytes.NewReader(data)
 }
 
 // AllowList checks if an email was from an approved email address and
@@ -406,7 +982,7 @@ func (allow AllowList) IsAllowedEmail(from string, to []string) bool {
 	if allow.ToAddress != "" {
 		found := false
 		for _, email := range to {
-			if strings.EqualFold(email, allow.ToAddress) {
+			if MatchesAddress(allow.ToAddress, email) {
 				found = true
 				break
 			}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/textproto"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/jordan-wright/email"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thecodingmachine/gotenberg-go-client/v7"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
 )
 
 func TestIsQuotedPrintable(t *testing.T) {
@@ -24,21 +32,6 @@ func TestIsQuotedPrintable(t *testing.T) {
 	}
 }
 
-func TestIsBase64(t *testing.T) {
-	tests := []struct {
-		input []byte
-		want  bool
-	}{
-		{[]byte("%"), false},
-		{[]byte("ABC"), false},
-		{[]byte("dGVzdA=="), true},
-	}
-
-	for _, test := range tests {
-		assert.Equal(t, test.want, IsBase64(test.input))
-	}
-}
-
 func TestNewAttachmentReader(t *testing.T) {
 	base64Headers := textproto.MIMEHeader{}
 	base64Headers.Add("Content-Transfer-Encoding", "base64")
@@ -83,3 +76,93 @@ func TestIsAllowedEmail(t *testing.T) {
 		assert.Equal(t, test.allowed, test.allow.IsAllowedEmail(test.from, test.to))
 	}
 }
+
+// uploadedDocument is a document received by the test Paperless server.
+type uploadedDocument struct {
+	Filename string
+	Contents string
+	Tags     []string
+}
+
+// newTestPaperless starts a fake Paperless server that records all uploaded
+// documents.
+func newTestPaperless(t *testing.T) (*paperless.Paperless, *[]uploadedDocument) {
+	var documents []uploadedDocument
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Failing the test from the server's goroutine isn't allowed, so
+		// errors are reported with assert and the upload is failed instead.
+		err := req.ParseMultipartForm(MaxMemory)
+		if !assert.Nil(t, err, "must not have error parsing uploaded document") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		f, header, err := req.FormFile("document")
+		if !assert.Nil(t, err, "upload must contain document") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		data, err := io.ReadAll(f)
+		if !assert.Nil(t, err, "should be able to read document") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		documents = append(documents, uploadedDocument{header.Filename, string(data), req.MultipartForm.Value["tags"]})
+
+		fmt.Fprint(w, "OK")
+	}))
+	t.Cleanup(ts.Close)
+
+	return paperless.New(ts.URL, "apiKey", http.DefaultClient), &documents
+}
+
+// newTestGotenberg starts a fake Gotenberg server that returns the names of
+// the submitted files prefixed with the route.
+func newTestGotenberg(t *testing.T) *gotenberg.Client {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := req.ParseMultipartForm(MaxMemory)
+		if !assert.Nil(t, err, "must not have error parsing conversion request") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var names []string
+		for _, files := range req.MultipartForm.File {
+			for _, file := range files {
+				names = append(names, file.Filename)
+			}
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(w, "%s:%s", req.URL.Path, strings.Join(names, ","))
+	}))
+	t.Cleanup(ts.Close)
+
+	return &gotenberg.Client{Hostname: ts.URL, HTTPClient: http.DefaultClient}
+}
+
+func TestProcessEmailBodyPolicy(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	handler := EmailHandler{
+		BodyPolicy:      BodyAndAttachments,
+		paperless:       paperless,
+		gotenbergClient: newTestGotenberg(t),
+	}
+
+	e := &email.Email{
+		Subject:     "Receipt",
+		Text:        []byte("Thanks for your order"),
+		Headers:     textproto.MIMEHeader{},
+		Attachments: []*email.Attachment{{Filename: "logo.png", Content: []byte("png"), Header: textproto.MIMEHeader{}}},
+	}
+
+	err := handler.ProcessEmail(e)
+	require.Nil(t, err, "email should be processed without errors")
+
+	require.Len(t, *documents, 2, "attachment and body should be uploaded")
+	assert.Equal(t, "logo.png", (*documents)[0].Filename)
+	assert.Equal(t, "Receipt.pdf", (*documents)[1].Filename)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+var mboxFrom = []byte("From ")
+
+// MboxReader reads each message of an mbox file. Messages are separated by
+// lines starting with "From ", and lines within messages that were quoted as
+// ">From " are unquoted.
+type MboxReader struct {
+	r       *bufio.Reader
+	started bool
+}
+
+// NewMboxReader creates a reader for the messages of an mbox file.
+func NewMboxReader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReader(r)}
+}
+
+// IsMbox checks if data starts like an mbox file.
+func IsMbox(data []byte) bool {
+	return bytes.HasPrefix(data, mboxFrom)
+}
+
+// Next returns the next message, or io.EOF after the last message.
+func (mbox *MboxReader) Next() ([]byte, error) {
+	var message bytes.Buffer
+
+	for {
+		line, err := mbox.r.ReadBytes('\n')
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, mboxFrom) {
+				if mbox.started && message.Len() > 0 {
+					return message.Bytes(), nil
+				}
+				mbox.started = true
+				continue
+			}
+
+			// Anything before the first separator isn't part of a message.
+			if !mbox.started {
+				continue
+			}
+
+			// Writers quote lines starting with any number of > followed by
+			// "From ", so one > is removed.
+			if line[0] == '>' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxFrom) {
+				line = line[1:]
+			}
+
+			message.Write(line)
+		}
+
+		if err == io.EOF {
+			if message.Len() > 0 {
+				return message.Bytes(), nil
+			}
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMboxReader(t *testing.T) {
+	mbox := "From billing@bank.example Tue Mar  2 10:00:00 2021\n" +
+		"From: billing@bank.example\n" +
+		"Subject: First\n" +
+		"\n" +
+		">From the desk of the manager\n" +
+		">>From here\n" +
+		"\n" +
+		"From me@example.com Wed Mar  3 10:00:00 2021\n" +
+		"From: me@example.com\n" +
+		"Subject: Second\n" +
+		"\n" +
+		"Body\n"
+
+	r := NewMboxReader(strings.NewReader(mbox))
+
+	first, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "From: billing@bank.example\nSubject: First\n\nFrom the desk of the manager\n>From here\n\n", string(first))
+
+	second, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "From: me@example.com\nSubject: Second\n\nBody\n", string(second))
+
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestIsMbox(t *testing.T) {
+	assert.True(t, IsMbox([]byte("From me@example.com Tue Mar  2 10:00:00 2021\n")))
+	assert.False(t, IsMbox([]byte("From: me@example.com\n")))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+	"github.com/thecodingmachine/gotenberg-go-client/v7"
+)
+
+// IsPDFAttachment checks if an attachment is a PDF by extension or MIME type.
+func IsPDFAttachment(attachment *email.Attachment) bool {
+	if strings.EqualFold(filepath.Ext(attachment.Filename), ".pdf") {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(attachment.ContentType)
+	return err == nil && mediaType == "application/pdf"
+}
+
+// MergeEmail renders the email content and combines it with every PDF or
+// convertible attachment into a single Paperless document.
+//
+// Attachments that can't be merged are uploaded individually. As the purpose
+// of merging is to keep the body with its attachments, body-if-no-attachments
+// is treated as both.
+func (handler *EmailHandler) MergeEmail(email *email.Email) error {
+	logCtx := log.WithFields(log.Fields{
+		"from":    email.From,
+		"to":      email.To,
+		"subject": email.Subject,
+	})
+
+	handler = handler.withProcessing()
+
+	policy := handler.BodyPolicy
+	if policy == "" || policy == BodyIfNoAttachments {
+		policy = BodyAndAttachments
+	}
+	includeBody, includeAttachments := policy.Evaluate(email)
+
+	var pdfs [][]byte
+
+	if includeBody && (email.HTML != nil || email.Text != nil) {
+		pdf, err := handler.RenderContent(email)
+		if err != nil {
+			return err
+		}
+
+		data, err := io.ReadAll(pdf)
+		pdf.Close()
+		if err != nil {
+			return err
+		}
+
+		pdfs = append(pdfs, data)
+	}
+
+	attachments := email.Attachments
+	if !includeAttachments {
+		attachments = nil
+	}
+
+	for _, attachment := range attachments {
+		switch {
+		case IsPDFAttachment(attachment):
+			if err := handler.processing.add(attachment); err != nil {
+				return err
+			}
+
+			data, err := io.ReadAll(NewAttachmentReader(attachment))
+			if err != nil {
+				return err
+			}
+
+			// Encrypted PDFs can't be merged, so they are uploaded separately if
+			// they can't be decrypted.
+			data, ok := handler.unlockPDF(data, attachment.Filename)
+			if !ok {
+				if err = handler.upload(bytes.NewReader(data), handler.attachmentFilename(attachment.Filename), handler.lockedTags()); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			pdfs = append(pdfs, data)
+		case IsOfficeAttachment(attachment, handler.OfficeTypes):
+			if err := handler.processing.add(attachment); err != nil {
+				return err
+			}
+
+			data, err := io.ReadAll(NewAttachmentReader(attachment))
+			if err != nil {
+				return err
+			}
+
+			// The original is uploaded directly, as converting it again would
+			// fail the same way.
+			pdf, err := handler.convertAttachment(data, attachment.Filename)
+			if err != nil {
+				logCtx.Warnf("could not convert attachment %s, uploading separately: %s", attachment.Filename, err.Error())
+
+				if err = handler.upload(bytes.NewReader(data), handler.attachmentFilename(attachment.Filename), handler.Tags); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			pdfs = append(pdfs, pdf)
+		default:
+			if err := handler.UploadAttachment(attachment); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch len(pdfs) {
+	case 0:
+		logCtx.Debug("email had nothing to merge")
+		return nil
+	case 1:
+		return handler.upload(bytes.NewReader(pdfs[0]), handler.contentFilename(email), handler.Tags)
+	}
+
+	logCtx.Infof("merging %d documents", len(pdfs))
+
+	docs := make([]gotenberg.Document, 0, len(pdfs))
+	for i, data := range pdfs {
+		// Gotenberg merges files in alphabetical order of their names.
+		doc, err := gotenberg.NewDocumentFromBytes(fmt.Sprintf("%04d.pdf", i), data)
+		if err != nil {
+			return err
+		}
+
+		docs = append(docs, doc)
+	}
+
+	req := gotenberg.NewMergeRequest(docs...)
+	req.WaitTimeout(30)
+	merged, err := handler.postGotenberg(req)
+	if err != nil {
+		return err
+	}
+	defer merged.Close()
+
+	if err = handler.upload(merged, handler.contentFilename(email), handler.Tags); err != nil {
+		return err
+	}
+
+	logCtx.Info("uploaded merged document")
+	return nil
+}
+
+// convertAttachment converts an office attachment to a PDF, uploading the
+// original as well if configured.
+func (handler *EmailHandler) convertAttachment(data []byte, filename string) ([]byte, error) {
+	pdf, err := handler.convertOffice(data, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pdf.Close()
+
+	if handler.KeepOriginal {
+		if err = handler.upload(bytes.NewReader(data), handler.attachmentFilename(filename), handler.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	return io.ReadAll(pdf)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thecodingmachine/gotenberg-go-client/v7"
+)
+
+func TestIsPDFAttachment(t *testing.T) {
+	assert.True(t, IsPDFAttachment(&email.Attachment{Filename: "bill.PDF"}))
+	assert.True(t, IsPDFAttachment(&email.Attachment{Filename: "bill", ContentType: "application/pdf; name=bill"}))
+	assert.False(t, IsPDFAttachment(&email.Attachment{Filename: "logo.png", ContentType: "image/png"}))
+}
+
+func TestMergeEmail(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	handler := EmailHandler{
+		OfficeTypes:     DefaultOfficeTypes,
+		MergeDocuments:  true,
+		paperless:       paperless,
+		gotenbergClient: newTestGotenberg(t),
+	}
+
+	e := &email.Email{
+		Subject: "Bill",
+		HTML:    []byte("<p>Your bill</p>"),
+		Headers: textproto.MIMEHeader{},
+		Attachments: []*email.Attachment{
+			{Filename: "bill.pdf", ContentType: "application/pdf", Content: []byte("pdf")},
+			{Filename: "logo.png", ContentType: "image/png", Content: []byte("png")},
+			{Filename: "terms.docx", ContentType: "application/octet-stream", Content: []byte("docx")},
+		},
+	}
+
+	err := handler.ProcessEmail(e)
+	require.Nil(t, err, "email should be merged without errors")
+
+	require.Len(t, *documents, 2, "merged document and unmergeable attachment should be uploaded")
+	assert.Equal(t, "logo.png", (*documents)[0].Filename)
+	assert.Equal(t, "Bill.pdf", (*documents)[1].Filename)
+	assert.Equal(t, "/merge:0000.pdf,0001.pdf,0002.pdf", (*documents)[1].Contents)
+}
+
+func TestMergeEmailLimits(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	handler := EmailHandler{
+		MergeDocuments:   true,
+		ProcessingLimits: ProcessingLimits{MaxAttachments: 1},
+		paperless:        paperless,
+		gotenbergClient:  newTestGotenberg(t),
+	}
+
+	e := &email.Email{
+		Subject: "Bills",
+		Headers: textproto.MIMEHeader{},
+		Attachments: []*email.Attachment{
+			{Filename: "first.pdf", ContentType: "application/pdf", Content: []byte("pdf")},
+			{Filename: "second.pdf", ContentType: "application/pdf", Content: []byte("pdf")},
+		},
+	}
+
+	err := handler.ProcessEmail(e)
+	assert.ErrorIs(t, err, errProcessingLimit, "merged attachments should count towards the limits")
+	assert.Empty(t, *documents)
+
+	handler.ProcessingLimits = ProcessingLimits{MaxSize: 5}
+	err = handler.ProcessEmail(e)
+	assert.ErrorIs(t, err, errProcessingLimit, "merged attachments should count towards the size limit")
+}
+
+func TestMergeEmailConversionFailure(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	var conversions int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conversions++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(ts.Close)
+
+	handler := EmailHandler{
+		OfficeTypes:     DefaultOfficeTypes,
+		MergeDocuments:  true,
+		paperless:       paperless,
+		gotenbergClient: &gotenberg.Client{Hostname: ts.URL, HTTPClient: http.DefaultClient},
+	}
+
+	e := &email.Email{
+		Subject: "Bill",
+		Headers: textproto.MIMEHeader{},
+		Attachments: []*email.Attachment{
+			{Filename: "terms.docx", ContentType: "application/octet-stream", Content: []byte("docx")},
+		},
+	}
+
+	require.Nil(t, handler.ProcessEmail(e))
+	assert.Equal(t, 1, conversions, "failed conversions should not be retried")
+	require.Len(t, *documents, 1)
+	assert.Equal(t, "terms.docx", (*documents)[0].Filename)
+	assert.Equal(t, "docx", (*documents)[0].Contents, "original attachment should be uploaded")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/mail"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+// upload sends a document to Paperless with the metadata of the email being
+// processed, and sets its owner once it has been consumed. During a dry run,
+// the document is only recorded in the report.
+func (handler *EmailHandler) upload(r io.Reader, filename string, tags []int) error {
+	metadata := handler.documentMetadata(tags)
+	if handler.report != nil {
+		return handler.record(r, filename, metadata)
+	}
+
+	taskID, err := handler.paperless.UploadDocumentWithMetadata(r, filename, metadata)
+	if err != nil {
+		return err
+	}
+
+	handler.watchTask(filename, taskID)
+
+	return nil
+}
+
+// documentMetadata returns the metadata for documents from the email being
+// processed. For forwarded emails, the original sender and date are used.
+func (handler *EmailHandler) documentMetadata(tags []int) paperless.DocumentMetadata {
+	metadata := paperless.DocumentMetadata{Tags: tags}
+
+	if handler.processing == nil || handler.processing.current() == nil {
+		return metadata
+	}
+	if !handler.SetCreated && !handler.SetCorrespondent {
+		return metadata
+	}
+
+	origin := handler.emailOrigin(handler.processing.current())
+
+	if handler.SetCreated {
+		metadata.Created = origin.Date
+	}
+
+	if handler.SetCorrespondent {
+		correspondent, ok := handler.processing.correspondents[origin.From]
+		if !ok {
+			correspondent = handler.findCorrespondent(origin.From)
+			handler.processing.correspondents[origin.From] = correspondent
+		}
+
+		metadata.Correspondent = correspondent
+	}
+
+	return metadata
+}
+
+// findCorrespondent looks up a correspondent by the sender's name and then by
+// their address, returning 0 if neither exists.
+func (handler *EmailHandler) findCorrespondent(from string) int {
+	names := []string{from}
+	if address, err := mail.ParseAddress(from); err == nil {
+		names = []string{address.Name, address.Address}
+	}
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		id, err := handler.paperless.FindCorrespondent(name)
+		if err != nil {
+			log.WithField("correspondent", name).Warnf("could not look up correspondent: %s", err.Error())
+			return 0
+		}
+		if id != 0 {
+			return id
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,421 @@
+// Package msg parses Outlook .msg files, which store a message and its
+// attachments as MAPI properties within a Compound File Binary document.
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/richardlehane/mscfb"
+
+	"github.com/Syfaro/paperless-mailhook/tnef"
+)
+
+// Signature is the first eight bytes of every Compound File Binary document.
+var Signature = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// Storage and stream names used within a message.
+const (
+	propertiesStream  = "__properties_version1.0"
+	recipientPrefix   = "__recip_version1.0_"
+	attachmentPrefix  = "__attach_version1.0_"
+	substgPrefix      = "__substg1.0_"
+	embeddedMessageID = "3701000D"
+)
+
+// MAPI property IDs.
+const (
+	propSubject          = 0x0037
+	propClientSubmitTime = 0x0039
+	propSentName         = 0x0042
+	propSentEmail        = 0x0065
+	propTransportHeaders = 0x007d
+	propRecipientType    = 0x0c15
+	propSenderName       = 0x0c1a
+	propSenderEmail      = 0x0c1f
+	propDeliveryTime     = 0x0e06
+	propBody             = 0x1000
+	propRTFCompressed    = 0x1009
+	propHTML             = 0x1013
+	propDisplayName      = 0x3001
+	propEmailAddress     = 0x3003
+	propAttachData       = 0x3701
+	propAttachFilename   = 0x3704
+	propAttachLongName   = 0x3707
+	propAttachMIMETag    = 0x370e
+	propSMTPAddress      = 0x39fe
+	propSenderSMTP       = 0x5d01
+)
+
+// MAPI property types.
+const (
+	typeLong    = 0x0003
+	typeString8 = 0x001e
+	typeUnicode = 0x001f
+	typeSysTime = 0x0040
+	typeBinary  = 0x0102
+)
+
+// Recipient types.
+const (
+	recipientTo = 1
+	recipientCc = 2
+)
+
+var (
+	// ErrNotMsg is returned when data is not a Compound File Binary document.
+	ErrNotMsg = errors.New("data was not an outlook message")
+	// ErrMalformed is returned when the Compound File Binary header describes
+	// more sectors than the data contains.
+	ErrMalformed = errors.New("outlook message was malformed")
+)
+
+// Attachment is a file or message attached to an Outlook message.
+type Attachment struct {
+	Filename string
+	MIMEType string
+	Data     []byte
+	// Message is set instead of Data when the attachment is another message.
+	Message *Message
+}
+
+// Message is the decoded contents of an Outlook message.
+type Message struct {
+	Subject string
+	From    string
+	To      []string
+	Cc      []string
+	Date    time.Time
+	// Headers are the original internet headers, if the message was received
+	// over SMTP.
+	Headers string
+
+	Body []byte
+	HTML []byte
+	// RTF is the decompressed RTF body, if one was included.
+	RTF []byte
+
+	Attachments []*Attachment
+}
+
+// IsMsg checks if data starts with the Compound File Binary signature. Other
+// Office formats share this signature, so it does not guarantee the data is a
+// message.
+func IsMsg(data []byte) bool {
+	return bytes.HasPrefix(data, Signature)
+}
+
+// Parse reads an Outlook message, including any attached messages.
+func Parse(data []byte) (*Message, error) {
+	if !IsMsg(data) {
+		return nil, ErrNotMsg
+	}
+
+	// mscfb allocates based on the sector counts in the header, so they must
+	// be checked before it sees untrusted data.
+	if err := checkHeader(data); err != nil {
+		return nil, err
+	}
+
+	doc, err := mscfb.New(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	root := newStorage()
+	for {
+		entry, err := doc.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		parent := root
+		for _, name := range entry.Path {
+			parent = parent.child(name)
+		}
+
+		if entry.FileInfo().IsDir() {
+			parent.child(entry.Name)
+			continue
+		}
+
+		contents, err := io.ReadAll(entry)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", entry.Name, err)
+		}
+		parent.streams[entry.Name] = contents
+	}
+
+	if _, ok := root.streams[propertiesStream]; !ok {
+		return nil, ErrNotMsg
+	}
+
+	return root.message(32), nil
+}
+
+// checkHeader ensures the directory, FAT, mini FAT, and DIFAT sector counts
+// in a Compound File Binary header fit within the data.
+func checkHeader(data []byte) error {
+	if len(data) < 512 {
+		return ErrMalformed
+	}
+
+	var sectorSize uint64
+	switch binary.LittleEndian.Uint16(data[30:32]) {
+	case 9:
+		sectorSize = 512
+	case 12:
+		sectorSize = 4096
+	default:
+		return ErrMalformed
+	}
+
+	// The header occupies the first sector.
+	sectors := uint64(len(data)) / sectorSize
+	if sectors == 0 {
+		return ErrMalformed
+	}
+	sectors--
+
+	var total uint64
+	for _, offset := range []int{40, 44, 64, 72} {
+		count := uint64(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		if count > sectors {
+			return ErrMalformed
+		}
+		total += count
+	}
+	if total > sectors {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// storage is a directory within a Compound File Binary document.
+type storage struct {
+	streams  map[string][]byte
+	children map[string]*storage
+	// names keeps the order children were found in.
+	names []string
+}
+
+func newStorage() *storage {
+	return &storage{
+		streams:  map[string][]byte{},
+		children: map[string]*storage{},
+	}
+}
+
+// child returns the named child storage, creating it if needed.
+func (s *storage) child(name string) *storage {
+	if child, ok := s.children[name]; ok {
+		return child
+	}
+
+	child := newStorage()
+	s.children[name] = child
+	s.names = append(s.names, name)
+	return child
+}
+
+// string reads a string property, which may be stored as UTF-16 or in an
+// 8-bit codepage.
+func (s *storage) string(id uint16) string {
+	if data, ok := s.streams[streamName(id, typeUnicode)]; ok {
+		return decodeUTF16(data)
+	}
+
+	if data, ok := s.streams[streamName(id, typeString8)]; ok {
+		return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+	}
+
+	return ""
+}
+
+// binary reads a binary property.
+func (s *storage) binary(id uint16) []byte {
+	return s.streams[streamName(id, typeBinary)]
+}
+
+// fixed reads the value of a fixed-length property from the properties
+// stream. headerSize depends on the kind of storage.
+func (s *storage) fixed(id, typ uint16, headerSize int) ([]byte, bool) {
+	data := s.streams[propertiesStream]
+	for offset := headerSize; offset+16 <= len(data); offset += 16 {
+		tag := binary.LittleEndian.Uint32(data[offset:])
+		if uint16(tag>>16) == id && uint16(tag) == typ {
+			return data[offset+8 : offset+16], true
+		}
+	}
+
+	return nil, false
+}
+
+// time reads a timestamp property.
+func (s *storage) time(id uint16, headerSize int) time.Time {
+	value, ok := s.fixed(id, typeSysTime, headerSize)
+	if !ok {
+		return time.Time{}
+	}
+
+	return filetime(binary.LittleEndian.Uint64(value))
+}
+
+// message reads the storage as a message.
+func (s *storage) message(headerSize int) *Message {
+	msg := &Message{
+		Subject: s.string(propSubject),
+		Headers: s.string(propTransportHeaders),
+		HTML:    s.binary(propHTML),
+	}
+
+	if msg.HTML == nil {
+		if html := s.string(propHTML); html != "" {
+			msg.HTML = []byte(html)
+		}
+	}
+
+	if body := s.string(propBody); body != "" {
+		msg.Body = []byte(body)
+	}
+
+	if compressed := s.binary(propRTFCompressed); compressed != nil {
+		if rtf, err := tnef.DecompressRTF(compressed); err == nil {
+			msg.RTF = bytes.TrimRight(rtf, "\x00")
+		}
+	}
+
+	msg.From = s.sender()
+
+	msg.Date = s.time(propClientSubmitTime, headerSize)
+	if msg.Date.IsZero() {
+		msg.Date = s.time(propDeliveryTime, headerSize)
+	}
+
+	for _, name := range s.names {
+		child := s.children[name]
+
+		switch {
+		case strings.HasPrefix(name, recipientPrefix):
+			address := formatAddress(child.string(propDisplayName), child.address(propSMTPAddress, propEmailAddress))
+			if address == "" {
+				continue
+			}
+
+			switch child.recipientType() {
+			case recipientTo:
+				msg.To = append(msg.To, address)
+			case recipientCc:
+				msg.Cc = append(msg.Cc, address)
+			}
+		case strings.HasPrefix(name, attachmentPrefix):
+			msg.Attachments = append(msg.Attachments, child.attachment())
+		}
+	}
+
+	return msg
+}
+
+// sender formats the address of the message's sender.
+func (s *storage) sender() string {
+	if address := s.address(propSenderSMTP, propSenderEmail); address != "" {
+		return formatAddress(s.string(propSenderName), address)
+	}
+
+	return formatAddress(s.string(propSentName), s.string(propSentEmail))
+}
+
+// address returns the first property that looks like an email address.
+// Exchange users often have an X.500 address instead of an SMTP address.
+func (s *storage) address(ids ...uint16) string {
+	for _, id := range ids {
+		if address := s.string(id); strings.Contains(address, "@") {
+			return address
+		}
+	}
+
+	return ""
+}
+
+func (s *storage) recipientType() uint32 {
+	value, ok := s.fixed(propRecipientType, typeLong, 8)
+	if !ok {
+		return recipientTo
+	}
+
+	return binary.LittleEndian.Uint32(value)
+}
+
+// attachment reads the storage as an attachment.
+func (s *storage) attachment() *Attachment {
+	attachment := &Attachment{
+		Filename: s.string(propAttachLongName),
+		MIMEType: s.string(propAttachMIMETag),
+		Data:     s.binary(propAttachData),
+	}
+
+	if attachment.Filename == "" {
+		attachment.Filename = s.string(propAttachFilename)
+	}
+
+	if embedded, ok := s.children[substgPrefix+embeddedMessageID]; ok {
+		attachment.Message = embedded.message(24)
+	}
+
+	return attachment
+}
+
+// streamName returns the name of the stream holding a property.
+func streamName(id, typ uint16) string {
+	return fmt.Sprintf("%s%04X%04X", substgPrefix, id, typ)
+}
+
+// formatAddress combines a display name and email address.
+func formatAddress(name, address string) string {
+	if address == "" {
+		return name
+	}
+
+	if name == "" || name == address {
+		return address
+	}
+
+	return (&mail.Address{Name: name, Address: address}).String()
+}
+
+// filetime converts a Windows FILETIME, the number of 100 nanosecond
+// intervals since 1601, into a time.
+func filetime(value uint64) time.Time {
+	if value == 0 {
+		return time.Time{}
+	}
+
+	const epochDifference = 116444736000000000
+	nanos := (int64(value) - epochDifference) * 100
+	return time.Unix(0, nanos).UTC()
+}
+
+// decodeUTF16 decodes a little-endian UTF-16 string, stopping at any null
+// terminator.
+func decodeUTF16(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := binary.LittleEndian.Uint16(data[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
@@ -0,0 +1,59 @@
+package msg
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	data, err := os.ReadFile("../testdata/msg/test.msg")
+	require.Nil(t, err, "should be able to read fixture")
+	assert.True(t, IsMsg(data))
+
+	msg, err := Parse(data)
+	require.Nil(t, err, "fixture should parse")
+
+	assert.Equal(t, "test", msg.Subject)
+	assert.Equal(t, `"Lehane, Richard" <Richard.Lehane@records.nsw.gov.au>`, msg.From)
+	assert.Equal(t, []string{`"Lehane, Richard" <Richard.Lehane@records.nsw.gov.au>`}, msg.To)
+	assert.Empty(t, msg.Cc)
+	assert.Equal(t, time.Date(2013, 11, 17, 21, 26, 9, 0, time.UTC), msg.Date.Truncate(time.Second))
+	assert.True(t, strings.HasPrefix(string(msg.Body), "Test\r\n"), "body should be decoded")
+	assert.True(t, strings.HasPrefix(string(msg.RTF), `{\rtf1`), "rtf body should be decompressed")
+	assert.True(t, strings.HasPrefix(msg.Headers, "Received: "), "transport headers should be included")
+
+	require.Len(t, msg.Attachments, 2)
+	assert.Equal(t, "test.doc", msg.Attachments[0].Filename)
+	assert.Len(t, msg.Attachments[0].Data, 12288)
+	assert.Equal(t, "image001.gif", msg.Attachments[1].Filename)
+	assert.Equal(t, "image/gif", msg.Attachments[1].MIMEType)
+}
+
+func TestParseInvalid(t *testing.T) {
+	_, err := Parse([]byte("From: someone@example.com"))
+	assert.Equal(t, ErrNotMsg, err)
+}
+
+func TestParseMalformed(t *testing.T) {
+	data, err := os.ReadFile("../testdata/msg/test.msg")
+	require.Nil(t, err, "should be able to read fixture")
+
+	// A huge directory sector count used to make mscfb run out of memory.
+	binary.LittleEndian.PutUint32(data[40:44], 0x40000000)
+	_, err = Parse(data)
+	assert.Equal(t, ErrMalformed, err)
+
+	_, err = Parse(data[:100])
+	assert.Equal(t, ErrMalformed, err)
+}
+
+func TestFiletime(t *testing.T) {
+	assert.True(t, filetime(0).IsZero())
+	assert.Equal(t, time.Unix(0, 0).UTC(), filetime(116444736000000000))
+}
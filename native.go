@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+
+	"github.com/Syfaro/paperless-mailhook/pdf"
+)
+
+// blockElements are HTML elements that start on a new line when converted to
+// text.
+var blockElements = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "br": true,
+	"div": true, "dl": true, "dt": true, "dd": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// blankLines matches runs of blank lines left over from nested block
+// elements.
+var blankLines = regexp.MustCompile(`\n\s*\n\s*\n+`)
+
+// HTMLToText extracts the visible text from an HTML document, keeping line
+// breaks for block elements and the destinations of links.
+func HTMLToText(body []byte) string {
+	var b strings.Builder
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	skip := 0
+	pre := 0
+	href := ""
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			text := blankLines.ReplaceAllString(b.String(), "\n\n")
+			return strings.TrimSpace(text)
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+
+			text := string(tokenizer.Text())
+			if pre == 0 {
+				text = strings.Join(strings.Fields(text), " ")
+				if text == "" {
+					continue
+				}
+				if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+					b.WriteByte(' ')
+				}
+			}
+			b.WriteString(text)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch tag := string(name); {
+			case tag == "style" || tag == "script" || tag == "head":
+				skip++
+			case tag == "pre":
+				pre++
+				b.WriteByte('\n')
+			case tag == "a" && hasAttr:
+				for {
+					key, val, more := tokenizer.TagAttr()
+					if string(key) == "href" && strings.HasPrefix(string(val), "http") {
+						href = string(val)
+					}
+					if !more {
+						break
+					}
+				}
+			case blockElements[tag]:
+				b.WriteByte('\n')
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch tag := string(name); {
+			case tag == "style" || tag == "script" || tag == "head":
+				if skip > 0 {
+					skip--
+				}
+			case tag == "pre":
+				if pre > 0 {
+					pre--
+				}
+				b.WriteByte('\n')
+			case tag == "a":
+				if href != "" && !strings.HasSuffix(b.String(), href) {
+					b.WriteString(" (" + href + ")")
+				}
+				href = ""
+			case blockElements[tag]:
+				b.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// renderNative converts the email content into a PDF without Gotenberg. HTML
+// is reduced to its text content.
+func (handler *EmailHandler) renderNative(email *email.Email, header EmailHeader) (io.ReadCloser, error) {
+	content, err := handler.nativeText(email, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(pdf.Render(string(content)))), nil
+}
+
+// nativeText returns the text of the email content with the header, as
+// rendered without Gotenberg.
+func (handler *EmailHandler) nativeText(email *email.Email, header EmailHeader) ([]byte, error) {
+	var body string
+	if email.Text != nil {
+		body = string(DecodeCharset(email.Text, TextCharset(email.Headers.Get("Content-Type"))))
+	} else {
+		body = HTMLToText(email.HTML)
+	}
+
+	content := []byte(body)
+	if handler.headerTemplate != nil {
+		var err error
+		if content, err = InjectTextHeader(handler.headerTemplate, header, content); err != nil {
+			return nil, err
+		}
+	}
+
+	return content, nil
+}
+
+// uploadNativeText uploads the email content as a text file if it can't be
+// rendered into a PDF without Gotenberg, returning false if it can be.
+func (handler *EmailHandler) uploadNativeText(email *email.Email) (bool, error) {
+	if handler.gotenbergClient != nil || (email.HTML == nil && email.Text == nil) {
+		return false, nil
+	}
+
+	content, err := handler.nativeText(email, NewEmailHeader(email))
+	if err != nil {
+		return false, err
+	}
+	if pdf.Renderable(string(content)) {
+		return false, nil
+	}
+
+	log.Warn("email text can't be rendered without gotenberg, uploading as text")
+
+	filename := strings.TrimSuffix(handler.contentFilename(email), ".pdf") + ".txt"
+	return true, handler.upload(bytes.NewReader(content), filename, handler.Tags)
+}
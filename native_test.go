@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/textproto"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"<p>Hello</p><p>World</p>", "Hello\n\nWorld"},
+		{"<html><head><title>Ignored</title><style>p {}</style></head><body>Total: <b>5</b>&nbsp;USD</body></html>", "Total: 5 USD"},
+		{`<a href="https://example.com">Pay now</a>`, "Pay now (https://example.com)"},
+		{`<a href="https://example.com">https://example.com</a>`, "https://example.com"},
+		{"<pre>a\n  b</pre>", "a\n  b"},
+		{"a<br>b", "a\nb"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, HTMLToText([]byte(test.input)))
+	}
+}
+
+func TestRenderContentNative(t *testing.T) {
+	handler := EmailHandler{}
+
+	pdf, err := handler.RenderContent(&email.Email{HTML: []byte("<p>Receipt</p>"), Headers: textproto.MIMEHeader{}})
+	require.Nil(t, err, "email should render without gotenberg")
+	defer pdf.Close()
+
+	data, err := io.ReadAll(pdf)
+	require.Nil(t, err, "rendered pdf should be readable")
+	assert.Contains(t, string(data), "(Receipt) Tj")
+}
+
+func TestUploadContentNativeUnicode(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+	handler := EmailHandler{paperless: paperless}
+
+	e := &email.Email{Subject: "Счёт", Text: []byte("Счёт приложен"), Headers: textproto.MIMEHeader{}}
+	require.Nil(t, handler.UploadContent(e))
+	require.Len(t, *documents, 1)
+	assert.Equal(t, "Счёт.txt", (*documents)[0].Filename, "text that can't be rendered should be uploaded as text")
+	assert.Equal(t, "Счёт приложен", (*documents)[0].Contents)
+
+	*documents = nil
+	e = &email.Email{Subject: "Reçu", Text: []byte("Voilà le reçu"), Headers: textproto.MIMEHeader{}}
+	require.Nil(t, handler.UploadContent(e))
+	require.Len(t, *documents, 1)
+	assert.Equal(t, "Reçu.pdf", (*documents)[0].Filename)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+	"github.com/thecodingmachine/gotenberg-go-client/v7"
+)
+
+// DefaultOfficeTypes are the extensions and MIME types converted to PDF when
+// office conversion is enabled without a custom list.
+var DefaultOfficeTypes = []string{
+	".doc", ".docx", ".odt", ".rtf",
+	".xls", ".xlsx", ".ods",
+	".ppt", ".pptx", ".odp",
+	"application/msword",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.oasis.opendocument.text",
+	"application/vnd.ms-excel",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.oasis.opendocument.spreadsheet",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/vnd.oasis.opendocument.presentation",
+}
+
+// IsOfficeAttachment checks if an attachment matches any of the given types.
+// Types starting with a period are compared against the filename's extension,
+// all others are compared against the attachment's MIME type.
+func IsOfficeAttachment(attachment *email.Attachment, types []string) bool {
+	ext := filepath.Ext(attachment.Filename)
+
+	contentType := attachment.ContentType
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
+	for _, t := range types {
+		if strings.HasPrefix(t, ".") {
+			if strings.EqualFold(t, ext) {
+				return true
+			}
+		} else if strings.EqualFold(t, contentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PDFFilename replaces the extension of a filename with .pdf.
+func PDFFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".pdf"
+}
+
+// UploadOfficeAttachment converts an office document to a PDF with Gotenberg
+// and uploads the result, optionally uploading the original document as well.
+//
+// If conversion fails, the original document is uploaded instead.
+func (handler *EmailHandler) UploadOfficeAttachment(r io.Reader, filename string) error {
+	logCtx := log.WithField("filename", filename)
+	logCtx.Info("converting office attachment to pdf")
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	pdf, err := handler.convertOffice(data, filename)
+	if err != nil {
+		logCtx.Warnf("could not convert office attachment, uploading original: %s", err.Error())
+		return handler.upload(bytes.NewReader(data), filename, handler.Tags)
+	}
+	defer pdf.Close()
+
+	if err = handler.upload(pdf, PDFFilename(filename), handler.Tags); err != nil {
+		return err
+	}
+
+	if handler.KeepOriginal {
+		logCtx.Debug("uploading original office attachment")
+		if err = handler.upload(bytes.NewReader(data), filename, handler.Tags); err != nil {
+			return err
+		}
+	}
+
+	logCtx.Info("uploaded converted attachment")
+	return nil
+}
+
+// convertOffice sends an office document to Gotenberg, returning the PDF.
+func (handler *EmailHandler) convertOffice(data []byte, filename string) (io.ReadCloser, error) {
+	doc, err := gotenberg.NewDocumentFromBytes(filename, data)
+	if err != nil {
+		return nil, err
+	}
+
+	req := gotenberg.NewOfficeRequest(doc)
+	req.WaitTimeout(30)
+
+	return handler.postGotenberg(req)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsOfficeAttachment(t *testing.T) {
+	tests := []struct {
+		filename    string
+		contentType string
+		want        bool
+	}{
+		{"invoice.DOCX", "application/octet-stream", true},
+		{"invoice", "application/msword; name=invoice", true},
+		{"invoice.pdf", "application/pdf", false},
+	}
+
+	for _, test := range tests {
+		attachment := &email.Attachment{Filename: test.filename, ContentType: test.contentType}
+		assert.Equal(t, test.want, IsOfficeAttachment(attachment, DefaultOfficeTypes), test.filename)
+	}
+}
+
+func TestPDFFilename(t *testing.T) {
+	assert.Equal(t, "invoice.pdf", PDFFilename("invoice.docx"))
+	assert.Equal(t, "invoice.pdf", PDFFilename("invoice"))
+}
+
+func TestUploadOfficeAttachment(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	handler := EmailHandler{
+		OfficeTypes:     DefaultOfficeTypes,
+		KeepOriginal:    true,
+		paperless:       paperless,
+		gotenbergClient: newTestGotenberg(t),
+	}
+
+	err := handler.UploadOfficeAttachment(strings.NewReader("contents"), "invoice.docx")
+	require.Nil(t, err, "office attachment should upload")
+
+	require.Len(t, *documents, 2, "converted and original documents should be uploaded")
+	assert.Equal(t, "invoice.pdf", (*documents)[0].Filename)
+	assert.Equal(t, "/convert/office:invoice.docx", (*documents)[0].Contents)
+	assert.Equal(t, "invoice.docx", (*documents)[1].Filename)
+	assert.Equal(t, "contents", (*documents)[1].Contents)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Syfaro/paperless-mailhook/msg"
+	"github.com/Syfaro/paperless-mailhook/tnef"
+)
+
+// IsMsgAttachment checks if an attachment is an Outlook .msg file.
+func IsMsgAttachment(attachment *email.Attachment) bool {
+	if strings.EqualFold(path.Ext(attachment.Filename), ".msg") {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(attachment.ContentType)
+	return err == nil && mediaType == "application/vnd.ms-outlook"
+}
+
+// NewEmailFromMsg converts an Outlook message into an email so its body and
+// attachments can be processed like any other email.
+//
+// Messages attached to the message are converted to message/rfc822
+// attachments so they are also processed.
+func NewEmailFromMsg(message *msg.Message) (*email.Email, error) {
+	e := email.NewEmail()
+	e.Subject = message.Subject
+	e.From = message.From
+	e.To = message.To
+	e.Cc = message.Cc
+	e.Headers = msgHeaders(message)
+
+	if len(message.HTML) > 0 {
+		e.HTML = message.HTML
+	}
+
+	if len(message.Body) > 0 {
+		e.Text = message.Body
+	} else if e.HTML == nil && len(message.RTF) > 0 {
+		e.Text = []byte(tnef.RTFText(message.RTF))
+	}
+
+	for _, attachment := range message.Attachments {
+		if attachment.Message != nil {
+			embedded, err := NewEmailFromMsg(attachment.Message)
+			if err != nil {
+				return nil, err
+			}
+
+			contents, err := embedded.Bytes()
+			if err != nil {
+				return nil, err
+			}
+
+			e.Attachments = append(e.Attachments, &email.Attachment{
+				Filename:    ContentFilename(embedded),
+				ContentType: "message/rfc822",
+				Header:      textproto.MIMEHeader{},
+				Content:     contents,
+			})
+			continue
+		}
+
+		filename := attachment.Filename
+		if filename == "" {
+			filename = "attachment"
+		}
+
+		contentType := attachment.MIMEType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(path.Ext(filename))
+		}
+
+		e.Attachments = append(e.Attachments, &email.Attachment{
+			Filename:    filename,
+			ContentType: contentType,
+			Header:      textproto.MIMEHeader{},
+			Content:     attachment.Data,
+		})
+	}
+
+	return e, nil
+}
+
+// msgHeaders parses the original internet headers of a message. The headers
+// describing the original MIME structure are removed as the body has already
+// been decoded.
+func msgHeaders(message *msg.Message) textproto.MIMEHeader {
+	headers := textproto.MIMEHeader{}
+
+	if message.Headers != "" {
+		r := textproto.NewReader(bufio.NewReader(strings.NewReader(message.Headers + "\r\n\r\n")))
+		if parsed, err := r.ReadMIMEHeader(); err == nil || len(parsed) > 0 {
+			headers = parsed
+		}
+	}
+
+	for key := range headers {
+		if strings.HasPrefix(key, "Content-") || key == "Mime-Version" {
+			headers.Del(key)
+		}
+	}
+
+	if headers.Get("Date") == "" && !message.Date.IsZero() {
+		headers.Set("Date", message.Date.Format(time.RFC1123Z))
+	}
+
+	return headers
+}
+
+// UploadMsg parses an Outlook .msg attachment and processes its contents as a
+// new email. If the attachment was not actually a message, it is uploaded
+// as-is.
+func (handler *EmailHandler) UploadMsg(r io.Reader, filename string) error {
+	logCtx := log.WithField("filename", filename)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	message, err := msg.Parse(data)
+	if err != nil {
+		logCtx.WithError(err).Warn("attachment was described as outlook message but could not be parsed, uploading original")
+		return handler.upload(bytes.NewReader(data), handler.attachmentFilename(filename), handler.Tags)
+	}
+
+	e, err := NewEmailFromMsg(message)
+	if err != nil {
+		return err
+	}
+
+	logCtx.Infof("parsed outlook message with %d attachments", len(e.Attachments))
+	return handler.ProcessEmail(e)
+}
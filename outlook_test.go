@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/msg"
+)
+
+func TestIsMsgAttachment(t *testing.T) {
+	assert.True(t, IsMsgAttachment(&email.Attachment{Filename: "Invoice.MSG"}))
+	assert.True(t, IsMsgAttachment(&email.Attachment{Filename: "file", ContentType: "application/vnd.ms-outlook"}))
+	assert.False(t, IsMsgAttachment(&email.Attachment{Filename: "bill.doc", ContentType: "application/msword"}))
+}
+
+func TestNewEmailFromMsg(t *testing.T) {
+	message := &msg.Message{
+		Subject: "Fwd: Bill",
+		From:    "sender@example.com",
+		Date:    time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Headers: "Message-ID: <abc@example.com>\r\nContent-Type: application/ms-tnef\r\n",
+		Body:    []byte("See attached"),
+		Attachments: []*msg.Attachment{
+			{Filename: "bill.pdf", Data: []byte("pdf")},
+			{Message: &msg.Message{Subject: "Bill", Body: []byte("Total: 5")}},
+		},
+	}
+
+	e, err := NewEmailFromMsg(message)
+	require.Nil(t, err, "message should be converted")
+
+	assert.Equal(t, "Fwd: Bill", e.Subject)
+	assert.Equal(t, "sender@example.com", e.From)
+	assert.Equal(t, "<abc@example.com>", e.Headers.Get("Message-Id"), "transport headers should be kept")
+	assert.Empty(t, e.Headers.Get("Content-Type"), "mime headers should be removed")
+	assert.Equal(t, "Thu, 04 Mar 2021 05:06:07 +0000", e.Headers.Get("Date"), "date should be set from message")
+
+	require.Len(t, e.Attachments, 2)
+	assert.Equal(t, "application/pdf", e.Attachments[0].ContentType, "content type should be guessed from extension")
+	assert.Equal(t, "message/rfc822", e.Attachments[1].ContentType, "embedded message should become email")
+	assert.Equal(t, "Bill.pdf", e.Attachments[1].Filename)
+}
+
+func TestUploadMsg(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+	handler := EmailHandler{paperless: paperless, BodyPolicy: BodyAttachmentsOnly}
+
+	data, err := os.ReadFile("testdata/msg/test.msg")
+	require.Nil(t, err, "should be able to read fixture")
+
+	attachment := &email.Attachment{Filename: "test.msg", ContentType: "application/vnd.ms-outlook", Header: textproto.MIMEHeader{}, Content: data}
+	err = handler.UploadAttachment(attachment)
+	require.Nil(t, err, "outlook message should be processed")
+
+	require.Len(t, *documents, 2, "each attachment within message should be uploaded")
+	assert.Equal(t, "test.doc", (*documents)[0].Filename)
+	assert.Equal(t, "image001.gif", (*documents)[1].Filename)
+
+	*documents = nil
+	attachment.Content = []byte("not a message")
+	err = handler.UploadAttachment(attachment)
+	require.Nil(t, err, "invalid message should be uploaded as-is")
+	require.Len(t, *documents, 1)
+	assert.Equal(t, "test.msg", (*documents)[0].Filename)
+
+	*documents = nil
+	malformed := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(malformed[40:44], 0x40000000)
+	attachment.Content = malformed
+	err = handler.UploadAttachment(attachment)
+	require.Nil(t, err, "malformed message should be uploaded as-is")
+	require.Len(t, *documents, 1)
+	assert.Equal(t, string(malformed), (*documents)[0].Contents)
+}
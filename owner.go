@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+// taskTimeout is how long to wait for Paperless to consume a document before
+// giving up on setting its owner or recording it.
+const taskTimeout = 30 * time.Minute
+
+// pendingTasks tracks documents waiting for Paperless to consume them, so
+// commands can wait for them before exiting.
+var pendingTasks sync.WaitGroup
+
+// waitForTasks waits for pending tasks to finish, returning false if they
+// didn't finish within the timeout.
+func waitForTasks(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pendingTasks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// OwnerRule is the Paperless user that owns documents from a sender, and the
+// groups allowed to view or change them.
+type OwnerRule struct {
+	Owner  string
+	View   []string
+	Change []string
+}
+
+// OwnerRules are keyed by the sender's email address, their domain starting
+// with an @, or * for every sender.
+type OwnerRules map[string]OwnerRule
+
+// documentOwner is an OwnerRule resolved on a Paperless instance.
+type documentOwner struct {
+	owner       int
+	permissions paperless.Permissions
+}
+
+// LoadOwnerRules reads an owner file. Each line contains a sender and the
+// owner's username, optionally followed by view= and change= with comma
+// separated group names. Blank lines and lines starting with # are ignored.
+func LoadOwnerRules(name string) (OwnerRules, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := OwnerRules{}
+
+	scanner := bufio.NewScanner(f)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected sender and owner", number)
+		}
+
+		rule := OwnerRule{Owner: fields[1]}
+		for _, field := range fields[2:] {
+			switch {
+			case strings.HasPrefix(field, "view="):
+				rule.View = append(rule.View, splitGroups(field[len("view="):])...)
+			case strings.HasPrefix(field, "change="):
+				rule.Change = append(rule.Change, splitGroups(field[len("change="):])...)
+			default:
+				return nil, fmt.Errorf("line %d: unknown permission %q", number, field)
+			}
+		}
+
+		rules[strings.ToLower(fields[0])] = rule
+	}
+
+	return rules, scanner.Err()
+}
+
+// splitGroups splits a comma separated list of group names.
+func splitGroups(value string) []string {
+	var groups []string
+	for _, group := range strings.Split(value, ",") {
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// ResolveOwners looks up the users and groups of each rule on a Paperless
+// instance.
+func ResolveOwners(client *paperless.Paperless, rules OwnerRules) (map[string]documentOwner, error) {
+	users := map[string]int{}
+	groups := map[string]int{}
+
+	resolveGroups := func(names []string) ([]int, error) {
+		ids := make([]int, 0, len(names))
+		for _, name := range names {
+			id, ok := groups[name]
+			if !ok {
+				var err error
+				if id, err = client.ResolveGroup(name); err != nil {
+					return nil, fmt.Errorf("could not resolve group %s: %w", name, err)
+				}
+				groups[name] = id
+			}
+			ids = append(ids, id)
+		}
+
+		return ids, nil
+	}
+
+	owners := make(map[string]documentOwner, len(rules))
+	for sender, rule := range rules {
+		var owner documentOwner
+		var err error
+
+		var ok bool
+		if owner.owner, ok = users[rule.Owner]; !ok {
+			if owner.owner, err = client.ResolveUser(rule.Owner); err != nil {
+				return nil, fmt.Errorf("could not resolve user %s: %w", rule.Owner, err)
+			}
+			users[rule.Owner] = owner.owner
+		}
+
+		if owner.permissions.View.Groups, err = resolveGroups(rule.View); err != nil {
+			return nil, err
+		}
+		if owner.permissions.Change.Groups, err = resolveGroups(rule.Change); err != nil {
+			return nil, err
+		}
+
+		owners[sender] = owner
+	}
+
+	return owners, nil
+}
+
+// resolveOwners resolves the handler's owner rules on its Paperless instance.
+func (handler *EmailHandler) resolveOwners() error {
+	if len(handler.OwnerRules) == 0 {
+		return nil
+	}
+
+	owners, err := ResolveOwners(handler.paperless, handler.OwnerRules)
+	if err != nil {
+		return err
+	}
+	handler.owners = owners
+
+	return nil
+}
+
+// ownerFor returns the owner of documents from a sender, starting with the
+// most specific rule.
+func (handler *EmailHandler) ownerFor(sender string) (documentOwner, bool) {
+	for _, key := range append(senderKeys(sender), "*") {
+		if owner, ok := handler.owners[key]; ok {
+			return owner, true
+		}
+	}
+
+	return documentOwner{}, false
+}
+
+// currentOwner returns the owner of documents from the email being processed.
+// The envelope sender is used rather than the From header, which the sender
+// controls, so an allowed sender can't assign documents to someone else.
+func (handler *EmailHandler) currentOwner() (documentOwner, bool) {
+	if len(handler.owners) == 0 || handler.sender == "" {
+		return documentOwner{}, false
+	}
+
+	return handler.ownerFor(handler.sender)
+}
+
+// withSender returns a copy of the handler that assigns documents to the owner
+// for the envelope sender of the email.
+func (handler *EmailHandler) withSender(sender string) *EmailHandler {
+	h := *handler
+	h.sender = sender
+
+	return &h
+}
+
+// watchTask waits for the document created by a consumption task, recording
+// it in the message history and assigning it to the owner for the sender of
+// the email being processed. Paperless only creates the document once the task
+// completes, so this happens in the background.
+func (handler *EmailHandler) watchTask(filename, taskID string) {
+	document := handler.message.addDocument(filename, taskID)
+	owner, hasOwner := handler.currentOwner()
+	if document == nil && !hasOwner {
+		return
+	}
+
+	logCtx := log.WithFields(log.Fields{
+		"filename": filename,
+		"task":     taskID,
+	})
+
+	if taskID == "" {
+		if hasOwner {
+			logCtx.Warn("paperless did not return a task, could not set document owner")
+		}
+		return
+	}
+
+	client := handler.paperless
+	pendingTasks.Add(1)
+	go func() {
+		defer pendingTasks.Done()
+
+		documentID, err := client.WaitForTask(taskID, taskTimeout)
+		document.consumed(documentID, err)
+		if err != nil {
+			logCtx.Errorf("could not wait for document to be consumed: %s", err.Error())
+			return
+		}
+
+		if !hasOwner {
+			return
+		}
+
+		if err = client.SetOwner(documentID, owner.owner, owner.permissions); err != nil {
+			logCtx.Errorf("could not set document owner: %s", err.Error())
+			return
+		}
+
+		logCtx.WithField("document", documentID).Debug("set document owner")
+	}()
+}
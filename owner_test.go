@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+func TestLoadOwnerRules(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "owners")
+	contents := "# family\nAlice@example.com alice view=family,parents change=parents\n@bank.example bob\n\n* admin  view=family\n"
+	require.Nil(t, os.WriteFile(name, []byte(contents), 0600), "should be able to write owners")
+
+	rules, err := LoadOwnerRules(name)
+	require.Nil(t, err, "owners should load")
+
+	assert.Equal(t, OwnerRules{
+		"alice@example.com": {Owner: "alice", View: []string{"family", "parents"}, Change: []string{"parents"}},
+		"@bank.example":     {Owner: "bob"},
+		"*":                 {Owner: "admin", View: []string{"family"}},
+	}, rules)
+
+	require.Nil(t, os.WriteFile(name, []byte("alice@example.com alice edit=family\n"), 0600))
+	_, err = LoadOwnerRules(name)
+	assert.Error(t, err, "unknown permissions should fail to load")
+
+	require.Nil(t, os.WriteFile(name, []byte("alice@example.com\n"), 0600))
+	_, err = LoadOwnerRules(name)
+	assert.Error(t, err, "rules without an owner should fail to load")
+}
+
+func TestOwnerFor(t *testing.T) {
+	handler := &EmailHandler{owners: map[string]documentOwner{
+		"alice@example.com": {owner: 1},
+		"@example.com":      {owner: 2},
+		"*":                 {owner: 3},
+	}}
+
+	tests := []struct {
+		sender string
+		owner  int
+	}{
+		{"Alice <ALICE@example.com>", 1},
+		{"bob@example.com", 2},
+		{"someone@other.example", 3},
+	}
+
+	for _, test := range tests {
+		owner, ok := handler.ownerFor(test.sender)
+		assert.True(t, ok, test.sender)
+		assert.Equal(t, test.owner, owner.owner, test.sender)
+	}
+
+	delete(handler.owners, "*")
+	_, ok := handler.ownerFor("someone@other.example")
+	assert.False(t, ok, "senders without a rule should have no owner")
+}
+
+func TestProcessEmailSetsOwner(t *testing.T) {
+	patches := make(chan string, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/users/":
+			fmt.Fprint(w, `{"results": [{"id": 3}]}`)
+		case "/api/groups/":
+			fmt.Fprint(w, `{"results": [{"id": 4}]}`)
+		case "/api/documents/post_document/":
+			fmt.Fprint(w, `"task-1"`)
+		case "/api/tasks/":
+			assert.Equal(t, "task-1", req.URL.Query().Get("task_id"))
+			fmt.Fprint(w, `[{"status": "SUCCESS", "related_document": "12"}]`)
+		case "/api/documents/12/":
+			body, _ := io.ReadAll(req.Body)
+			patches <- string(body)
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	client := paperless.New(ts.URL, "apiKey", http.DefaultClient)
+	client.TaskPollInterval = time.Millisecond
+
+	handler := &EmailHandler{
+		AllowList:  AllowList{AllowedEmails: []string{"alice@example.com"}},
+		OwnerRules: OwnerRules{"alice@example.com": {Owner: "alice", View: []string{"family"}}},
+		paperless:  client,
+	}
+	require.Nil(t, handler.resolveOwners(), "owners should resolve")
+
+	e := &email.Email{
+		From:    "Alice <alice@example.com>",
+		Subject: "Payslip",
+		Headers: textproto.MIMEHeader{},
+		Attachments: []*email.Attachment{
+			{Filename: "payslip.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: []byte("pdf")},
+		},
+	}
+	require.Nil(t, handler.withSender("alice@example.com").ProcessEmail(e))
+
+	select {
+	case body := <-patches:
+		assert.JSONEq(t, `{"owner": 3, "set_permissions": {"view": {"users": [], "groups": [4]}, "change": {"users": [], "groups": []}}}`, body)
+	case <-time.After(time.Second):
+		t.Error("document owner was not set")
+	}
+
+	// The From header can be forged by any allowed sender.
+	handler.AllowList.AllowedEmails = append(handler.AllowList.AllowedEmails, "relay@example.com")
+	raw := []byte("From: Alice <alice@example.com>\r\nSubject: Payslip\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=payslip.pdf\r\n\r\npdf")
+	require.Nil(t, handler.receive(log.WithField("test", t.Name()), "relay@example.com", nil, raw, nil))
+	pendingTasks.Wait()
+
+	select {
+	case body := <-patches:
+		t.Errorf("owner should not be set from the From header: %s", body)
+	default:
+	}
+}
+
+func TestWaitForTasks(t *testing.T) {
+	assert.True(t, waitForTasks(time.Millisecond), "nothing should be pending")
+
+	pendingTasks.Add(1)
+	assert.False(t, waitForTasks(time.Millisecond), "pending tasks should time out")
+
+	pendingTasks.Done()
+	assert.True(t, waitForTasks(time.Second))
+}
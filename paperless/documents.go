@@ -0,0 +1,183 @@
+package paperless
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errBadUser  = errors.New("got incorrect number of users")
+	errBadGroup = errors.New("got incorrect number of groups")
+
+	// ErrTaskFailed is returned when Paperless could not consume a document.
+	ErrTaskFailed = errors.New("paperless could not consume document")
+	// ErrTaskTimeout is returned when a task didn't finish in time.
+	ErrTaskTimeout = errors.New("paperless did not finish consuming document in time")
+)
+
+// DefaultTaskPollInterval is how often the status of a task is checked.
+const DefaultTaskPollInterval = 2 * time.Second
+
+// Permissions are the users and groups allowed to view or change a document.
+type Permissions struct {
+	View   PermissionSet `json:"view"`
+	Change PermissionSet `json:"change"`
+}
+
+// PermissionSet contains user and group IDs.
+type PermissionSet struct {
+	Users  []int `json:"users"`
+	Groups []int `json:"groups"`
+}
+
+type task struct {
+	Status          string          `json:"status"`
+	Result          string          `json:"result"`
+	RelatedDocument json.RawMessage `json:"related_document"`
+}
+
+// WaitForTask polls a consumption task until it finishes, returning the ID of
+// the created document.
+func (paperless *Paperless) WaitForTask(taskID string, timeout time.Duration) (int, error) {
+	logCtx := log.WithField("task", taskID)
+
+	interval := paperless.TaskPollInterval
+	if interval == 0 {
+		interval = DefaultTaskPollInterval
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		t, err := paperless.getTask(taskID)
+		if err != nil {
+			return 0, err
+		}
+
+		if t != nil {
+			logCtx.Tracef("task status was %s", t.Status)
+
+			switch t.Status {
+			case "SUCCESS":
+				id, err := strconv.Atoi(strings.Trim(string(t.RelatedDocument), `"`))
+				if err != nil {
+					return 0, fmt.Errorf("task had invalid document id %s: %w", t.RelatedDocument, err)
+				}
+
+				return id, nil
+			case "FAILURE", "REVOKED":
+				return 0, fmt.Errorf("%w: %s", ErrTaskFailed, t.Result)
+			}
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return 0, ErrTaskTimeout
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// getTask fetches the status of a task, returning nil if it wasn't found yet.
+func (paperless *Paperless) getTask(taskID string) (*task, error) {
+	endpoint := fmt.Sprintf("%s/api/tasks/?task_id=%s", paperless.Endpoint, url.QueryEscape(taskID))
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := paperless.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &PaperlessError{
+			Message:    fmt.Sprintf("got bad paperless status code: %d", resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Body:       body,
+		}
+	}
+
+	var tasks []task
+	if err = json.NewDecoder(resp.Body).Decode(&tasks); err != nil {
+		return nil, err
+	}
+
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+
+	return &tasks[0], nil
+}
+
+type documentOwner struct {
+	Owner          int         `json:"owner"`
+	SetPermissions Permissions `json:"set_permissions"`
+}
+
+// SetOwner changes the owner of a document and replaces its permissions.
+func (paperless *Paperless) SetOwner(documentID, owner int, permissions Permissions) error {
+	logCtx := log.WithField("document", documentID)
+	logCtx.Debug("setting document owner")
+
+	// Paperless expects empty lists rather than null.
+	for _, set := range []*PermissionSet{&permissions.View, &permissions.Change} {
+		if set.Users == nil {
+			set.Users = []int{}
+		}
+		if set.Groups == nil {
+			set.Groups = []int{}
+		}
+	}
+
+	body, err := json.Marshal(documentOwner{owner, permissions})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/api/documents/%d/", paperless.Endpoint, documentID)
+	req, err := http.NewRequest(http.MethodPatch, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := paperless.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &PaperlessError{
+			Message:    fmt.Sprintf("got bad paperless status code: %d", resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Body:       body,
+		}
+	}
+
+	return nil
+}
+
+// ResolveUser attempts to resolve a username into a Paperless user ID.
+func (paperless *Paperless) ResolveUser(username string) (int, error) {
+	return paperless.resolve("users", "username", username, errBadUser)
+}
+
+// ResolveGroup attempts to resolve a group name into a Paperless group ID.
+func (paperless *Paperless) ResolveGroup(name string) (int, error) {
+	return paperless.resolve("groups", "name", name, errBadGroup)
+}
@@ -10,6 +10,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,11 +25,16 @@ type Paperless struct {
 	APIKey   string
 
 	Client HTTPClient
+
+	// TaskPollInterval is how often WaitForTask checks a task, defaulting to
+	// DefaultTaskPollInterval.
+	TaskPollInterval time.Duration
 }
 
 type PaperlessError struct {
-	Message string
-	Body    []byte
+	Message    string
+	StatusCode int
+	Body       []byte
 }
 
 func (err PaperlessError) Error() string {
@@ -64,9 +70,27 @@ func (c *httpClient) Do(req *http.Request) (*http.Response, error) {
 	return c.c.Do(req)
 }
 
+// DocumentMetadata is set on documents when they are uploaded. Zero values
+// are left for Paperless to determine.
+type DocumentMetadata struct {
+	Tags          []int
+	Title         string
+	Created       time.Time
+	Correspondent int
+}
+
 // UploadDocument uploads a document to the given Paperless instance with the
 // provided filename and tag IDs.
 func (paperless *Paperless) UploadDocument(r io.Reader, filename string, tags []int) error {
+	_, err := paperless.UploadDocumentWithMetadata(r, filename, DocumentMetadata{Tags: tags})
+	return err
+}
+
+// UploadDocumentWithMetadata uploads a document to the given Paperless
+// instance with the provided filename and metadata. It returns the ID of the
+// task consuming the document, which is empty for versions of Paperless that
+// don't report it.
+func (paperless *Paperless) UploadDocumentWithMetadata(r io.Reader, filename string, metadata DocumentMetadata) (string, error) {
 	logCtx := log.WithField("filename", filename)
 	logCtx.Debug("uploading file to paperless")
 
@@ -75,32 +99,50 @@ func (paperless *Paperless) UploadDocument(r io.Reader, filename string, tags []
 
 	fw, err := body.CreateFormFile("document", filename)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if _, err = io.Copy(fw, r); err != nil {
-		return err
+		return "", err
 	}
 
-	for _, tag := range tags {
+	for _, tag := range metadata.Tags {
 		if err = body.WriteField("tags", fmt.Sprint(tag)); err != nil {
-			return err
+			return "", err
+		}
+	}
+
+	if metadata.Title != "" {
+		if err = body.WriteField("title", metadata.Title); err != nil {
+			return "", err
+		}
+	}
+
+	if !metadata.Created.IsZero() {
+		if err = body.WriteField("created", metadata.Created.Format(time.RFC3339)); err != nil {
+			return "", err
+		}
+	}
+
+	if metadata.Correspondent != 0 {
+		if err = body.WriteField("correspondent", fmt.Sprint(metadata.Correspondent)); err != nil {
+			return "", err
 		}
 	}
 
 	if err = body.Close(); err != nil {
-		return err
+		return "", err
 	}
 
 	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/documents/post_document/", paperless.Endpoint), buf)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	req.Header.Add("Content-Type", body.FormDataContentType())
 
 	resp, err := paperless.Client.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 
@@ -110,16 +152,23 @@ func (paperless *Paperless) UploadDocument(r io.Reader, filename string, tags []
 			logCtx.Errorf("could not read paperless error response")
 		}
 
-		return &PaperlessError{
-			Message: fmt.Sprintf("got bad paperless status code: %d", resp.StatusCode),
-			Body:    body,
+		return "", &PaperlessError{
+			Message:    fmt.Sprintf("got bad paperless status code: %d", resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Body:       body,
 		}
 	}
 
-	return nil
+	// Paperless-ngx responds with the task ID, older versions with "OK".
+	var taskID string
+	if err = json.NewDecoder(resp.Body).Decode(&taskID); err != nil || taskID == "OK" {
+		return "", nil
+	}
+
+	return taskID, nil
 }
 
-type tagResults struct {
+type idResults struct {
 	Results []struct {
 		ID int `json:"id"`
 	} `json:"results"`
@@ -127,32 +176,74 @@ type tagResults struct {
 
 // ResolveTag attempts to resolve a tag name into a Paperless tag ID.
 func (paperless *Paperless) ResolveTag(tag string) (int, error) {
-	logCtx := log.WithField("tag", tag)
-	logCtx.Debug("looking up tag")
+	return paperless.resolve("tags", "name", tag, errBadTag)
+}
 
-	endpoint := fmt.Sprintf("%s/api/tags/?name__iexact=%s", paperless.Endpoint, url.QueryEscape(tag))
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+// FindCorrespondent looks up a correspondent by name, returning 0 if there was
+// no correspondent with that name.
+func (paperless *Paperless) FindCorrespondent(name string) (int, error) {
+	ids, err := paperless.find("correspondents", "name", name)
+	if err != nil || len(ids) != 1 {
+		return 0, err
+	}
+
+	return ids[0], nil
+}
+
+// resolve looks up the ID of the only object with a field matching value,
+// returning errBad if there wasn't exactly one.
+func (paperless *Paperless) resolve(objects, field, value string, errBad error) (int, error) {
+	ids, err := paperless.find(objects, field, value)
 	if err != nil {
 		return -1, err
 	}
 
+	if len(ids) != 1 {
+		return -1, errBad
+	}
+
+	return ids[0], nil
+}
+
+// find looks up the IDs of objects with a field matching value, ignoring
+// case.
+func (paperless *Paperless) find(objects, field, value string) ([]int, error) {
+	logCtx := log.WithFields(log.Fields{"objects": objects, field: value})
+	logCtx.Debugf("looking up %s", objects)
+
+	endpoint := fmt.Sprintf("%s/api/%s/?%s__iexact=%s", paperless.Endpoint, objects, field, url.QueryEscape(value))
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	resp, err := paperless.Client.Do(req)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var results tagResults
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &PaperlessError{
+			Message:    fmt.Sprintf("got bad paperless status code: %d", resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Body:       body,
+		}
+	}
+
+	var results idResults
 	decoder := json.NewDecoder(resp.Body)
 	if err = decoder.Decode(&results); err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	if len(results.Results) != 1 {
-		return -1, errBadTag
+	ids := make([]int, 0, len(results.Results))
+	for _, result := range results.Results {
+		ids = append(ids, result.ID)
 	}
 
-	logCtx.Tracef("resolved tag to ID %d", results.Results[0].ID)
+	logCtx.Tracef("found %s with IDs %v", objects, ids)
 
-	return results.Results[0].ID, nil
+	return ids, nil
 }
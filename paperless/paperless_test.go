@@ -130,3 +130,153 @@ func TestUploadDocument(t *testing.T) {
 	err := paperless.UploadDocument(r, DocumentFilename, DocumentTags)
 	assert.Nil(t, err, "document should upload without errors")
 }
+
+func TestUploadDocumentWithMetadata(t *testing.T) {
+	created := time.Date(2021, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := req.ParseMultipartForm(1024 * 1024 * 10)
+		require.Nil(t, err, "must not have error parsing sent multipart form")
+
+		assert.Equal(t, []string{"Invoice"}, req.MultipartForm.Value["title"], "title should be sent")
+		assert.Equal(t, []string{"2021-03-02T10:00:00Z"}, req.MultipartForm.Value["created"], "created date should be sent")
+		assert.Equal(t, []string{"5"}, req.MultipartForm.Value["correspondent"], "correspondent should be sent")
+		assert.Equal(t, []string{"1"}, req.MultipartForm.Value["tags"], "tags should be sent")
+
+		fmt.Fprint(w, `"b3e5a6c1-task"`)
+	}))
+	defer ts.Close()
+
+	paperless := New(ts.URL, APIKeyValue, http.DefaultClient)
+
+	metadata := DocumentMetadata{Tags: []int{1}, Title: "Invoice", Created: created, Correspondent: 5}
+	taskID, err := paperless.UploadDocumentWithMetadata(strings.NewReader(DocumentContents), DocumentFilename, metadata)
+	assert.Nil(t, err, "document should upload without errors")
+	assert.Equal(t, "b3e5a6c1-task", taskID, "task id should be returned")
+}
+
+func TestUploadDocumentWithoutMetadata(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := req.ParseMultipartForm(1024 * 1024 * 10)
+		require.Nil(t, err, "must not have error parsing sent multipart form")
+
+		for _, field := range []string{"title", "created", "correspondent"} {
+			assert.NotContains(t, req.MultipartForm.Value, field, "unset metadata should not be sent")
+		}
+	}))
+	defer ts.Close()
+
+	paperless := New(ts.URL, APIKeyValue, http.DefaultClient)
+
+	err := paperless.UploadDocument(strings.NewReader(DocumentContents), DocumentFilename, nil)
+	assert.Nil(t, err, "document should upload without errors")
+}
+
+func TestFindCorrespondent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/api/correspondents/", req.URL.Path, "correspondents should use correct url")
+
+		switch req.URL.Query().Get("name__iexact") {
+		case "Example Bank":
+			fmt.Fprint(w, `{"results": [{"id": 7}]}`)
+		default:
+			fmt.Fprint(w, `{"results": []}`)
+		}
+	}))
+	defer ts.Close()
+
+	paperless := New(ts.URL, APIKeyValue, http.DefaultClient)
+
+	id, err := paperless.FindCorrespondent("Example Bank")
+	assert.Nil(t, err, "existing correspondent should not have error")
+	assert.Equal(t, 7, id, "correspondent should have expected id")
+
+	id, err = paperless.FindCorrespondent("Unknown")
+	assert.Nil(t, err, "missing correspondent should not have error")
+	assert.Equal(t, 0, id, "missing correspondent should not have an id")
+}
+
+func TestWaitForTask(t *testing.T) {
+	polls := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/api/tasks/", req.URL.Path, "tasks should use correct url")
+
+		switch req.URL.Query().Get("task_id") {
+		case "pending":
+			polls++
+			if polls < 3 {
+				fmt.Fprint(w, `[{"status": "STARTED", "related_document": null}]`)
+			} else {
+				fmt.Fprint(w, `[{"status": "SUCCESS", "related_document": "12"}]`)
+			}
+		case "failed":
+			fmt.Fprint(w, `[{"status": "FAILURE", "result": "duplicate document"}]`)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	defer ts.Close()
+
+	paperless := New(ts.URL, APIKeyValue, http.DefaultClient)
+	paperless.TaskPollInterval = time.Millisecond
+
+	id, err := paperless.WaitForTask("pending", time.Second)
+	assert.Nil(t, err, "finished task should not have error")
+	assert.Equal(t, 12, id, "document id should be returned")
+	assert.Equal(t, 3, polls, "task should be polled until finished")
+
+	_, err = paperless.WaitForTask("failed", time.Second)
+	assert.ErrorIs(t, err, ErrTaskFailed, "failed task should return error")
+
+	_, err = paperless.WaitForTask("missing", 10*time.Millisecond)
+	assert.Equal(t, ErrTaskTimeout, err, "unfinished task should time out")
+}
+
+func TestSetOwner(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPatch, req.Method, "owner should be set with patch")
+		assert.Equal(t, "/api/documents/12/", req.URL.Path, "owner should use correct url")
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(req.Body)
+		require.Nil(t, err)
+		assert.JSONEq(t, `{"owner": 3, "set_permissions": {"view": {"users": [], "groups": [4, 5]}, "change": {"users": [], "groups": []}}}`, string(body))
+	}))
+	defer ts.Close()
+
+	paperless := New(ts.URL, APIKeyValue, http.DefaultClient)
+
+	err := paperless.SetOwner(12, 3, Permissions{View: PermissionSet{Groups: []int{4, 5}}})
+	assert.Nil(t, err, "owner should be set without errors")
+}
+
+func TestResolveUserAndGroup(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/users/":
+			assert.Equal(t, "alice", req.URL.Query().Get("username__iexact"))
+			fmt.Fprint(w, `{"results": [{"id": 3}]}`)
+		case "/api/groups/":
+			if req.URL.Query().Get("name__iexact") == "family" {
+				fmt.Fprint(w, `{"results": [{"id": 4}]}`)
+			} else {
+				fmt.Fprint(w, `{"results": []}`)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	paperless := New(ts.URL, APIKeyValue, http.DefaultClient)
+
+	id, err := paperless.ResolveUser("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, id, "user id should be resolved")
+
+	id, err = paperless.ResolveGroup("family")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, id, "group id should be resolved")
+
+	_, err = paperless.ResolveGroup("missing")
+	assert.Equal(t, errBadGroup, err, "missing group should return error")
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxMIMEDepth is how deeply multipart parts may be nested within an email.
+const maxMIMEDepth = 16
+
+var errNotEncoded = errors.New("content was not encoded as described")
+
+// uuencodeBegin matches the first line of a uuencoded file, capturing its name.
+var uuencodeBegin = regexp.MustCompile(`(?m)^begin [0-7]{3,4} ([^\r\n]+)\r?\n`)
+
+// uuencodeEnd matches the last line of a uuencoded file.
+var uuencodeEnd = regexp.MustCompile(`(?m)^end\r?$`)
+
+// htmlMetaCharset matches meta tags declaring the charset of an HTML document,
+// capturing the charset.
+var htmlMetaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([\w.:-]+)[^>]*>`)
+
+// headerDecoder decodes RFC 2047 encoded words in any charset known to
+// browsers, not only UTF-8 and ISO-8859-1.
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// ParseEmail parses a raw email. Unlike email.NewEmailFromReader, bodies are
+// converted to UTF-8, attachments are stored decoded, filenames in any charset
+// are decoded and malformed parts are tolerated wherever possible.
+func ParseEmail(r io.Reader) (*email.Email, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header, body := splitMessage(bytes.TrimLeft(raw, " \t\r\n"))
+	parsed, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &email.Email{
+		Subject: decodeHeader(parsed.Get("Subject")),
+		From:    decodeHeader(parsed.Get("From")),
+		To:      decodeAddressList(parsed["To"]),
+		Cc:      decodeAddressList(parsed["Cc"]),
+		Bcc:     decodeAddressList(parsed["Bcc"]),
+		ReplyTo: decodeAddressList(parsed["Reply-To"]),
+		Headers: parsed,
+	}
+
+	for _, name := range []string{"Subject", "From", "To", "Cc", "Bcc", "Reply-To"} {
+		parsed.Del(name)
+	}
+
+	parsePart(e, parsed, body, "text/plain", 0)
+
+	// Bodies are always converted to UTF-8, so the declared charset must
+	// match.
+	if mediaType, params, err := mime.ParseMediaType(parsed.Get("Content-Type")); err == nil && strings.HasPrefix(mediaType, "text/") {
+		params["charset"] = "utf-8"
+		parsed.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+
+	return e, nil
+}
+
+// parsePart adds a MIME part to an email, either as a body, attachment, or by
+// adding each of its own parts.
+func parsePart(e *email.Email, header textproto.MIMEHeader, body []byte, defaultType string, depth int) {
+	mediaType, params := partMediaType(header.Get("Content-Type"), defaultType)
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth {
+			log.Warnf("skipping parts nested more than %d deep", maxMIMEDepth)
+			return
+		}
+
+		parts := multipartParts(body, params["boundary"])
+		if params["boundary"] != "" && len(parts) > 0 {
+			childType := "text/plain"
+			if mediaType == "multipart/digest" {
+				childType = "message/rfc822"
+			}
+
+			for _, part := range parts {
+				partHeader, partBody := splitMessage(part)
+				parsed, err := parseHeader(partHeader)
+				if err != nil {
+					log.Warnf("skipping part with invalid header: %s", err.Error())
+					continue
+				}
+
+				parsePart(e, parsed, partBody, childType, depth+1)
+			}
+
+			return
+		}
+
+		// Without any parts, the body is the best remaining guess at content.
+		mediaType = "text/plain"
+	}
+
+	content, err := DecodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		log.Warnf("could not decode part as %s, using it as-is: %s", header.Get("Content-Transfer-Encoding"), err.Error())
+		content = body
+	}
+
+	disposition, _ := partMediaType(header.Get("Content-Disposition"), "")
+	filename := partFilename(header)
+
+	if disposition != "attachment" && filename == "" {
+		switch mediaType {
+		case "text/plain":
+			text, files := extractUUEncoded(DecodeCharset(content, params["charset"]))
+			e.Text = appendText(e.Text, text)
+			e.Attachments = append(e.Attachments, files...)
+			return
+		case "text/html":
+			if e.HTML == nil {
+				e.HTML = decodeHTML(content, params["charset"])
+			}
+			return
+		}
+	}
+
+	if filename == "" {
+		filename = defaultFilename(mediaType)
+	}
+
+	// Content is already decoded, so it must not be decoded again when read.
+	attachmentHeader := textproto.MIMEHeader{}
+	for name, values := range header {
+		attachmentHeader[name] = values
+	}
+	attachmentHeader.Del("Content-Transfer-Encoding")
+
+	_, _ = e.AttachWithHeaders(bytes.NewReader(content), filename, mediaType, attachmentHeader)
+}
+
+// partMediaType parses a Content-Type or Content-Disposition header, returning
+// the lowercase value and any parameters. Invalid parameters are ignored
+// rather than discarding the entire value.
+func partMediaType(value, defaultType string) (string, map[string]string) {
+	if strings.TrimSpace(value) == "" {
+		return defaultType, map[string]string{}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err == nil {
+		return mediaType, params
+	}
+
+	mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+	if mediaType == "" {
+		mediaType = defaultType
+	}
+
+	params = map[string]string{}
+	for _, name := range []string{"charset", "boundary"} {
+		if param := headerParam(value, name); param != "" {
+			params[name] = param
+		}
+	}
+
+	return mediaType, params
+}
+
+// partFilename returns the decoded filename of a part from its
+// Content-Disposition or Content-Type header.
+func partFilename(header textproto.MIMEHeader) string {
+	filename := headerParam(header.Get("Content-Disposition"), "filename")
+	if filename == "" {
+		filename = headerParam(header.Get("Content-Type"), "name")
+	}
+
+	return cleanFilename(filename)
+}
+
+// defaultFilename names an attachment that was sent without a filename.
+func defaultFilename(mediaType string) string {
+	if mediaType == "message/rfc822" {
+		return "message.eml"
+	}
+
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return "attachment" + exts[0]
+	}
+
+	return "attachment"
+}
+
+// cleanFilename removes any directories and control characters from a
+// filename.
+func cleanFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+
+	filename = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, filename)
+
+	filename = strings.TrimSpace(filename)
+	if filename == "." || filename == ".." {
+		return ""
+	}
+
+	return filename
+}
+
+// paramPatterns match parameters in header values, including parameters split
+// into numbered sections or encoded as described in RFC 2231. They capture the
+// section number, whether the section was encoded, and its value.
+var paramPatterns = map[string]*regexp.Regexp{
+	"filename": newParamPattern("filename"),
+	"name":     newParamPattern("name"),
+	"charset":  newParamPattern("charset"),
+	"boundary": newParamPattern("boundary"),
+}
+
+func newParamPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(?:^|;)\s*` + name + `(\*(\d+)?(\*)?)?\s*=\s*("(?:[^"\\]|\\.)*"|[^;]*)`)
+}
+
+// headerParam extracts a parameter from a header value. RFC 2231 sections and
+// charsets are supported, as are RFC 2047 encoded words which many clients
+// use within quoted parameters.
+func headerParam(value, name string) string {
+	type section struct {
+		index   int
+		encoded bool
+		value   string
+	}
+
+	var plain string
+	var sections []section
+	for _, match := range paramPatterns[name].FindAllStringSubmatch(value, -1) {
+		param := strings.TrimSpace(match[4])
+		if strings.HasPrefix(param, `"`) {
+			param = unquote(param)
+		}
+
+		if match[1] == "" {
+			plain = param
+			continue
+		}
+
+		index, _ := strconv.Atoi(match[2])
+		sections = append(sections, section{
+			index: index,
+			// name*=value is encoded without being split into sections.
+			encoded: match[2] == "" || match[3] != "",
+			value:   param,
+		})
+	}
+
+	// Clients may send both forms, in which case RFC 2231 is preferred.
+	if len(sections) == 0 {
+		return decodeHeader(plain)
+	}
+
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sections[i].index < sections[j].index
+	})
+
+	var charset string
+	var decoded []byte
+	for i, s := range sections {
+		if !s.encoded {
+			decoded = append(decoded, s.value...)
+			continue
+		}
+
+		param := s.value
+		if i == 0 {
+			if fields := strings.SplitN(param, "'", 3); len(fields) == 3 {
+				charset, param = fields[0], fields[2]
+			}
+		}
+
+		decoded = append(decoded, percentDecode(param)...)
+	}
+
+	return string(DecodeCharset(decoded, charset))
+}
+
+// unquote removes the quotes and escapes from a quoted string.
+func unquote(value string) string {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+
+	return b.String()
+}
+
+// percentDecode decodes %XX escapes, leaving invalid escapes unchanged.
+func percentDecode(value string) []byte {
+	decoded := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == '%' && i+2 < len(value) {
+			if b, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				decoded = append(decoded, byte(b))
+				i += 2
+				continue
+			}
+		}
+		decoded = append(decoded, value[i])
+	}
+
+	return decoded
+}
+
+// decodeHeader decodes RFC 2047 encoded words in a header, converting any
+// unencoded 8-bit text to UTF-8.
+func decodeHeader(value string) string {
+	value = string(DecodeCharset([]byte(value), ""))
+
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+// addressParser parses address lists with encoded words in any charset.
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+// addressQuoter escapes a display name within a quoted string.
+var addressQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// decodeAddressList decodes each address in address headers. Headers that
+// can't be parsed as address lists are kept whole.
+func decodeAddressList(values []string) []string {
+	var addresses []string
+	for _, value := range values {
+		value = strings.TrimSpace(string(DecodeCharset([]byte(value), "")))
+		if value == "" {
+			continue
+		}
+
+		list, err := addressParser.ParseList(value)
+		if err != nil {
+			addresses = append(addresses, decodeHeader(value))
+			continue
+		}
+
+		for _, address := range list {
+			addresses = append(addresses, formatAddress(address))
+		}
+	}
+
+	return addresses
+}
+
+// formatAddress formats an address with its decoded display name, quoting the
+// name only if it contains special characters. Unlike mail.Address.String, the
+// name isn't encoded again.
+func formatAddress(address *mail.Address) string {
+	if address.Name == "" {
+		return address.Address
+	}
+
+	name := address.Name
+	if strings.ContainsAny(name, `()<>[]:;@\,."`) {
+		name = `"` + addressQuoter.Replace(name) + `"`
+	}
+
+	return name + " <" + address.Address + ">"
+}
+
+// decodeHTML converts an HTML body to UTF-8, updating the declared charset to
+// match. The charset in a meta tag is used if the part didn't declare one.
+func decodeHTML(content []byte, charset string) []byte {
+	if charset == "" {
+		if match := htmlMetaCharset.FindSubmatch(content); match != nil {
+			charset = string(match[1])
+		}
+	}
+
+	decoded := DecodeCharset(content, charset)
+
+	meta := []byte(`<meta charset="utf-8">`)
+	if htmlMetaCharset.Match(decoded) {
+		return htmlMetaCharset.ReplaceAllLiteral(decoded, meta)
+	}
+
+	return append(meta, decoded...)
+}
+
+// appendText adds another plain text part to the text body.
+func appendText(text, part []byte) []byte {
+	if text == nil {
+		return part
+	}
+
+	text = append(text, '\n')
+	return append(text, part...)
+}
+
+// DecodeTransferEncoding decodes content with a Content-Transfer-Encoding.
+// Base64 may be wrapped at any length or be missing padding. Content that
+// wasn't encoded as described returns errNotEncoded.
+func DecodeTransferEncoding(encoding string, content []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return decodeBase64(content)
+	case "quoted-printable":
+		if !IsQuotedPrintable(content) {
+			return nil, errNotEncoded
+		}
+
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+	case "x-uuencode", "uuencode", "x-uue":
+		return uudecode(content)
+	default:
+		return content, nil
+	}
+}
+
+// decodeBase64 decodes base64 ignoring whitespace and missing padding.
+func decodeBase64(content []byte) ([]byte, error) {
+	cleaned := make([]byte, 0, len(content))
+	for _, b := range content {
+		switch {
+		case b == ' ' || b == '\t' || b == '\r' || b == '\n':
+		case isBase64Byte(b) || b == '=':
+			cleaned = append(cleaned, b)
+		default:
+			return nil, errNotEncoded
+		}
+	}
+
+	trimmed := bytes.TrimRight(cleaned, "=")
+	if bytes.IndexByte(trimmed, '=') >= 0 || len(trimmed)%4 == 1 {
+		return nil, errNotEncoded
+	}
+
+	return base64.RawStdEncoding.DecodeString(string(trimmed))
+}
+
+// isBase64Byte checks if a byte is in the standard base64 alphabet.
+func isBase64Byte(b byte) bool {
+	return b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/'
+}
+
+// uudecode decodes uuencoded content, with or without the begin and end
+// lines.
+func uudecode(content []byte) ([]byte, error) {
+	if loc := uuencodeBegin.FindIndex(content); loc != nil {
+		content = content[loc[1]:]
+	}
+
+	var decoded []byte
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if string(line) == "end" {
+			break
+		}
+
+		n := int((line[0] - ' ') & 0x3f)
+		if n == 0 {
+			continue
+		}
+
+		chars := line[1:]
+		if len(chars) < (n*4+2)/3 {
+			return nil, errNotEncoded
+		}
+
+		var group [4]byte
+		for i := 0; n > 0; i += 4 {
+			for j := range group {
+				group[j] = 0
+				if i+j < len(chars) {
+					group[j] = (chars[i+j] - ' ') & 0x3f
+				}
+			}
+
+			out := []byte{
+				group[0]<<2 | group[1]>>4,
+				group[1]<<4 | group[2]>>2,
+				group[2]<<6 | group[3],
+			}
+			if n < 3 {
+				out = out[:n]
+			}
+
+			decoded = append(decoded, out...)
+			n -= len(out)
+		}
+	}
+
+	return decoded, nil
+}
+
+// extractUUEncoded removes uuencoded files from a text body, returning them as
+// attachments.
+func extractUUEncoded(text []byte) ([]byte, []*email.Attachment) {
+	var attachments []*email.Attachment
+
+	for {
+		begin := uuencodeBegin.FindSubmatchIndex(text)
+		if begin == nil {
+			return text, attachments
+		}
+
+		end := uuencodeEnd.FindIndex(text[begin[1]:])
+		if end == nil {
+			return text, attachments
+		}
+		blockEnd := begin[1] + end[1]
+
+		content, err := uudecode(text[begin[0]:blockEnd])
+		if err != nil {
+			log.Warnf("could not decode uuencoded file: %s", err.Error())
+			return text, attachments
+		}
+
+		filename := cleanFilename(string(text[begin[2]:begin[3]]))
+		contentType := "application/octet-stream"
+		if ext := strings.LastIndex(filename, "."); ext >= 0 {
+			if byExt, _ := partMediaType(mime.TypeByExtension(filename[ext:]), ""); byExt != "" {
+				contentType = byExt
+			}
+		}
+
+		attachments = append(attachments, &email.Attachment{
+			Filename:    filename,
+			ContentType: contentType,
+			Header:      textproto.MIMEHeader{},
+			Content:     content,
+		})
+
+		remaining := append([]byte{}, text[:begin[0]]...)
+		text = append(remaining, bytes.TrimLeft(text[blockEnd:], "\r\n")...)
+	}
+}
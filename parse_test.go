@@ -0,0 +1,278 @@
+package main
+
+import (
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPDF is the document attached to the fixtures in testdata/mime.
+var testPDF = "%PDF-1.4\n% test document\n%%EOF\n"
+
+func TestParseEmail(t *testing.T) {
+	type attachment struct {
+		filename    string
+		contentType string
+		content     string
+	}
+
+	tests := []struct {
+		filename    string
+		from        string
+		to          []string
+		subject     string
+		text        string
+		html        []string
+		attachments []attachment
+	}{
+		{
+			filename: "latin1-qp.eml",
+			from:     "José <jose@example.com>",
+			to:       []string{"Paperless <paperless@example.com>"},
+			subject:  "Café reçu",
+			text:     "Voilà le reçu du café.\r\n",
+		},
+		{
+			filename: "windows1252-8bit.eml",
+			from:     "sender@example.com",
+			subject:  "Invoice € 100",
+			text:     "Total: €100 – paid\r\n",
+		},
+		{
+			filename: "shift-jis.eml",
+			from:     "sender@example.jp",
+			subject:  "請求書",
+			text:     "お支払いありがとうございます",
+		},
+		{
+			filename: "koi8r-alternative.eml",
+			from:     "sender@example.ru",
+			subject:  "Счёт",
+			text:     "Счёт приложен",
+			html:     []string{`<meta charset="utf-8">`, "<p>Счёт приложен</p>"},
+		},
+		{
+			filename:    "rfc2231-continuation.eml",
+			subject:     "Continuation",
+			text:        "See attached.",
+			attachments: []attachment{{"Rechnung für März 2021.pdf", "application/pdf", testPDF}},
+		},
+		{
+			filename:    "rfc2231-latin1.eml",
+			attachments: []attachment{{"résumé.pdf", "application/pdf", testPDF}},
+		},
+		{
+			filename: "rfc2047-filenames.eml",
+			attachments: []attachment{
+				{"見積書.pdf", "application/pdf", testPDF},
+				{"€ invoice–final.pdf", "application/octet-stream", testPDF},
+			},
+		},
+		{
+			filename:    "base64-wrapped.eml",
+			attachments: []attachment{{"wrapped.pdf", "application/pdf", testPDF}},
+		},
+		{
+			filename: "no-disposition.eml",
+			attachments: []attachment{
+				{"scan 001.pdf", "application/pdf", testPDF},
+				{"attachment.png", "image/png", "PNGDATA"},
+			},
+		},
+		{
+			filename:    "uuencode-inline.eml",
+			text:        "Here is the document.\r\n\r\nRegards\r\n",
+			attachments: []attachment{{"old.pdf", "application/pdf", testPDF}},
+		},
+		{
+			filename:    "uuencode-part.eml",
+			attachments: []attachment{{"part.pdf", "application/pdf", testPDF}},
+		},
+		{
+			filename:    "single-part.eml",
+			attachments: []attachment{{"scan.pdf", "application/pdf", testPDF}},
+		},
+		{
+			filename: "nested.eml",
+			from:     "sender@example.com",
+			to:       []string{"a@example.com", "Béa <b@example.com>"},
+			subject:  "Nested",
+			text:     "Grüße",
+			html:     []string{`<meta charset="utf-8">`, "Grüße"},
+			attachments: []attachment{
+				{"logo.png", "image/png", "PNGDATA"},
+				{"message.eml", "message/rfc822", "From: inner@example.com\r\nSubject: Inner\r\n\r\nInner body"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			f, err := os.Open("testdata/mime/" + test.filename)
+			require.NoError(t, err)
+			defer f.Close()
+
+			e, err := ParseEmail(f)
+			require.NoError(t, err)
+
+			if test.from != "" {
+				assert.Equal(t, test.from, e.From)
+			}
+			if test.to != nil {
+				assert.Equal(t, test.to, e.To)
+			}
+			if test.subject != "" {
+				assert.Equal(t, test.subject, e.Subject)
+			}
+			if test.text != "" {
+				assert.Equal(t, test.text, string(e.Text))
+			}
+			for _, html := range test.html {
+				assert.Contains(t, string(e.HTML), html)
+			}
+
+			require.Len(t, e.Attachments, len(test.attachments))
+			for i, expected := range test.attachments {
+				attachment := e.Attachments[i]
+				assert.Equal(t, expected.filename, attachment.Filename)
+				assert.Equal(t, expected.contentType, attachment.ContentType)
+
+				data, err := io.ReadAll(NewAttachmentReader(attachment))
+				require.NoError(t, err)
+				assert.Equal(t, expected.content, string(data))
+			}
+		})
+	}
+}
+
+func TestParseEmailCharsetHeader(t *testing.T) {
+	f, err := os.Open("testdata/mime/latin1-qp.eml")
+	require.NoError(t, err)
+	defer f.Close()
+
+	e, err := ParseEmail(f)
+	require.NoError(t, err)
+
+	assert.Equal(t, "utf-8", TextCharset(e.Headers.Get("Content-Type")))
+	assert.Empty(t, e.Headers.Get("Subject"), "decoded headers should be removed")
+}
+
+func TestDecodeAddressList(t *testing.T) {
+	addresses := decodeAddressList([]string{
+		`"Doe, Jane" <jane@example.com>, paperless@example.com`,
+		"=?UTF-8?Q?J=C3=BCrgen_M=C3=BCller?= <juergen@example.com>",
+		"Undisclosed recipients:;",
+		"not an address, at all",
+	})
+
+	assert.Equal(t, []string{
+		`"Doe, Jane" <jane@example.com>`,
+		"paperless@example.com",
+		"Jürgen Müller <juergen@example.com>",
+		"not an address, at all",
+	}, addresses)
+
+	for _, address := range addresses[:3] {
+		_, err := mail.ParseAddress(address)
+		assert.NoError(t, err, "decoded addresses should parse again")
+	}
+}
+
+func TestHeaderParam(t *testing.T) {
+	tests := []struct {
+		value    string
+		name     string
+		expected string
+	}{
+		{`attachment; filename="report.pdf"`, "filename", "report.pdf"},
+		{`attachment; filename=report.pdf`, "filename", "report.pdf"},
+		{`attachment; filename="a \"quoted\" name.pdf"`, "filename", `a "quoted" name.pdf`},
+		{`attachment; filename*=UTF-8''%E2%82%AC.pdf`, "filename", "€.pdf"},
+		{`attachment; filename*=windows-1252''%80.pdf`, "filename", "€.pdf"},
+		{`attachment; filename*0="long "; filename*1="name.pdf"`, "filename", "long name.pdf"},
+		{`attachment; filename*1*=%C3%A9.pdf; filename*0*=utf-8''caf`, "filename", "café.pdf"},
+		{`attachment; filename="fallback.pdf"; filename*=utf-8''preferred.pdf`, "filename", "preferred.pdf"},
+		{`attachment; filename="=?utf-8?B?w6ku?= pdf"`, "filename", "é. pdf"},
+		{`attachment; filename*=utf-8''100%.pdf`, "filename", "100%.pdf"},
+		{`application/pdf; filename=x.pdf`, "name", ""},
+		{`attachment`, "filename", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, headerParam(test.value, test.name), test.value)
+	}
+}
+
+func TestCleanFilename(t *testing.T) {
+	assert.Equal(t, "report.pdf", cleanFilename(`C:\Users\me\report.pdf`))
+	assert.Equal(t, "report.pdf", cleanFilename("../../report.pdf"))
+	assert.Equal(t, "report.pdf", cleanFilename(" report\x00.pdf "))
+	assert.Equal(t, "", cleanFilename(".."))
+}
+
+func TestDecodeTransferEncoding(t *testing.T) {
+	tests := []struct {
+		encoding string
+		content  string
+		expected string
+		err      bool
+	}{
+		{"base64", "dGVzdA==", "test", false},
+		{"Base64", " dGVz\r\ndA==\r\n", "test", false},
+		{"BASE64", "dGVzdA", "test", false},
+		{"base64", "dGVzdA=", "test", false},
+		{"base64", "test%", "", true},
+		{"base64", "dG=VzdA", "", true},
+		{"base64", "dGVzd", "", true},
+		{"quoted-printable", "caf=C3=A9=\r\n!", "café!", false},
+		{"Quoted-Printable", "=", "", true},
+		{"x-uuencode", "begin 644 test\n$=&5S=`\n`\nend\n", "test", false},
+		{"7bit", "test", "test", false},
+		{"binary", "\x00\xff", "\x00\xff", false},
+		{"", "test", "test", false},
+	}
+
+	for _, test := range tests {
+		data, err := DecodeTransferEncoding(test.encoding, []byte(test.content))
+		if test.err {
+			assert.Error(t, err, test.content)
+			continue
+		}
+
+		require.NoError(t, err, test.content)
+		assert.Equal(t, test.expected, string(data), test.content)
+	}
+}
+
+func TestExtractUUEncoded(t *testing.T) {
+	text, attachments := extractUUEncoded([]byte("before\nbegin 644 a.txt\n#86)C\n`\nend\nbetween\nbegin 644 b.bin\n!80``\n`\nend\nafter"))
+
+	assert.Equal(t, "before\nbetween\nafter", string(text))
+	require.Len(t, attachments, 2)
+	assert.Equal(t, "a.txt", attachments[0].Filename)
+	assert.Equal(t, "abc", string(attachments[0].Content))
+	assert.Equal(t, "b.bin", attachments[1].Filename)
+	assert.Equal(t, "application/octet-stream", attachments[1].ContentType)
+	assert.Equal(t, "a", string(attachments[1].Content))
+
+	unterminated := []byte("begin 644 a.txt\n#86)C\n")
+	text, attachments = extractUUEncoded(unterminated)
+	assert.Equal(t, unterminated, text)
+	assert.Empty(t, attachments)
+}
+
+func TestNewAttachmentReaderDecoded(t *testing.T) {
+	// Attachments parsed by ParseEmail no longer describe their original
+	// encoding, so they must not be decoded again.
+	attachment := &email.Attachment{Filename: "test", Content: []byte("dGVzdA=="), Header: textproto.MIMEHeader{}}
+
+	data, err := io.ReadAll(NewAttachmentReader(attachment))
+	require.NoError(t, err)
+	assert.Equal(t, "dGVzdA==", string(data))
+}
@@ -0,0 +1,177 @@
+// Package pdf generates simple text-only PDF documents without needing any
+// external services.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Page layout for an A4 page using 10pt Courier.
+const (
+	pageWidth  = 595
+	pageHeight = 842
+	margin     = 50
+	fontSize   = 10
+	leading    = 12
+
+	// Courier glyphs are 600 units wide, or 6pt at a 10pt font size.
+	lineWidth    = (pageWidth - 2*margin) * 1000 / (fontSize * 600)
+	linesPerPage = (pageHeight - 2*margin) / leading
+)
+
+// Renderable checks if every character in the text can be drawn with the
+// WinAnsi encoded font Render uses. Control characters are ignored.
+func Renderable(text string) bool {
+	encoder := charmap.Windows1252.NewEncoder()
+	for _, r := range text {
+		if unicode.IsControl(r) {
+			continue
+		}
+		if _, err := encoder.String(string(r)); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Render creates a PDF document containing the given text, wrapping long
+// lines and splitting it across as many pages as needed. Characters that
+// aren't Renderable are replaced.
+func Render(text string) []byte {
+	lines := wrap(text, lineWidth)
+
+	var pages [][]string
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	w := &writer{}
+	w.buf.WriteString("%PDF-1.4\n")
+
+	// Objects 1 through 3 are the catalog, page tree, and font. Each page then
+	// takes two objects, the page itself and its content stream.
+	kids := make([]string, 0, len(pages))
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+i*2))
+	}
+
+	w.object("<< /Type /Catalog /Pages 2 0 R >>")
+	w.object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	w.object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range pages {
+		w.object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 5+i*2))
+
+		content := pageContent(page)
+		w.object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	w.finish()
+
+	return w.buf.Bytes()
+}
+
+// writer tracks object offsets while building a PDF.
+type writer struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+// object writes the next numbered object.
+func (w *writer) object(contents string) {
+	w.offsets = append(w.offsets, w.buf.Len())
+	fmt.Fprintf(&w.buf, "%d 0 obj\n%s\nendobj\n", len(w.offsets), contents)
+}
+
+// finish writes the cross-reference table and trailer.
+func (w *writer) finish() {
+	xref := w.buf.Len()
+
+	fmt.Fprintf(&w.buf, "xref\n0 %d\n", len(w.offsets)+1)
+	w.buf.WriteString("0000000000 65535 f \n")
+	for _, offset := range w.offsets {
+		fmt.Fprintf(&w.buf, "%010d 00000 n \n", offset)
+	}
+
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(w.offsets)+1, xref)
+}
+
+// pageContent creates the content stream drawing lines of text.
+func pageContent(lines []string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", fontSize, leading, margin, pageHeight-margin-fontSize)
+	for _, line := range lines {
+		fmt.Fprintf(&b, "(%s) Tj T*\n", escape(line))
+	}
+	b.WriteString("ET")
+
+	return b.String()
+}
+
+// escape encodes a line as WinAnsi and escapes characters with special
+// meaning in PDF strings. Characters that can't be represented are replaced.
+func escape(line string) string {
+	encoder := charmap.Windows1252.NewEncoder()
+
+	var b strings.Builder
+	for _, r := range line {
+		encoded, err := encoder.Bytes([]byte(string(r)))
+		if err != nil || unicode.IsControl(r) {
+			encoded = []byte("?")
+		}
+
+		for _, c := range encoded {
+			switch c {
+			case '(', ')', '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			default:
+				if c < 0x20 || c > 0x7e {
+					fmt.Fprintf(&b, "\\%03o", c)
+				} else {
+					b.WriteByte(c)
+				}
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// wrap splits text into lines no longer than width characters, breaking on
+// spaces where possible.
+func wrap(text string, width int) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\t", "    ")
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		runes := []rune(strings.TrimRightFunc(line, unicode.IsSpace))
+
+		for len(runes) > width {
+			split := width
+			for i := width; i > 0; i-- {
+				if runes[i] == ' ' {
+					split = i
+					break
+				}
+			}
+
+			lines = append(lines, string(runes[:split]))
+			runes = []rune(strings.TrimLeft(string(runes[split:]), " "))
+		}
+
+		lines = append(lines, string(runes))
+	}
+
+	return lines
+}
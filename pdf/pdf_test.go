@@ -0,0 +1,66 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		input    string
+		width    int
+		expected []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"one two three", 8, []string{"one two", "three"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"a\r\n\tb  ", 10, []string{"a", "    b"}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, wrap(test.input, test.width))
+	}
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `\(a\\b\)`, escape(`(a\b)`))
+	assert.Equal(t, `caf\351 \200`, escape("café €"))
+	assert.Equal(t, "?", escape("✓"))
+}
+
+func TestRenderable(t *testing.T) {
+	assert.True(t, Renderable("Café €5\r\n\tpaid"))
+	assert.False(t, Renderable("Счёт приложен"))
+	assert.False(t, Renderable("Λογαριασμός"))
+	assert.False(t, Renderable("請求書"))
+}
+
+func TestRender(t *testing.T) {
+	text := strings.Repeat("line\n", linesPerPage+1)
+	doc := Render(text)
+
+	assert.True(t, bytes.HasPrefix(doc, []byte("%PDF-1.4\n")), "document should start with header")
+	assert.True(t, bytes.HasSuffix(doc, []byte("%%EOF\n")), "document should end with trailer")
+	assert.Contains(t, string(doc), "/Count 2", "long text should span two pages")
+
+	// Every object offset in the cross-reference table must point at the
+	// start of that object.
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(doc)
+	require.NotNil(t, startxref, "document should have startxref")
+	xref, _ := strconv.Atoi(string(startxref[1]))
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(doc[xref:], -1)
+	require.Len(t, entries, 7, "catalog, pages, font, and two objects per page")
+
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		assert.True(t, bytes.HasPrefix(doc[offset:], []byte(fmt.Sprintf("%d 0 obj", i+1))), "object %d offset should be correct", i+1)
+	}
+}
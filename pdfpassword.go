@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	log "github.com/sirupsen/logrus"
+)
+
+var errPDFPassword = errors.New("pdf could not be decrypted with any password")
+
+func init() {
+	// pdfcpu otherwise writes a configuration directory to the user's home.
+	api.DisableConfigDir()
+}
+
+// PDFPasswords are passwords tried on encrypted PDF attachments. They are keyed
+// by the sender's email address, their domain starting with an @, or * for
+// every sender.
+type PDFPasswords map[string][]string
+
+// LoadPDFPasswords reads a password file. Each line contains a sender followed
+// by a space and the password. Blank lines and lines starting with # are
+// ignored.
+func LoadPDFPasswords(name string) (PDFPasswords, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	passwords := PDFPasswords{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		sender := strings.ToLower(fields[0])
+		passwords[sender] = append(passwords[sender], fields[1])
+	}
+
+	return passwords, scanner.Err()
+}
+
+// For returns the passwords that may be used for PDFs from any of the
+// senders, starting with the most specific.
+func (passwords PDFPasswords) For(senders []string) []string {
+	var matched []string
+	seen := map[string]bool{}
+
+	add := func(key string) {
+		for _, password := range passwords[key] {
+			if !seen[password] {
+				seen[password] = true
+				matched = append(matched, password)
+			}
+		}
+	}
+
+	for _, sender := range senders {
+		for _, key := range senderKeys(sender) {
+			add(key)
+		}
+	}
+	add("*")
+
+	return matched
+}
+
+// senderKeys returns the keys used to look up settings for a sender: their
+// lowercased address followed by their domain starting with an @.
+func senderKeys(sender string) []string {
+	address := strings.ToLower(sender)
+	if parsed, err := mail.ParseAddress(sender); err == nil {
+		address = strings.ToLower(parsed.Address)
+	}
+
+	keys := []string{address}
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		keys = append(keys, address[at:])
+	}
+
+	return keys
+}
+
+// IsEncryptedPDF checks if a PDF has an encryption dictionary.
+func IsEncryptedPDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("%PDF")) && bytes.Contains(data, []byte("/Encrypt"))
+}
+
+// DecryptPDF removes encryption from a PDF, trying an empty password before
+// each of the passwords.
+func DecryptPDF(data []byte, passwords []string) ([]byte, error) {
+	for _, password := range append([]string{""}, passwords...) {
+		conf := pdfcpu.NewDefaultConfiguration()
+		conf.Cmd = pdfcpu.DECRYPT
+		conf.ValidationMode = pdfcpu.ValidationRelaxed
+		conf.UserPW = password
+		conf.OwnerPW = password
+
+		var buf bytes.Buffer
+		if err := api.Optimize(bytes.NewReader(data), &buf, conf); err != nil {
+			continue
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return nil, errPDFPassword
+}
+
+// unlocksPDFs checks if encrypted PDF attachments should be decrypted.
+func (handler *EmailHandler) unlocksPDFs() bool {
+	return len(handler.PDFPasswords) > 0 || handler.PDFLockedTag != 0
+}
+
+// unlockPDF decrypts a PDF if it was encrypted, returning false if it could
+// not be decrypted.
+func (handler *EmailHandler) unlockPDF(data []byte, filename string) ([]byte, bool) {
+	if !IsEncryptedPDF(data) {
+		return data, true
+	}
+
+	logCtx := log.WithField("filename", filename)
+
+	var senders []string
+	if handler.processing != nil {
+		senders = handler.processing.senders()
+	}
+
+	decrypted, err := DecryptPDF(data, handler.PDFPasswords.For(senders))
+	if err != nil {
+		logCtx.Warn("could not decrypt pdf")
+		return data, false
+	}
+
+	logCtx.Info("decrypted pdf")
+	return decrypted, true
+}
+
+// UploadPDF uploads a PDF attachment, decrypting it if needed. PDFs that can't
+// be decrypted are uploaded as-is with the locked tag.
+func (handler *EmailHandler) UploadPDF(r io.Reader, filename string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	data, ok := handler.unlockPDF(data, filename)
+	if ok {
+		return handler.upload(bytes.NewReader(data), filename, handler.Tags)
+	}
+
+	return handler.upload(bytes.NewReader(data), filename, handler.lockedTags())
+}
+
+// lockedTags returns the tags for documents that could not be decrypted.
+func (handler *EmailHandler) lockedTags() []int {
+	if handler.PDFLockedTag == 0 {
+		return handler.Tags
+	}
+
+	tags := make([]int, 0, len(handler.Tags)+1)
+	tags = append(tags, handler.Tags...)
+	return append(tags, handler.PDFLockedTag)
+}
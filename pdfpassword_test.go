@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/pdf"
+)
+
+// encryptedPDF creates a PDF encrypted with a user password.
+func encryptedPDF(t *testing.T, password string) []byte {
+	conf := pdfcpu.NewAESConfiguration(password, "owner-"+password, 256)
+	conf.Cmd = pdfcpu.ENCRYPT
+	conf.ValidationMode = pdfcpu.ValidationRelaxed
+
+	var buf bytes.Buffer
+	err := api.Optimize(bytes.NewReader(pdf.Render("Payslip")), &buf, conf)
+	require.Nil(t, err, "should be able to encrypt pdf")
+
+	return buf.Bytes()
+}
+
+func TestLoadPDFPasswords(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "passwords")
+	contents := "# payslips\npayroll@example.com 1990-01-01\n@bank.example secret with spaces\n\n* fallback\n"
+	require.Nil(t, os.WriteFile(name, []byte(contents), 0600), "should be able to write passwords")
+
+	passwords, err := LoadPDFPasswords(name)
+	require.Nil(t, err, "passwords should load")
+
+	assert.Equal(t, []string{"1990-01-01", "fallback"}, passwords.For([]string{"Payroll <PAYROLL@example.com>"}))
+	assert.Equal(t, []string{"secret with spaces", "fallback"}, passwords.For([]string{"statements@bank.example"}))
+	assert.Equal(t, []string{"1990-01-01", "secret with spaces", "fallback"}, passwords.For([]string{"payroll@example.com", "statements@bank.example"}))
+	assert.Equal(t, []string{"fallback"}, passwords.For(nil))
+}
+
+func TestDecryptPDF(t *testing.T) {
+	data := encryptedPDF(t, "1990-01-01")
+	assert.True(t, IsEncryptedPDF(data))
+	assert.False(t, IsEncryptedPDF(pdf.Render("Payslip")))
+
+	_, err := DecryptPDF(data, []string{"wrong"})
+	assert.Equal(t, errPDFPassword, err)
+
+	decrypted, err := DecryptPDF(data, []string{"wrong", "1990-01-01"})
+	require.Nil(t, err, "pdf should be decrypted with correct password")
+	assert.False(t, IsEncryptedPDF(decrypted))
+}
+
+func TestUploadPDF(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+	handler := EmailHandler{
+		paperless:    paperless,
+		Tags:         []int{1},
+		PDFPasswords: PDFPasswords{"payroll@example.com": {"1990-01-01"}},
+		PDFLockedTag: 9,
+	}
+
+	e := email.NewEmail()
+	e.From = "Payroll <payroll@example.com>"
+	e.Attachments = []*email.Attachment{{Filename: "payslip.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: encryptedPDF(t, "1990-01-01")}}
+	handler.BodyPolicy = BodyAttachmentsOnly
+
+	require.Nil(t, handler.ProcessEmail(e), "email should be processed")
+	require.Len(t, *documents, 1)
+	assert.False(t, strings.Contains((*documents)[0].Contents, "/Encrypt"), "decrypted pdf should be uploaded")
+	assert.Equal(t, []string{"1"}, (*documents)[0].Tags)
+
+	*documents = nil
+	e.From = "someone@example.com"
+	require.Nil(t, handler.ProcessEmail(e), "email should be processed")
+	require.Len(t, *documents, 1)
+	assert.True(t, strings.Contains((*documents)[0].Contents, "/Encrypt"), "original pdf should be uploaded")
+	assert.Equal(t, []string{"1", "9"}, (*documents)[0].Tags, "locked pdf should be tagged")
+}
+
+func TestUploadPDFUnconfigured(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+
+	// Handlers are always created with an empty set of passwords.
+	handler := EmailHandler{paperless: paperless, PDFPasswords: PDFPasswords{}}
+	assert.False(t, handler.unlocksPDFs())
+
+	for _, password := range []string{"1990-01-01", ""} {
+		*documents = nil
+		content := encryptedPDF(t, password)
+
+		attachment := &email.Attachment{Filename: "payslip.pdf", ContentType: "application/pdf", Header: textproto.MIMEHeader{}, Content: content}
+		require.Nil(t, handler.UploadAttachment(attachment))
+		require.Len(t, *documents, 1)
+		assert.Equal(t, string(content), (*documents)[0].Contents, "pdf should be uploaded unchanged")
+	}
+}
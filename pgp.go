@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPGPLayers is how many layers of encryption and signatures are removed
+// from a message.
+const maxPGPLayers = 4
+
+// pgpArmorMessage starts every ASCII armored PGP message.
+var pgpArmorMessage = []byte("-----BEGIN PGP MESSAGE-----")
+
+// pgpSignedMessage starts every cleartext signed PGP message.
+var pgpSignedMessage = []byte("-----BEGIN PGP SIGNED MESSAGE-----")
+
+// pgpExtensions are file extensions used for encrypted attachments.
+var pgpExtensions = []string{".pgp", ".gpg"}
+
+// errPGPKeyring is returned when PGP is enabled without any keys.
+var errPGPKeyring = errors.New("pgp keyring was empty")
+
+// PGP decrypts and verifies OpenPGP messages before they are processed.
+type PGP struct {
+	// Keyring contains the private keys used to decrypt messages and the
+	// public keys of senders used to verify signatures.
+	Keyring openpgp.EntityList
+
+	// RequireSignature rejects emails without a valid signature from the
+	// sender.
+	RequireSignature bool
+}
+
+// LoadPGP reads armored or binary keyrings, decrypting any private keys with
+// the passphrase.
+func LoadPGP(keyringFiles []string, passphrase string) (*PGP, error) {
+	pgp := &PGP{}
+
+	for _, name := range keyringFiles {
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var keyring openpgp.EntityList
+		if bytes.Contains(contents, []byte("-----BEGIN PGP")) {
+			keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(contents))
+		} else {
+			keyring, err = openpgp.ReadKeyRing(bytes.NewReader(contents))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read keyring %s: %w", name, err)
+		}
+
+		pgp.Keyring = append(pgp.Keyring, keyring...)
+	}
+
+	if len(pgp.Keyring) == 0 {
+		return nil, errPGPKeyring
+	}
+
+	for _, entity := range pgp.Keyring {
+		if err := decryptEntity(entity, []byte(passphrase)); err != nil {
+			return nil, err
+		}
+	}
+
+	return pgp, nil
+}
+
+// decryptEntity decrypts the private key and subkeys of an entity so they are
+// ready to decrypt messages.
+func decryptEntity(entity *openpgp.Entity, passphrase []byte) error {
+	if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+			return fmt.Errorf("could not decrypt private key %s: %w", entity.PrimaryKey.KeyIdString(), err)
+		}
+	}
+
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return fmt.Errorf("could not decrypt private subkey %s: %w", subkey.PublicKey.KeyIdString(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Unwrap decrypts a PGP/MIME message and removes any signatures, returning the
+// resulting message and the signer if the signature was valid.
+//
+// Messages without PGP/MIME content are returned unchanged. Invalid
+// signatures are logged but do not prevent processing.
+func (pgp *PGP) Unwrap(raw []byte) ([]byte, *openpgp.Entity, error) {
+	var signer *openpgp.Entity
+
+	for i := 0; i < maxPGPLayers; i++ {
+		header, body := splitMessage(raw)
+		parsed, err := parseHeader(header)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		mediaType, params, err := mime.ParseMediaType(parsed.Get("Content-Type"))
+		if err != nil {
+			return raw, signer, nil
+		}
+		protocol := strings.ToLower(params["protocol"])
+
+		var entity []byte
+		switch {
+		case mediaType == "multipart/encrypted" && protocol == "application/pgp-encrypted":
+			parts := multipartParts(body, params["boundary"])
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("encrypted message had %d parts, expected 2", len(parts))
+			}
+
+			_, ciphertext := splitMessage(parts[1])
+
+			var entitySigner *openpgp.Entity
+			if entity, entitySigner, err = pgp.decrypt(ciphertext); err != nil {
+				return nil, nil, err
+			}
+			if entitySigner != nil {
+				signer = entitySigner
+			}
+		case mediaType == "multipart/signed" && protocol == "application/pgp-signature":
+			parts := multipartParts(body, params["boundary"])
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("signed message had %d parts, expected 2", len(parts))
+			}
+
+			entity = parts[0]
+			if entitySigner := pgp.verify(parts[0], parts[1]); entitySigner != nil {
+				signer = entitySigner
+			}
+		default:
+			return raw, signer, nil
+		}
+
+		raw = replaceContent(raw, entity)
+	}
+
+	return raw, signer, nil
+}
+
+// decrypt decrypts an armored or binary PGP message, returning the signer if
+// it was signed with a known key.
+func (pgp *PGP) decrypt(ciphertext []byte) ([]byte, *openpgp.Entity, error) {
+	contents, details, err := pgp.read(ciphertext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A signature claiming to be from a known key is only reported as invalid
+	// once the body has been read.
+	if details.IsSigned && details.SignatureError != nil {
+		log.Warnf("pgp signature was not valid: %s", details.SignatureError.Error())
+		return contents, nil, nil
+	}
+
+	if details.IsSigned && details.SignedBy != nil {
+		return contents, details.SignedBy.Entity, nil
+	}
+
+	return contents, nil, nil
+}
+
+// read decrypts a PGP message, consuming the entire body so the signature is
+// checked.
+func (pgp *PGP) read(ciphertext []byte) ([]byte, *openpgp.MessageDetails, error) {
+	var r io.Reader = bytes.NewReader(ciphertext)
+	if start := bytes.Index(ciphertext, pgpArmorMessage); start >= 0 {
+		block, err := armor.Decode(bytes.NewReader(ciphertext[start:]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not decode pgp armor: %w", err)
+		}
+		r = block.Body
+	}
+
+	details, err := openpgp.ReadMessage(r, pgp.Keyring, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not decrypt pgp message: %w", err)
+	}
+
+	// Invalid signatures and integrity checks are only reported once the body
+	// has been read.
+	contents, err := io.ReadAll(details.UnverifiedBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not decrypt pgp message: %w", err)
+	}
+
+	return contents, details, nil
+}
+
+// verify checks a detached signature, returning the signer if it was valid.
+func (pgp *PGP) verify(signed, signaturePart []byte) *openpgp.Entity {
+	_, signature := splitMessage(signaturePart)
+
+	// Signatures are created over the canonical form of the part, but line
+	// endings may have been changed in transit.
+	for _, content := range [][]byte{signed, canonicalLineEndings(signed)} {
+		signer, err := openpgp.CheckArmoredDetachedSignature(pgp.Keyring, bytes.NewReader(content), bytes.NewReader(signature), nil)
+		if err == nil {
+			return signer
+		}
+
+		log.Debugf("pgp signature was not valid: %s", err.Error())
+	}
+
+	return nil
+}
+
+// IsPGPAttachment checks if an attachment is an encrypted PGP message based on
+// its extension or contents. Armored files are checked by contents as the
+// same extension is used for keys and signatures.
+func IsPGPAttachment(attachment *email.Attachment) bool {
+	ext := strings.ToLower(path.Ext(attachment.Filename))
+	for _, pgpExt := range pgpExtensions {
+		if ext == pgpExt {
+			return true
+		}
+	}
+
+	return bytes.Contains(attachment.Content, pgpArmorMessage)
+}
+
+// DecryptInline decrypts inline PGP attachments and bodies, replacing them
+// with their decrypted contents, and removes cleartext signatures from bodies.
+// Anything that can't be decrypted is left as-is.
+//
+// The signer of the body is returned if its signature was valid and the email
+// has no attachments or HTML body, as the signature doesn't cover them.
+func (pgp *PGP) DecryptInline(e *email.Email) *openpgp.Entity {
+	signer := pgp.decryptBody(e)
+
+	for _, attachment := range e.Attachments {
+		if !IsPGPAttachment(attachment) {
+			continue
+		}
+
+		logCtx := log.WithField("filename", attachment.Filename)
+
+		data, err := io.ReadAll(NewAttachmentReader(attachment))
+		if err != nil {
+			logCtx.Warnf("could not read pgp attachment: %s", err.Error())
+			continue
+		}
+
+		contents, details, err := pgp.read(data)
+		if err != nil {
+			logCtx.Warnf("could not decrypt pgp attachment: %s", err.Error())
+			continue
+		}
+
+		filename := strings.TrimSuffix(attachment.Filename, path.Ext(attachment.Filename))
+		if details.LiteralData != nil && details.LiteralData.FileName != "" && details.LiteralData.FileName != "_CONSOLE" {
+			filename = path.Base(details.LiteralData.FileName)
+		}
+
+		logCtx.Infof("decrypted pgp attachment as %s", filename)
+
+		attachment.Filename = filename
+		attachment.ContentType = mime.TypeByExtension(path.Ext(filename))
+		attachment.Header = textproto.MIMEHeader{}
+		attachment.Content = contents
+	}
+
+	if len(e.Attachments) > 0 || len(e.HTML) > 0 {
+		return nil
+	}
+
+	return signer
+}
+
+// decryptBody decrypts an inline PGP body or removes its cleartext signature,
+// returning the signer if the signature was valid. Text outside of a
+// cleartext signed message isn't signed, so it is removed.
+func (pgp *PGP) decryptBody(e *email.Email) *openpgp.Entity {
+	switch {
+	case bytes.Contains(e.Text, pgpArmorMessage):
+		contents, details, err := pgp.read(e.Text)
+		if err != nil {
+			log.Warnf("could not decrypt inline pgp body: %s", err.Error())
+			return nil
+		}
+
+		e.Text = contents
+		if details.IsSigned && details.SignatureError == nil && details.SignedBy != nil {
+			return details.SignedBy.Entity
+		}
+	case bytes.Contains(e.Text, pgpSignedMessage):
+		block, _ := clearsign.Decode(e.Text)
+		if block == nil {
+			log.Warn("could not decode inline pgp signed body")
+			return nil
+		}
+
+		e.Text = block.Plaintext
+		signer, err := block.VerifySignature(pgp.Keyring, nil)
+		if err != nil {
+			log.Warnf("pgp signature was not valid: %s", err.Error())
+			return nil
+		}
+
+		return signer
+	}
+
+	return nil
+}
+
+// PGPSignedBy checks if an entity has an identity with an email address.
+func PGPSignedBy(entity *openpgp.Entity, address string) bool {
+	if entity == nil {
+		return false
+	}
+
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && strings.EqualFold(identity.UserId.Email, address) {
+			return true
+		}
+	}
+
+	return false
+}
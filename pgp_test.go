@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPGP creates a keyring with a private key for the mailhook and a
+// sender's key, returning both entities.
+func newTestPGP(t *testing.T) (*PGP, *openpgp.Entity, *openpgp.Entity) {
+	config := &packet.Config{RSABits: 1024}
+
+	mailhook, err := openpgp.NewEntity("Mailhook", "", "mailhook@example.com", config)
+	require.Nil(t, err, "should be able to create mailhook key")
+	sender, err := openpgp.NewEntity("Sender", "", "sender@example.com", config)
+	require.Nil(t, err, "should be able to create sender key")
+
+	// Keys created by the library don't list any preferred hashes, which
+	// prevents encrypting to them.
+	for _, entity := range []*openpgp.Entity{mailhook, sender} {
+		for _, identity := range entity.Identities {
+			identity.SelfSignature.PreferredHash = []uint8{8}
+		}
+	}
+
+	return &PGP{Keyring: openpgp.EntityList{mailhook, sender}}, mailhook, sender
+}
+
+// encryptPGP encrypts and armors data for the recipient.
+func encryptPGP(t *testing.T, data string, to, signer *openpgp.Entity, filename string) string {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	require.Nil(t, err, "should be able to create armor")
+
+	plaintext, err := openpgp.Encrypt(w, []*openpgp.Entity{to}, signer, &openpgp.FileHints{FileName: filename}, nil)
+	require.Nil(t, err, "should be able to encrypt")
+	_, err = plaintext.Write([]byte(data))
+	require.Nil(t, err, "should be able to write plaintext")
+	require.Nil(t, plaintext.Close(), "should be able to finish encryption")
+	require.Nil(t, w.Close(), "should be able to finish armor")
+
+	return buf.String()
+}
+
+func TestPGPDecrypt(t *testing.T) {
+	pgp, mailhook, sender := newTestPGP(t)
+
+	ciphertext := encryptPGP(t, "Content-Type: text/plain\r\n\r\nStatement total: 5\r\n", mailhook, sender, "")
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"enc\"\r\n" +
+		"\r\n" +
+		"--enc\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n" +
+		"--enc\r\n" +
+		"Content-Type: application/octet-stream; name=encrypted.asc\r\n\r\n" + ciphertext + "\r\n" +
+		"--enc--\r\n"
+
+	unwrapped, signer, err := pgp.Unwrap([]byte(raw))
+	require.Nil(t, err, "encrypted email should be unwrapped")
+	assert.True(t, PGPSignedBy(signer, "sender@example.com"), "signer should be returned")
+
+	e, err := email.NewEmailFromReader(bytes.NewReader(unwrapped))
+	require.Nil(t, err, "decrypted email should parse")
+	assert.Equal(t, "Statement", e.Subject, "outer headers should be kept")
+	assert.Equal(t, "Statement total: 5\r\n", string(e.Text), "body should be decrypted")
+}
+
+func TestPGPDecryptTamperedSignature(t *testing.T) {
+	pgp, mailhook, sender := newTestPGP(t)
+	pgp.RequireSignature = true
+	handler := EmailHandler{PGP: pgp}
+
+	var signed bytes.Buffer
+	w, err := openpgp.Sign(&signed, sender, nil, nil)
+	require.Nil(t, err, "should be able to sign")
+	_, err = w.Write([]byte("Content-Type: text/plain\r\n\r\nStatement total: 5\r\n"))
+	require.Nil(t, err, "should be able to write signed message")
+	require.Nil(t, w.Close(), "should be able to finish signing")
+
+	// Corrupt the end of the signature, keeping the key ID of the sender.
+	tampered := signed.Bytes()
+	tampered[len(tampered)-1] ^= 0xff
+
+	var ciphertext bytes.Buffer
+	armored, err := armor.Encode(&ciphertext, "PGP MESSAGE", nil)
+	require.Nil(t, err, "should be able to create armor")
+
+	key := make([]byte, packet.CipherAES128.KeySize())
+	require.NotEmpty(t, mailhook.Subkeys, "mailhook should have an encryption key")
+	require.Nil(t, packet.SerializeEncryptedKey(armored, mailhook.Subkeys[0].PublicKey, packet.CipherAES128, key, nil), "should be able to write session key")
+
+	encrypted, err := packet.SerializeSymmetricallyEncrypted(armored, packet.CipherAES128, key, nil)
+	require.Nil(t, err, "should be able to encrypt")
+	_, err = encrypted.Write(tampered)
+	require.Nil(t, err, "should be able to write encrypted message")
+	require.Nil(t, encrypted.Close(), "should be able to finish encryption")
+	require.Nil(t, armored.Close(), "should be able to finish armor")
+
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"enc\"\r\n" +
+		"\r\n" +
+		"--enc\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n\r\nVersion: 1\r\n" +
+		"--enc\r\n" +
+		"Content-Type: application/octet-stream; name=encrypted.asc\r\n\r\n" + ciphertext.String() + "\r\n" +
+		"--enc--\r\n"
+
+	_, signer, err := pgp.Unwrap([]byte(raw))
+	require.Nil(t, err, "email with an invalid signature should still be decrypted")
+	assert.Nil(t, signer, "invalid signature should not return a signer")
+
+	_, err = handler.PrepareEmail([]byte(raw), "sender@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "email with an invalid signature should be rejected")
+}
+
+func TestPGPVerify(t *testing.T) {
+	pgp, _, sender := newTestPGP(t)
+	pgp.RequireSignature = true
+	handler := EmailHandler{PGP: pgp}
+
+	entity := "Content-Type: text/plain\r\n\r\nStatement total: 5"
+	var signature bytes.Buffer
+	require.Nil(t, openpgp.ArmoredDetachSign(&signature, sender, strings.NewReader(entity), nil), "should be able to sign")
+
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pgp-signature\"; micalg=pgp-sha256; boundary=\"sig\"\r\n" +
+		"\r\n" +
+		"--sig\r\n" + entity + "\r\n" +
+		"--sig\r\n" +
+		"Content-Type: application/pgp-signature; name=signature.asc\r\n\r\n" + signature.String() + "\r\n" +
+		"--sig--\r\n"
+
+	e, err := handler.PrepareEmail([]byte(raw), "sender@example.com")
+	require.Nil(t, err, "signed email should be prepared")
+	assert.Equal(t, "Statement total: 5", string(e.Text))
+	assert.Empty(t, e.Attachments, "signature should be removed")
+
+	_, err = handler.PrepareEmail([]byte(raw), "mailhook@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "signature from another address should be rejected")
+
+	tampered := strings.Replace(raw, "total: 5", "total: 6", 1)
+	_, err = handler.PrepareEmail([]byte(tampered), "sender@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "tampered email should be rejected")
+}
+
+func TestPGPVerifyCleartext(t *testing.T) {
+	pgp, _, sender := newTestPGP(t)
+	pgp.RequireSignature = true
+	handler := EmailHandler{PGP: pgp}
+
+	var signed bytes.Buffer
+	w, err := clearsign.Encode(&signed, sender.PrivateKey, nil)
+	require.Nil(t, err, "should be able to sign")
+	_, err = w.Write([]byte("Statement total: 5\r\n- Sender"))
+	require.Nil(t, err, "should be able to write plaintext")
+	require.Nil(t, w.Close(), "should be able to finish signature")
+
+	raw := "From: sender@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Unsigned introduction\r\n" + signed.String() + "\r\nUnsigned footer\r\n"
+
+	e, err := handler.PrepareEmail([]byte(raw), "sender@example.com")
+	require.Nil(t, err, "cleartext signed email should be prepared")
+	assert.Equal(t, "Statement total: 5\n- Sender\n", string(e.Text), "only the signed text should be kept")
+
+	tampered := strings.Replace(raw, "total: 5", "total: 6", 1)
+	_, err = handler.PrepareEmail([]byte(tampered), "sender@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "tampered email should be rejected")
+
+	withAttachment := "From: sender@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n" +
+		"\r\n" +
+		"--mixed\r\nContent-Type: text/plain\r\n\r\n" + signed.String() + "\r\n" +
+		"--mixed\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=statement.pdf\r\n\r\npdf\r\n" +
+		"--mixed--\r\n"
+	_, err = handler.PrepareEmail([]byte(withAttachment), "sender@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "attachments aren't covered by inline signatures")
+}
+
+func TestPGPDecryptInline(t *testing.T) {
+	pgp, mailhook, _ := newTestPGP(t)
+
+	e := email.NewEmail()
+	e.Text = []byte(encryptPGP(t, "Total: 5", mailhook, nil, ""))
+	e.Attachments = []*email.Attachment{
+		{Filename: "bill.pdf.asc", Header: textproto.MIMEHeader{}, Content: []byte(encryptPGP(t, "pdf", mailhook, nil, ""))},
+		{Filename: "statement.gpg", Header: textproto.MIMEHeader{}, Content: []byte(encryptPGP(t, "pdf", mailhook, nil, "statement.pdf"))},
+		{Filename: "signature.asc", Header: textproto.MIMEHeader{}, Content: []byte("-----BEGIN PGP SIGNATURE-----")},
+	}
+
+	pgp.DecryptInline(e)
+
+	assert.Equal(t, "Total: 5", string(e.Text), "inline body should be decrypted")
+	assert.Equal(t, "bill.pdf", e.Attachments[0].Filename, "extension should be removed")
+	assert.Equal(t, "application/pdf", e.Attachments[0].ContentType)
+	assert.Equal(t, "pdf", string(e.Attachments[0].Content))
+	assert.Equal(t, "statement.pdf", e.Attachments[1].Filename, "filename should be used from message")
+	assert.Equal(t, "signature.asc", e.Attachments[2].Filename, "signatures should be left as-is")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/jordan-wright/email"
+)
+
+// BodyPolicy determines when the body of an email is uploaded in addition to
+// or instead of its attachments.
+type BodyPolicy string
+
+const (
+	// BodyAttachmentsOnly only uploads attachments, never the body.
+	BodyAttachmentsOnly BodyPolicy = "attachments-only"
+	// BodyOnly only uploads the body, ignoring any attachments.
+	BodyOnly BodyPolicy = "body-only"
+	// BodyAndAttachments uploads attachments and the body, if it has content.
+	BodyAndAttachments BodyPolicy = "both"
+	// BodyIfNoAttachments only uploads the body when there are no attachments.
+	BodyIfNoAttachments BodyPolicy = "body-if-no-attachments"
+)
+
+// Decode validates the policy when loading it from the environment.
+func (policy *BodyPolicy) Decode(value string) error {
+	switch p := BodyPolicy(value); p {
+	case BodyAttachmentsOnly, BodyOnly, BodyAndAttachments, BodyIfNoAttachments:
+		*policy = p
+		return nil
+	default:
+		return fmt.Errorf("unknown body policy: %s", value)
+	}
+}
+
+// Evaluate determines if the body and attachments of an email should be
+// uploaded. An empty policy is treated as body-if-no-attachments.
+func (policy BodyPolicy) Evaluate(email *email.Email) (body bool, attachments bool) {
+	hasAttachments := len(email.Attachments) > 0
+
+	switch policy {
+	case BodyAttachmentsOnly:
+		return false, true
+	case BodyOnly:
+		return true, false
+	case BodyAndAttachments:
+		return !hasAttachments || HasMeaningfulBody(email), true
+	default:
+		return !hasAttachments, true
+	}
+}
+
+// htmlTags matches HTML tags along with the contents of style and script
+// elements, which never contain visible text.
+var htmlTags = regexp.MustCompile(`(?is)<(style|script)[^>]*>.*?</(style|script)>|<[^>]*>`)
+
+// HasMeaningfulBody checks if an email contains any visible text, ignoring
+// markup and whitespace.
+func HasMeaningfulBody(email *email.Email) bool {
+	if len(bytes.TrimSpace(email.Text)) > 0 {
+		return true
+	}
+
+	text := html.UnescapeString(string(htmlTags.ReplaceAll(email.HTML, nil)))
+	return strings.TrimSpace(text) != ""
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyPolicyDecode(t *testing.T) {
+	var policy BodyPolicy
+
+	assert.Nil(t, policy.Decode("both"), "known policy should decode")
+	assert.Equal(t, BodyAndAttachments, policy)
+
+	assert.NotNil(t, policy.Decode("everything"), "unknown policy should be rejected")
+}
+
+func TestBodyPolicyEvaluate(t *testing.T) {
+	attachments := []*email.Attachment{{Filename: "logo.png"}}
+
+	withBody := &email.Email{HTML: []byte("<p>Receipt</p>"), Attachments: attachments}
+	withoutBody := &email.Email{HTML: []byte("<html><style>p {}</style><p>&nbsp;</p></html>"), Attachments: attachments}
+	noAttachments := &email.Email{Text: []byte("Receipt")}
+
+	tests := []struct {
+		policy      BodyPolicy
+		email       *email.Email
+		body        bool
+		attachments bool
+	}{
+		{BodyAttachmentsOnly, noAttachments, false, true},
+		{BodyOnly, withBody, true, false},
+		{BodyAndAttachments, withBody, true, true},
+		{BodyAndAttachments, withoutBody, false, true},
+		{BodyAndAttachments, noAttachments, true, true},
+		{BodyIfNoAttachments, withBody, false, true},
+		{BodyIfNoAttachments, noAttachments, true, true},
+		{"", noAttachments, true, true},
+	}
+
+	for _, test := range tests {
+		body, attachments := test.policy.Evaluate(test.email)
+		assert.Equal(t, test.body, body, "policy %s body", test.policy)
+		assert.Equal(t, test.attachments, attachments, "policy %s attachments", test.policy)
+	}
+}
+
+func TestHasMeaningfulBody(t *testing.T) {
+	assert.True(t, HasMeaningfulBody(&email.Email{Text: []byte(" receipt ")}))
+	assert.True(t, HasMeaningfulBody(&email.Email{HTML: []byte("<b>receipt</b>")}))
+	assert.False(t, HasMeaningfulBody(&email.Email{Text: []byte("\r\n"), HTML: []byte("<img src=\"logo.png\"><script>x()</script>")}))
+}
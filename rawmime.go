@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/textproto"
+	"strings"
+)
+
+// splitMessage separates the raw header and body of a message or MIME part.
+// If there is no blank line, everything is treated as the header.
+func splitMessage(raw []byte) (header, body []byte) {
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return raw[:crlf+2], raw[crlf+4:]
+	case lf >= 0:
+		return raw[:lf+1], raw[lf+2:]
+	default:
+		return raw, nil
+	}
+}
+
+// parseHeader parses a raw message header.
+func parseHeader(header []byte) (textproto.MIMEHeader, error) {
+	// The header may be a slice of a larger message, so it must not be
+	// appended to directly.
+	terminated := make([]byte, 0, len(header)+2)
+	terminated = append(append(terminated, header...), "\r\n"...)
+
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(terminated)))
+	return r.ReadMIMEHeader()
+}
+
+// replaceContent replaces the content of a message with a MIME entity, such as
+// the result of decrypting it. Headers describing the original content are
+// removed in favor of those in the entity.
+func replaceContent(raw, entity []byte) []byte {
+	header, _ := splitMessage(raw)
+
+	var buf bytes.Buffer
+	skip := false
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		// Folded lines belong to the previous header.
+		if line[0] != ' ' && line[0] != '\t' {
+			name := strings.ToLower(string(line[:bytes.IndexByte(append(line, ':'), ':')]))
+			skip = strings.HasPrefix(name, "content-") || name == "mime-version"
+		}
+
+		if !skip {
+			buf.Write(line)
+		}
+	}
+
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.Write(entity)
+
+	return buf.Bytes()
+}
+
+// multipartParts splits the body of a multipart message into its raw parts,
+// including each part's header. The line break before each delimiter is not
+// part of the content, as required for verifying signatures.
+func multipartParts(body []byte, boundary string) [][]byte {
+	delimiter := []byte("\n--" + boundary)
+	chunks := bytes.Split(append([]byte("\n"), body...), delimiter)
+
+	var parts [][]byte
+	for _, chunk := range chunks[1:] {
+		if bytes.HasPrefix(chunk, []byte("--")) {
+			break
+		}
+
+		// Skip the rest of the delimiter line.
+		i := bytes.IndexByte(chunk, '\n')
+		if i < 0 {
+			break
+		}
+
+		parts = append(parts, bytes.TrimSuffix(chunk[i+1:], []byte("\r")))
+	}
+
+	return parts
+}
+
+// canonicalLineEndings converts bare line feeds into CRLF, the canonical form
+// used when signing MIME entities.
+func canonicalLineEndings(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
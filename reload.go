@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configPollInterval is how often the configuration file is checked for
+// changes.
+const configPollInterval = 5 * time.Second
+
+// HandlerSwap holds the EmailHandler used for new requests, replaced when the
+// configuration is reloaded. Requests being processed keep using the handler
+// they started with.
+type HandlerSwap struct {
+	handler atomic.Value
+}
+
+// Load returns the current handler.
+func (swap *HandlerSwap) Load() *EmailHandler {
+	handler, _ := swap.handler.Load().(*EmailHandler)
+	return handler
+}
+
+// Store replaces the handler for new requests.
+func (swap *HandlerSwap) Store(handler *EmailHandler) {
+	swap.handler.Store(handler)
+}
+
+func (swap *HandlerSwap) sendGrid(w http.ResponseWriter, req *http.Request) {
+	swap.Load().sendGrid(w, req)
+}
+
+// WatchConfig calls reload when the process receives SIGHUP or the
+// configuration file is modified, until the context is done.
+func WatchConfig(ctx context.Context, name string, interval time.Duration, reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modified := modTime(name)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Info("got sighup, reloading configuration")
+			modified = modTime(name)
+			reload()
+		case <-ticker.C:
+			if current := modTime(name); !current.Equal(modified) {
+				log.Info("configuration file changed, reloading")
+				modified = current
+				reload()
+			}
+		}
+	}
+}
+
+// modTime returns when a file was last modified, or the zero time if it
+// doesn't exist.
+func modTime(name string) time.Time {
+	info, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// reloadConfig loads the configuration and swaps in a new handler. If the
+// configuration is invalid, the previous handler is kept.
+func reloadConfig(handlers *HandlerSwap, client *http.Client, httpHost string) {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Errorf("could not reload configuration: %s", err.Error())
+		return
+	}
+
+	handler, err := NewEmailHandler(cfg, client)
+	if err != nil {
+		log.Errorf("could not reload configuration: %s", err.Error())
+		return
+	}
+
+	if cfg.HTTPHost != httpHost {
+		log.Warn("changing the http host requires a restart")
+	}
+
+	// Messages received before reloading are kept.
+	handler.History = handlers.Load().History
+
+	setLogLevel(cfg.Debug)
+	handlers.Store(handler)
+
+	log.Info("reloaded configuration")
+}
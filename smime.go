@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/pkcs7"
+)
+
+// errSMIMEDecrypt is returned when S/MIME content can't be read, so the
+// encrypted content isn't uploaded as a document.
+var errSMIMEDecrypt = errors.New("s/mime message could not be decrypted")
+
+// maxSMIMELayers is how many layers of encryption and signatures are removed
+// from a message.
+const maxSMIMELayers = 4
+
+// SMIME decrypts and verifies S/MIME messages before they are processed.
+type SMIME struct {
+	// Certificate and Key are used to decrypt messages. They are optional if
+	// only verifying signatures.
+	Certificate *x509.Certificate
+	Key         crypto.PrivateKey
+
+	// Roots are the certificate authorities trusted to issue signing
+	// certificates.
+	Roots *x509.CertPool
+
+	// RequireSignature rejects emails without a valid signature from the
+	// sender.
+	RequireSignature bool
+}
+
+// LoadSMIME loads a PEM encoded certificate and private key and the trusted
+// certificate authorities. The system roots are used if no roots file is set.
+func LoadSMIME(certFile, keyFile, rootsFile string) (*SMIME, error) {
+	smime := &SMIME{}
+
+	if certFile != "" || keyFile != "" {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load s/mime key pair: %w", err)
+		}
+
+		if smime.Certificate, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return nil, err
+		}
+		smime.Key = pair.PrivateKey
+	}
+
+	if rootsFile == "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("could not load system roots: %w", err)
+		}
+		smime.Roots = roots
+
+		return smime, nil
+	}
+
+	contents, err := os.ReadFile(rootsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	smime.Roots = x509.NewCertPool()
+	if !smime.Roots.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("no certificates found in %s", rootsFile)
+	}
+
+	return smime, nil
+}
+
+// Unwrap decrypts an S/MIME message and removes any signatures, returning the
+// resulting message and the certificate of the signer if the signature was
+// valid.
+//
+// Messages without S/MIME content are returned unchanged. Invalid signatures
+// are logged but do not prevent processing. If encrypted content can't be
+// read, the error wraps errSMIMEDecrypt.
+func (smime *SMIME) Unwrap(raw []byte) ([]byte, *x509.Certificate, error) {
+	var signer *x509.Certificate
+
+	for i := 0; i < maxSMIMELayers; i++ {
+		header, body := splitMessage(raw)
+		parsed, err := parseHeader(header)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		mediaType, params, err := mime.ParseMediaType(parsed.Get("Content-Type"))
+		if err != nil {
+			return raw, signer, nil
+		}
+
+		var entity []byte
+		switch {
+		case mediaType == "multipart/signed" && isSMIMESignature(params["protocol"]):
+			var cert *x509.Certificate
+			if entity, cert, err = smime.verifyDetached(body, params["boundary"]); err != nil {
+				return nil, nil, err
+			}
+			if cert != nil {
+				signer = cert
+			}
+		case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime":
+			var cert *x509.Certificate
+			if entity, cert, err = smime.open(parsed.Get("Content-Transfer-Encoding"), body); err != nil {
+				return nil, nil, err
+			}
+			if cert != nil {
+				signer = cert
+			}
+		default:
+			return raw, signer, nil
+		}
+
+		raw = replaceContent(raw, entity)
+	}
+
+	return raw, signer, nil
+}
+
+// isSMIMESignature checks if a multipart/signed protocol is S/MIME.
+func isSMIMESignature(protocol string) bool {
+	protocol = strings.ToLower(protocol)
+	return protocol == "application/pkcs7-signature" || protocol == "application/x-pkcs7-signature"
+}
+
+// open decrypts an enveloped message or extracts the content of an opaque
+// signed message.
+func (smime *SMIME) open(encoding string, body []byte) ([]byte, *x509.Certificate, error) {
+	der, err := DecodeTransferEncoding(encoding, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: could not parse s/mime content: %s", errSMIMEDecrypt, err.Error())
+	}
+
+	// Signed data has signers, enveloped data only has recipients.
+	if len(p7.Signers) > 0 {
+		return p7.Content, smime.verify(p7), nil
+	}
+
+	if smime.Certificate == nil || smime.Key == nil {
+		return nil, nil, fmt.Errorf("%w: no s/mime key is configured", errSMIMEDecrypt)
+	}
+
+	content, err := p7.Decrypt(smime.Certificate, smime.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errSMIMEDecrypt, err.Error())
+	}
+
+	log.Debug("decrypted s/mime message")
+	return content, nil, nil
+}
+
+// verifyDetached checks a multipart/signed message, returning the signed part.
+func (smime *SMIME) verifyDetached(body []byte, boundary string) ([]byte, *x509.Certificate, error) {
+	parts := multipartParts(body, boundary)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("signed message had %d parts, expected 2", len(parts))
+	}
+
+	header, signature := splitMessage(parts[1])
+	parsed, err := parseHeader(header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := DecodeTransferEncoding(parsed.Get("Content-Transfer-Encoding"), signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		log.Warnf("could not parse s/mime signature: %s", err.Error())
+		return parts[0], nil, nil
+	}
+
+	// Signatures are created over the canonical form of the part, but line
+	// endings may have been changed in transit.
+	p7.Content = parts[0]
+	if signer := smime.verify(p7); signer != nil {
+		return parts[0], signer, nil
+	}
+
+	p7.Content = canonicalLineEndings(parts[0])
+	return parts[0], smime.verify(p7), nil
+}
+
+// verify checks the signature of signed data, returning the signer's
+// certificate if it was valid.
+func (smime *SMIME) verify(p7 *pkcs7.PKCS7) *x509.Certificate {
+	if err := p7.VerifyWithChain(smime.Roots); err != nil {
+		log.Debugf("s/mime signature was not valid: %s", err.Error())
+		return nil
+	}
+
+	return p7.GetOnlySigner()
+}
+
+// SignedBy checks if a certificate belongs to an email address.
+func SignedBy(cert *x509.Certificate, address string) bool {
+	if cert == nil {
+		return false
+	}
+
+	for _, email := range cert.EmailAddresses {
+		if strings.EqualFold(email, address) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mozilla.org/pkcs7"
+)
+
+// newTestSMIME creates a self-signed certificate for an email address and
+// an S/MIME configuration trusting it.
+func newTestSMIME(t *testing.T, address string) (*SMIME, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err, "should be able to generate key")
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: address},
+		EmailAddresses: []string{address},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err, "should be able to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err, "should be able to parse certificate")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	return &SMIME{Certificate: cert, Key: key, Roots: roots}, key
+}
+
+// signMessage creates a multipart/signed message containing the entity.
+func signMessage(t *testing.T, smime *SMIME, key *rsa.PrivateKey, entity string) string {
+	sd, err := pkcs7.NewSignedData([]byte(entity))
+	require.Nil(t, err, "should be able to create signed data")
+	require.Nil(t, sd.AddSigner(smime.Certificate, key, pkcs7.SignerInfoConfig{}), "should be able to add signer")
+	sd.Detach()
+	signature, err := sd.Finish()
+	require.Nil(t, err, "should be able to sign")
+
+	return "From: bank@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256;\r\n boundary=\"sig\"\r\n" +
+		"\r\n" +
+		"--sig\r\n" + entity + "\r\n" +
+		"--sig\r\n" +
+		"Content-Type: application/pkcs7-signature; name=smime.p7s\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" + base64.StdEncoding.EncodeToString(signature) + "\r\n" +
+		"--sig--\r\n"
+}
+
+func TestSMIMEDecrypt(t *testing.T) {
+	smime, _ := newTestSMIME(t, "mailhook@example.com")
+
+	encrypted, err := pkcs7.Encrypt([]byte("Content-Type: text/plain\r\n\r\nStatement total: 5\r\n"), []*x509.Certificate{smime.Certificate})
+	require.Nil(t, err, "should be able to encrypt")
+
+	raw := "From: bank@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=enveloped-data;\r\n name=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" + base64.StdEncoding.EncodeToString(encrypted) + "\r\n"
+
+	handler := EmailHandler{SMIME: smime}
+	e, err := handler.PrepareEmail([]byte(raw), "bank@example.com")
+	require.Nil(t, err, "encrypted email should be prepared")
+
+	assert.Equal(t, "Statement", e.Subject, "outer headers should be kept")
+	assert.Equal(t, "Statement total: 5\r\n", string(e.Text), "body should be decrypted")
+	assert.Empty(t, e.Attachments, "encrypted content should not be an attachment")
+
+	handler.SMIME = &SMIME{}
+	_, err = handler.PrepareEmail([]byte(raw), "bank@example.com")
+	assert.ErrorIs(t, err, errSMIMEDecrypt, "email should not be processed without a key")
+
+	other, _ := newTestSMIME(t, "mailhook@example.com")
+	handler.SMIME = other
+	_, err = handler.PrepareEmail([]byte(raw), "bank@example.com")
+	assert.ErrorIs(t, err, errSMIMEDecrypt, "email should not be processed with the wrong key")
+}
+
+func TestReceiveSMIMEDecryptFailure(t *testing.T) {
+	client, documents := newTestPaperless(t)
+	smime, _ := newTestSMIME(t, "mailhook@example.com")
+
+	history := NewHistory(10, 0)
+	handler := &EmailHandler{
+		AllowList: AllowList{[]string{"bank@example.com"}, ""},
+		SMIME:     &SMIME{},
+		paperless: client,
+		History:   history,
+	}
+
+	encrypted, err := pkcs7.Encrypt([]byte("Content-Type: text/plain\r\n\r\nStatement total: 5\r\n"), []*x509.Certificate{smime.Certificate})
+	require.Nil(t, err, "should be able to encrypt")
+
+	raw := "From: bank@example.com\r\n" +
+		"Subject: Statement\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=enveloped-data;\r\n name=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" + base64.StdEncoding.EncodeToString(encrypted) + "\r\n"
+
+	err = handler.track("test", "bank@example.com", nil, []byte(raw)).receive(log.WithField("test", t.Name()), "bank@example.com", nil, []byte(raw), nil)
+	assert.ErrorIs(t, err, errInvalidEmail, "email should fail")
+	assert.Empty(t, *documents, "encrypted content should not be uploaded")
+
+	messages := history.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, MessageFailed, messages[0].Status)
+	assert.Contains(t, messages[0].Reason, errSMIMEDecrypt.Error())
+}
+
+func TestSMIMEVerify(t *testing.T) {
+	smime, key := newTestSMIME(t, "bank@example.com")
+	smime.RequireSignature = true
+	handler := EmailHandler{SMIME: smime}
+
+	raw := signMessage(t, smime, key, "Content-Type: text/plain\r\n\r\nStatement total: 5")
+
+	unwrapped, signer, err := smime.Unwrap([]byte(raw))
+	require.Nil(t, err, "signed email should be unwrapped")
+	assert.True(t, SignedBy(signer, "BANK@example.com"), "signer should be returned")
+	assert.False(t, strings.Contains(string(unwrapped), "pkcs7-signature"), "signature should be removed")
+
+	e, err := handler.PrepareEmail([]byte(raw), "bank@example.com")
+	require.Nil(t, err, "signed email should be prepared")
+	assert.Equal(t, "Statement total: 5", string(e.Text))
+
+	_, err = handler.PrepareEmail([]byte(raw), "someone@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "signature from another address should be rejected")
+
+	lf := strings.ReplaceAll(raw, "\r\n", "\n")
+	_, err = handler.PrepareEmail([]byte(lf), "bank@example.com")
+	assert.Nil(t, err, "signature should be valid after line endings change")
+
+	tampered := strings.Replace(raw, "total: 5", "total: 6", 1)
+	_, err = handler.PrepareEmail([]byte(tampered), "bank@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "tampered email should be rejected")
+
+	_, err = handler.PrepareEmail([]byte("From: bank@example.com\r\nSubject: Hi\r\n\r\nHello"), "bank@example.com")
+	assert.Equal(t, errUnsignedEmail, err, "unsigned email should be rejected")
+
+	handler.SMIME.RequireSignature = false
+	_, err = handler.PrepareEmail([]byte(tampered), "bank@example.com")
+	assert.Nil(t, err, "invalid signatures should be allowed unless required")
+}
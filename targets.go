@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Syfaro/paperless-mailhook/paperless"
+)
+
+// targetName matches names that can be used within environment variables.
+var targetName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+var errNoTarget = errors.New("email was not addressed to any target")
+
+// TargetConfig is the configuration of a single target, read from the
+// configuration file and environment variables prefixed with MAILHOOK_TARGET_
+// and the target's name.
+type TargetConfig struct {
+	Name string `ignored:"true" yaml:"-"`
+
+	PaperlessEndpoint string
+	PaperlessAPIKey   string
+	PaperlessTags     []string
+	AllowedEmails     []string
+	ToAddress         string
+}
+
+// validate checks that every required setting of a target is present.
+func (cfg TargetConfig) validate() error {
+	if !targetName.MatchString(cfg.Name) {
+		return fmt.Errorf("target name %q may only contain letters, numbers and underscores", cfg.Name)
+	}
+
+	if cfg.PaperlessEndpoint == "" || cfg.PaperlessAPIKey == "" || len(cfg.AllowedEmails) == 0 || cfg.ToAddress == "" {
+		return fmt.Errorf("target %s requires paperlessEndpoint, paperlessAPIKey, allowedEmails and toAddress", cfg.Name)
+	}
+
+	return nil
+}
+
+// LoadTargets creates a handler for each target, copying every other setting
+// from the base handler. Tags and owners are resolved on each target's own
+// Paperless instance.
+func LoadTargets(configs []TargetConfig, base *EmailHandler, client paperless.HTTPClient, lockedTag string) ([]*EmailHandler, error) {
+	targets := make([]*EmailHandler, 0, len(configs))
+
+	for _, cfg := range configs {
+		name := cfg.Name
+
+		target := *base
+		target.Target = name
+		target.Targets = nil
+		target.AllowList = AllowList{cfg.AllowedEmails, cfg.ToAddress}
+		target.paperless = paperless.New(cfg.PaperlessEndpoint, cfg.PaperlessAPIKey, client)
+
+		var err error
+		if target.Tags, err = ResolveTags(target.paperless, cfg.PaperlessTags); err != nil {
+			return nil, fmt.Errorf("could not resolve tags for target %s: %w", name, err)
+		}
+
+		if lockedTag != "" {
+			if target.PDFLockedTag, err = target.paperless.ResolveTag(lockedTag); err != nil {
+				return nil, fmt.Errorf("could not resolve locked pdf tag for target %s: %w", name, err)
+			}
+		}
+
+		if err = target.resolveOwners(); err != nil {
+			return nil, fmt.Errorf("could not resolve owners for target %s: %w", name, err)
+		}
+
+		targets = append(targets, &target)
+	}
+
+	return targets, nil
+}
+
+// route selects the handler for an email by its recipients. If no target was
+// addressed, the handler itself is used if it has its own Paperless instance.
+func (handler *EmailHandler) route(to []string) (*EmailHandler, error) {
+	for _, target := range handler.Targets {
+		for _, address := range to {
+			if MatchesAddress(target.ToAddress, address) {
+				return target, nil
+			}
+		}
+	}
+
+	if handler.paperless == nil {
+		return nil, errNoTarget
+	}
+
+	return handler, nil
+}
+
+// target returns the handler for the named target, or nil if there is no such
+// target.
+func (handler *EmailHandler) target(name string) *EmailHandler {
+	for _, target := range handler.Targets {
+		if strings.EqualFold(target.Target, name) {
+			return target
+		}
+	}
+
+	return nil
+}
+
+// MatchesAddress checks if an address matches an expected address. An expected
+// address ending with @, such as "home@", matches that local part on any
+// domain.
+func MatchesAddress(expected, address string) bool {
+	if strings.HasSuffix(expected, "@") {
+		return len(address) > len(expected) && strings.EqualFold(address[:len(expected)], expected)
+	}
+
+	return strings.EqualFold(expected, address)
+}
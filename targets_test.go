@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setenv sets environment variables for the duration of a test.
+func setenv(t *testing.T, values map[string]string) {
+	for key, value := range values {
+		previous, existed := os.LookupEnv(key)
+		require.NoError(t, os.Setenv(key, value))
+
+		key := key
+		t.Cleanup(func() {
+			if existed {
+				os.Setenv(key, previous)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+// newSendGridRequest creates an inbound parse webhook request for a raw email.
+func newSendGridRequest(t *testing.T, from string, to []string, raw string) *http.Request {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+
+	recipients := ""
+	for i, address := range to {
+		if i > 0 {
+			recipients += ","
+		}
+		recipients += fmt.Sprintf("%q", address)
+	}
+
+	require.NoError(t, form.WriteField("envelope", fmt.Sprintf(`{"from": %q, "to": [%s]}`, from, recipients)))
+	require.NoError(t, form.WriteField("email", raw))
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/sendgrid", &buf)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	return req
+}
+
+func TestMatchesAddress(t *testing.T) {
+	tests := []struct {
+		expected string
+		address  string
+		matches  bool
+	}{
+		{"home@example.com", "home@example.com", true},
+		{"home@example.com", "HOME@example.com", true},
+		{"home@example.com", "office@example.com", false},
+		{"home@", "home@example.com", true},
+		{"home@", "Home@other.example", true},
+		{"home@", "office@example.com", false},
+		{"home@", "home@", false},
+		{"home@", "myhome@example.com", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.matches, MatchesAddress(test.expected, test.address), "%s %s", test.expected, test.address)
+	}
+}
+
+func TestLoadTargets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "Token officeKey", req.Header.Get("Authorization"), "target api key should be used")
+
+		switch req.URL.Query().Get("name__iexact") {
+		case "invoices":
+			fmt.Fprint(w, `{"results": [{"id": 4}]}`)
+		case "locked":
+			fmt.Fprint(w, `{"results": [{"id": 9}]}`)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	base := &EmailHandler{Tags: []int{1}, MergeDocuments: true}
+
+	configs := []TargetConfig{{
+		Name:              "office",
+		PaperlessEndpoint: ts.URL,
+		PaperlessAPIKey:   "officeKey",
+		PaperlessTags:     []string{"invoices"},
+		AllowedEmails:     []string{"boss@example.com", "clerk@example.com"},
+		ToAddress:         "office@",
+	}}
+
+	targets, err := LoadTargets(configs, base, http.DefaultClient, "locked")
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+
+	target := targets[0]
+	assert.Equal(t, "office", target.Target)
+	assert.Equal(t, []int{4}, target.Tags)
+	assert.Equal(t, 9, target.PDFLockedTag)
+	assert.Equal(t, []string{"boss@example.com", "clerk@example.com"}, target.AllowedEmails)
+	assert.Equal(t, "office@", target.ToAddress)
+	assert.True(t, target.MergeDocuments, "other settings should be copied from the base handler")
+	assert.Equal(t, []int{1}, base.Tags, "base handler should not be changed")
+}
+
+func TestLoadTargetConfig(t *testing.T) {
+	setenv(t, map[string]string{
+		"MAILHOOK_TARGET_OFFICE_PAPERLESSENDPOINT": "http://paperless",
+		"MAILHOOK_TARGET_OFFICE_PAPERLESSAPIKEY":   "officeKey",
+		"MAILHOOK_TARGET_OFFICE_PAPERLESSTAGS":     "invoices",
+		"MAILHOOK_TARGET_OFFICE_ALLOWEDEMAILS":     "boss@example.com,clerk@example.com",
+		"MAILHOOK_TARGET_OFFICE_TOADDRESS":         "office@",
+	})
+
+	target, err := loadTargetConfig("office", nil)
+	require.NoError(t, err)
+	assert.Equal(t, TargetConfig{
+		Name:              "office",
+		PaperlessEndpoint: "http://paperless",
+		PaperlessAPIKey:   "officeKey",
+		PaperlessTags:     []string{"invoices"},
+		AllowedEmails:     []string{"boss@example.com", "clerk@example.com"},
+		ToAddress:         "office@",
+	}, target)
+
+	_, err = loadTargetConfig("missing", nil)
+	assert.Error(t, err, "targets without configuration should fail to load")
+
+	_, err = loadTargetConfig("bad-name", nil)
+	assert.Error(t, err, "target names must be usable in environment variables")
+}
+
+func TestSendGridTargets(t *testing.T) {
+	defaultPaperless, defaultDocuments := newTestPaperless(t)
+	homePaperless, homeDocuments := newTestPaperless(t)
+	officePaperless, officeDocuments := newTestPaperless(t)
+
+	home := &EmailHandler{
+		AllowList: AllowList{[]string{"me@example.com"}, "home@"},
+		Target:    "home",
+		paperless: homePaperless,
+	}
+	office := &EmailHandler{
+		AllowList: AllowList{[]string{"boss@example.com"}, "office@example.com"},
+		Target:    "office",
+		paperless: officePaperless,
+	}
+
+	handler := &EmailHandler{
+		AllowList: AllowList{[]string{"me@example.com", "boss@example.com"}, ""},
+		Targets:   []*EmailHandler{home, office},
+		paperless: defaultPaperless,
+	}
+
+	raw := "From: sender\r\nSubject: %s\r\nContent-Type: text/plain\r\n\r\nBody\r\n"
+
+	tests := []struct {
+		from string
+		to   string
+	}{
+		{"me@example.com", "home@example.com"},
+		{"boss@example.com", "office@example.com"},
+		{"boss@example.com", "home@example.com"},
+		{"me@example.com", "other@example.com"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.sendGrid(w, newSendGridRequest(t, test.from, []string{test.to}, fmt.Sprintf(raw, test.to)))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	require.Len(t, *homeDocuments, 1)
+	assert.Equal(t, "home@example.com.pdf", (*homeDocuments)[0].Filename)
+
+	require.Len(t, *officeDocuments, 1)
+	assert.Equal(t, "office@example.com.pdf", (*officeDocuments)[0].Filename)
+
+	require.Len(t, *defaultDocuments, 1, "emails not addressed to a target should use the default instance")
+	assert.Equal(t, "other@example.com.pdf", (*defaultDocuments)[0].Filename)
+}
+
+func TestSendGridNoTarget(t *testing.T) {
+	homePaperless, homeDocuments := newTestPaperless(t)
+
+	handler := &EmailHandler{
+		Targets: []*EmailHandler{{
+			AllowList: AllowList{[]string{"me@example.com"}, "home@example.com"},
+			paperless: homePaperless,
+		}},
+	}
+
+	w := httptest.NewRecorder()
+	handler.sendGrid(w, newSendGridRequest(t, "me@example.com", []string{"other@example.com"}, "Subject: Test\r\n\r\nBody\r\n"))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, *homeDocuments)
+}
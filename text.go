@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// textTemplate wraps plain-text emails so they can be rendered by Chromium
+// while keeping their original formatting.
+var textTemplate = template.Must(template.New("text").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<style>
+body { margin: 0; }
+pre { font-family: "DejaVu Sans Mono", "Liberation Mono", monospace; font-size: 11px; white-space: pre-wrap; word-wrap: break-word; }
+</style>
+</head>
+<body>
+<pre>{{.}}</pre>
+</body>
+</html>
+`))
+
+// urlPattern matches http and https URLs within plain text.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// TextCharset returns the charset declared in an email's Content-Type header,
+// if any.
+func TextCharset(contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return params["charset"]
+}
+
+// DecodeCharset converts text in the given charset to UTF-8. If the charset is
+// unknown or missing, valid UTF-8 is returned unchanged and anything else is
+// assumed to be Windows-1252.
+func DecodeCharset(text []byte, charset string) []byte {
+	if charset != "" {
+		if enc, err := htmlindex.Get(charset); err == nil {
+			if decoded, err := enc.NewDecoder().Bytes(text); err == nil {
+				return decoded
+			}
+		}
+	}
+
+	if utf8.Valid(text) {
+		return text
+	}
+
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(text)
+	if err != nil {
+		return text
+	}
+
+	return decoded
+}
+
+// Linkify escapes text for HTML, converting any URLs into links.
+func Linkify(text string) template.HTML {
+	var buf strings.Builder
+
+	last := 0
+	for _, loc := range urlPattern.FindAllStringIndex(text, -1) {
+		// Punctuation at the end of a URL is much more likely to belong to the
+		// surrounding sentence.
+		url := strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)'")
+		end := loc[0] + len(url)
+
+		buf.WriteString(template.HTMLEscapeString(text[last:loc[0]]))
+		buf.WriteString(`<a href="`)
+		buf.WriteString(template.HTMLEscapeString(url))
+		buf.WriteString(`">`)
+		buf.WriteString(template.HTMLEscapeString(url))
+		buf.WriteString(`</a>`)
+
+		last = end
+	}
+	buf.WriteString(template.HTMLEscapeString(text[last:]))
+
+	return template.HTML(buf.String())
+}
+
+// RenderTextHTML converts a plain-text email body into an HTML document.
+func RenderTextHTML(text []byte, charset string) ([]byte, error) {
+	decoded := DecodeCharset(text, charset)
+
+	// Normalize line endings so Chromium doesn't render extra blank lines.
+	body := strings.ReplaceAll(string(decoded), "\r\n", "\n")
+
+	var buf bytes.Buffer
+	if err := textTemplate.Execute(&buf, Linkify(body)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
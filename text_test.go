@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/textproto"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextCharset(t *testing.T) {
+	assert.Equal(t, "iso-8859-1", TextCharset("text/plain; charset=iso-8859-1"))
+	assert.Equal(t, "", TextCharset("text/plain"))
+	assert.Equal(t, "", TextCharset(""))
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		charset  string
+		expected string
+	}{
+		{[]byte("caf\xe9"), "iso-8859-1", "café"},
+		{[]byte("caf\xc3\xa9"), "", "café"},
+		{[]byte("caf\xe9"), "", "café"},
+		{[]byte("caf\xc3\xa9"), "not-a-charset", "café"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, string(DecodeCharset(test.input, test.charset)))
+	}
+}
+
+func TestLinkify(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"no links <here>", "no links &lt;here&gt;"},
+		{"see https://example.com/a?b=1&c=2.", `see <a href="https://example.com/a?b=1&amp;c=2">https://example.com/a?b=1&amp;c=2</a>.`},
+		{"(http://example.com)", `(<a href="http://example.com">http://example.com</a>)`},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, string(Linkify(test.input)))
+	}
+}
+
+func TestRenderTextHTML(t *testing.T) {
+	out, err := RenderTextHTML([]byte("Total:\r\n  <b>5</b>"), "")
+	require.Nil(t, err, "text should render")
+
+	assert.Contains(t, string(out), `<meta charset="utf-8">`)
+	assert.Contains(t, string(out), "<pre>Total:\n  &lt;b&gt;5&lt;/b&gt;</pre>")
+}
+
+func TestRenderContentText(t *testing.T) {
+	handler := EmailHandler{gotenbergClient: newTestGotenberg(t)}
+
+	pdf, err := handler.RenderContent(&email.Email{Text: []byte("text"), Headers: textproto.MIMEHeader{}})
+	require.Nil(t, err, "text email should render")
+	defer pdf.Close()
+
+	data, err := io.ReadAll(pdf)
+	require.Nil(t, err, "rendered pdf should be readable")
+	assert.Equal(t, "/convert/html:index.html", string(data), "text should be rendered with chromium")
+}
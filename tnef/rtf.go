@@ -0,0 +1,262 @@
+package tnef
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Compression types for compressed RTF.
+const (
+	rtfCompressed   = 0x75465a4c // "LZFu"
+	rtfUncompressed = 0x414c454d // "MELA"
+)
+
+// rtfPrebuf is used to initialize the compressed RTF dictionary.
+const rtfPrebuf = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}{\\f0\\fnil \\froman " +
+	"\\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier" +
+	"{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+
+// ErrRTFFormat is returned when compressed RTF has an unknown format.
+var ErrRTFFormat = errors.New("unknown compressed rtf format")
+
+// DecompressRTF decompresses an RTF body stored in the compressed format
+// described by MS-OXRTFCP.
+func DecompressRTF(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, ErrTruncated
+	}
+
+	compressedSize := binary.LittleEndian.Uint32(data[0:4])
+	rawSize := binary.LittleEndian.Uint32(data[4:8])
+	compType := binary.LittleEndian.Uint32(data[8:12])
+
+	// The compressed size includes the header after the size field itself.
+	end := int(compressedSize) + 4
+	if end > len(data) || end < 16 {
+		end = len(data)
+	}
+	input := data[16:end]
+
+	switch compType {
+	case rtfUncompressed:
+		if int(rawSize) < len(input) {
+			input = input[:rawSize]
+		}
+		return input, nil
+	case rtfCompressed:
+	default:
+		return nil, ErrRTFFormat
+	}
+
+	var dict [4096]byte
+	copy(dict[:], rtfPrebuf)
+	writePos := len(rtfPrebuf)
+
+	// The raw size comes from the attachment, so the output is only
+	// preallocated up to the most the input could expand to. Each two byte
+	// reference expands to at most 17 bytes.
+	capacity := len(input) * 9
+	if uint64(rawSize) < uint64(capacity) {
+		capacity = int(rawSize)
+	}
+
+	out := make([]byte, 0, capacity)
+	write := func(b byte) {
+		out = append(out, b)
+		dict[writePos] = b
+		writePos = (writePos + 1) % len(dict)
+	}
+
+	// Output beyond the raw size is discarded.
+decode:
+	for i := 0; i < len(input) && uint64(len(out)) < uint64(rawSize); {
+		control := input[i]
+		i++
+
+		for bit := 0; bit < 8 && i < len(input); bit++ {
+			if control&(1<<bit) == 0 {
+				write(input[i])
+				i++
+				continue
+			}
+
+			if i+1 >= len(input) {
+				return nil, ErrTruncated
+			}
+
+			token := int(input[i])<<8 | int(input[i+1])
+			i += 2
+
+			offset := token >> 4
+			length := token&0xf + 2
+
+			// A reference to the current write position marks the end.
+			if offset == writePos {
+				break decode
+			}
+
+			for j := 0; j < length; j++ {
+				write(dict[(offset+j)%len(dict)])
+			}
+		}
+	}
+
+	if uint64(len(out)) > uint64(rawSize) {
+		out = out[:rawSize]
+	}
+
+	return out, nil
+}
+
+// rtfSkipDestinations are RTF groups that never contain message text.
+var rtfSkipDestinations = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true,
+	"pict": true, "object": true, "header": true, "footer": true,
+	"listtable": true, "listoverridetable": true, "rsidtbl": true,
+	"generator": true, "themedata": true, "datastore": true,
+	"latentstyles": true, "xmlnstbl": true, "mmathPr": true,
+}
+
+// RTFText extracts the plain text from an RTF document, discarding all
+// formatting.
+func RTFText(rtf []byte) string {
+	var b strings.Builder
+	decoder := charmap.Windows1252.NewDecoder()
+
+	// Each group inherits whether its parent was being skipped.
+	skip := []bool{false}
+	skipping := func() bool { return skip[len(skip)-1] }
+	// groupStart tracks if the next control word is the first in its group,
+	// which is where destinations are declared.
+	groupStart := false
+	// fallback is how many characters to skip after a unicode escape.
+	fallback := 0
+
+	for i := 0; i < len(rtf); i++ {
+		c := rtf[i]
+
+		switch c {
+		case '{':
+			skip = append(skip, skipping())
+			groupStart = true
+			continue
+		case '}':
+			if len(skip) > 1 {
+				skip = skip[:len(skip)-1]
+			}
+			groupStart = false
+			continue
+		case '\r', '\n':
+			continue
+		case '\\':
+		default:
+			groupStart = false
+			if fallback > 0 {
+				fallback--
+				continue
+			}
+			if !skipping() {
+				b.WriteByte(c)
+			}
+			continue
+		}
+
+		// Handle control symbols and words.
+		if i+1 >= len(rtf) {
+			break
+		}
+		i++
+		c = rtf[i]
+		first := groupStart
+		groupStart = false
+
+		switch {
+		case c == '\\' || c == '{' || c == '}':
+			if !skipping() {
+				b.WriteByte(c)
+			}
+		case c == '*':
+			skip[len(skip)-1] = true
+		case c == '~':
+			if !skipping() {
+				b.WriteString(" ")
+			}
+		case c == '\r' || c == '\n':
+			if !skipping() {
+				b.WriteByte('\n')
+			}
+		case c == '\'':
+			if i+2 >= len(rtf) {
+				break
+			}
+			hex := string(rtf[i+1 : i+3])
+			i += 2
+			if fallback > 0 {
+				fallback--
+				break
+			}
+			if v, err := strconv.ParseUint(hex, 16, 8); err == nil && !skipping() {
+				if decoded, err := decoder.Bytes([]byte{byte(v)}); err == nil {
+					b.Write(decoded)
+				}
+			}
+		case isLetter(c):
+			start := i
+			for i < len(rtf) && isLetter(rtf[i]) {
+				i++
+			}
+			word := string(rtf[start:i])
+
+			paramStart := i
+			if i < len(rtf) && rtf[i] == '-' {
+				i++
+			}
+			for i < len(rtf) && rtf[i] >= '0' && rtf[i] <= '9' {
+				i++
+			}
+			param, hasParam := 0, i > paramStart
+			if hasParam {
+				param, _ = strconv.Atoi(string(rtf[paramStart:i]))
+			}
+
+			// A single space delimits the control word and is not text.
+			if i >= len(rtf) || rtf[i] != ' ' {
+				i--
+			}
+
+			if first && rtfSkipDestinations[word] {
+				skip[len(skip)-1] = true
+				continue
+			}
+
+			if skipping() {
+				continue
+			}
+
+			switch word {
+			case "par", "line", "row":
+				b.WriteByte('\n')
+			case "tab", "cell":
+				b.WriteByte('\t')
+			case "u":
+				if hasParam {
+					if param < 0 {
+						param += 65536
+					}
+					b.WriteRune(rune(param))
+					fallback = 1
+				}
+			}
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,418 @@
+// Package tnef decodes Microsoft Transport Neutral Encapsulation Format data,
+// which Outlook uses to send attachments as winmail.dat.
+package tnef
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// Signature is the first four bytes of every TNEF stream.
+const Signature = 0x223e9f78
+
+// TNEF attribute levels.
+const (
+	levelMessage    = 0x01
+	levelAttachment = 0x02
+)
+
+// TNEF attribute IDs, excluding the type in the upper 16 bits.
+const (
+	attSubject        = 0x8004
+	attBody           = 0x800c
+	attAttachData     = 0x800f
+	attAttachTitle    = 0x8010
+	attAttachRendData = 0x9002
+	attMAPIProps      = 0x9003
+	attAttachment     = 0x9005
+)
+
+// MAPI property IDs.
+const (
+	propSubject        = 0x0037
+	propBody           = 0x1000
+	propRTFCompressed  = 0x1009
+	propHTML           = 0x1013
+	propAttachDataObj  = 0x3701
+	propAttachFilename = 0x3704
+	propAttachLongName = 0x3707
+	propAttachMIMETag  = 0x370e
+)
+
+// MAPI property types.
+const (
+	typeShort     = 0x0002
+	typeLong      = 0x0003
+	typeFloat     = 0x0004
+	typeDouble    = 0x0005
+	typeCurrency  = 0x0006
+	typeAppTime   = 0x0007
+	typeError     = 0x000a
+	typeBoolean   = 0x000b
+	typeObject    = 0x000d
+	typeInt64     = 0x0014
+	typeString8   = 0x001e
+	typeUnicode   = 0x001f
+	typeSysTime   = 0x0040
+	typeCLSID     = 0x0048
+	typeBinary    = 0x0102
+	typeMultiFlag = 0x1000
+)
+
+var (
+	// ErrNotTNEF is returned when data does not start with the TNEF
+	// signature.
+	ErrNotTNEF = errors.New("data was not tnef")
+	// ErrTruncated is returned when data ends in the middle of a structure.
+	ErrTruncated = errors.New("tnef data was truncated")
+)
+
+// Attachment is a file embedded within a TNEF message.
+type Attachment struct {
+	Filename string
+	MIMEType string
+	Data     []byte
+}
+
+// Message is the decoded contents of a TNEF stream.
+type Message struct {
+	Subject string
+	Body    []byte
+	HTML    []byte
+	// RTF is the decompressed RTF body, if one was included.
+	RTF []byte
+
+	Attachments []*Attachment
+}
+
+// IsTNEF checks if data starts with the TNEF signature.
+func IsTNEF(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == Signature
+}
+
+// Decode parses a TNEF stream, extracting the message body and attachments.
+func Decode(data []byte) (*Message, error) {
+	if !IsTNEF(data) {
+		return nil, ErrNotTNEF
+	}
+
+	r := &reader{data: data, offset: 6}
+	msg := &Message{}
+
+	var attachment *Attachment
+	for r.remaining() > 0 {
+		level, name, value, err := r.attribute()
+		if err != nil {
+			// Some clients append data after the last attribute, so anything
+			// that can't be read is ignored.
+			break
+		}
+
+		switch level {
+		case levelMessage:
+			switch name {
+			case attSubject:
+				msg.Subject = cString(value)
+			case attBody:
+				msg.Body = []byte(cString(value))
+			case attMAPIProps:
+				props, _ := decodeProperties(value)
+				msg.applyProperties(props)
+			}
+		case levelAttachment:
+			if name == attAttachRendData {
+				attachment = &Attachment{}
+				msg.Attachments = append(msg.Attachments, attachment)
+				continue
+			}
+
+			if attachment == nil {
+				continue
+			}
+
+			switch name {
+			case attAttachTitle:
+				if attachment.Filename == "" {
+					attachment.Filename = cString(value)
+				}
+			case attAttachData:
+				attachment.Data = value
+			case attAttachment:
+				props, _ := decodeProperties(value)
+				attachment.applyProperties(props)
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+func (msg *Message) applyProperties(props []property) {
+	for _, prop := range props {
+		switch prop.id {
+		case propSubject:
+			msg.Subject = prop.string()
+		case propBody:
+			msg.Body = []byte(prop.string())
+		case propHTML:
+			msg.HTML = prop.value
+		case propRTFCompressed:
+			if rtf, err := DecompressRTF(prop.value); err == nil {
+				msg.RTF = bytes.TrimRight(rtf, "\x00")
+			}
+		}
+	}
+}
+
+func (attachment *Attachment) applyProperties(props []property) {
+	var filename, longFilename string
+
+	for _, prop := range props {
+		switch prop.id {
+		case propAttachLongName:
+			longFilename = prop.string()
+		case propAttachFilename:
+			filename = prop.string()
+		case propAttachMIMETag:
+			attachment.MIMEType = prop.string()
+		case propAttachDataObj:
+			if attachment.Data == nil {
+				data := prop.value
+				// Embedded objects start with the interface identifier.
+				if prop.typ == typeObject && len(data) >= 16 {
+					data = data[16:]
+				}
+				attachment.Data = data
+			}
+		}
+	}
+
+	// The long filename is preferred over the 8.3 filename in the title.
+	if longFilename != "" {
+		attachment.Filename = longFilename
+	} else if filename != "" && attachment.Filename == "" {
+		attachment.Filename = filename
+	}
+}
+
+// property is a single MAPI property value.
+type property struct {
+	typ   uint16
+	id    uint16
+	value []byte
+}
+
+// string decodes a string property.
+func (prop property) string() string {
+	if prop.typ == typeUnicode {
+		return decodeUTF16(prop.value)
+	}
+
+	return cString(prop.value)
+}
+
+// decodeProperties parses a list of MAPI properties. Multi-valued properties
+// only keep their first value. If an error is encountered, the properties
+// decoded before it are still returned.
+func decodeProperties(data []byte) (props []property, err error) {
+	r := &reader{data: data}
+
+	count, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < count && r.remaining() > 0; i++ {
+		typ, err := r.uint16()
+		if err != nil {
+			return props, err
+		}
+		id, err := r.uint16()
+		if err != nil {
+			return props, err
+		}
+
+		// Named properties include a GUID followed by either a numeric ID or
+		// a padded UTF-16 name.
+		if id >= 0x8000 {
+			if _, err = r.bytes(16); err != nil {
+				return props, err
+			}
+			kind, err := r.uint32()
+			if err != nil {
+				return props, err
+			}
+			if kind == 0 {
+				_, err = r.uint32()
+			} else {
+				var length uint32
+				if length, err = r.uint32(); err == nil {
+					_, err = r.padded(int(length))
+				}
+			}
+			if err != nil {
+				return props, err
+			}
+		}
+
+		multi := typ&typeMultiFlag != 0
+		base := typ &^ typeMultiFlag
+
+		values := uint32(1)
+		size := fixedSize(base)
+		if multi || size < 0 {
+			if values, err = r.uint32(); err != nil {
+				return props, err
+			}
+		}
+
+		var first []byte
+		for v := uint32(0); v < values; v++ {
+			length := size
+			if length < 0 {
+				l, err := r.uint32()
+				if err != nil {
+					return props, err
+				}
+				length = int(l)
+			}
+
+			value, err := r.padded(length)
+			if err != nil {
+				return props, err
+			}
+
+			if v == 0 {
+				first = value
+			}
+		}
+
+		props = append(props, property{base, id, first})
+	}
+
+	return props, nil
+}
+
+// fixedSize returns the size of fixed-length property types, or -1 for
+// variable-length types.
+func fixedSize(typ uint16) int {
+	switch typ {
+	case typeShort, typeLong, typeFloat, typeError, typeBoolean:
+		return 4
+	case typeDouble, typeCurrency, typeAppTime, typeInt64, typeSysTime:
+		return 8
+	case typeCLSID:
+		return 16
+	default:
+		return -1
+	}
+}
+
+// cString trims a null-terminated string.
+func cString(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+
+	return string(data)
+}
+
+// decodeUTF16 decodes a null-terminated little-endian UTF-16 string.
+func decodeUTF16(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := binary.LittleEndian.Uint16(data[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
+
+// reader reads little-endian values, returning ErrTruncated instead of
+// panicking when data runs out.
+type reader struct {
+	data   []byte
+	offset int
+}
+
+// attribute reads a TNEF attribute, returning its level, name, and value.
+// The type in the upper bits of the ID and the checksum are ignored.
+func (r *reader) attribute() (level uint8, name uint32, value []byte, err error) {
+	if level, err = r.uint8(); err != nil {
+		return
+	}
+
+	var id, length uint32
+	if id, err = r.uint32(); err != nil {
+		return
+	}
+	if length, err = r.uint32(); err != nil {
+		return
+	}
+	if value, err = r.bytes(int(length)); err != nil {
+		return
+	}
+	if _, err = r.bytes(2); err != nil {
+		return
+	}
+
+	return level, id & 0xffff, value, nil
+}
+
+func (r *reader) remaining() int {
+	return len(r.data) - r.offset
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > r.remaining() {
+		return nil, ErrTruncated
+	}
+
+	b := r.data[r.offset : r.offset+n]
+	r.offset += n
+	return b, nil
+}
+
+// padded reads n bytes and skips padding to the next 4 byte boundary.
+func (r *reader) padded(n int) ([]byte, error) {
+	b, err := r.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if pad := (4 - n%4) % 4; pad <= r.remaining() {
+		r.offset += pad
+	}
+
+	return b, nil
+}
+
+func (r *reader) uint8() (uint8, error) {
+	b, err := r.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *reader) uint16() (uint16, error) {
+	b, err := r.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	b, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
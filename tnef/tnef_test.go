@@ -0,0 +1,119 @@
+package tnef
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readFixture loads a TNEF file from the testdata directory.
+func readFixture(t *testing.T, name string) []byte {
+	data, err := os.ReadFile("../testdata/tnef/" + name)
+	require.Nil(t, err, "should be able to read fixture")
+	return data
+}
+
+func TestIsTNEF(t *testing.T) {
+	assert.True(t, IsTNEF(readFixture(t, "one-file.tnef")))
+	assert.False(t, IsTNEF([]byte("PK")))
+}
+
+func TestDecodeAttachments(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		subject   string
+		filenames []string
+	}{
+		{"one-file.tnef", "one-file", []string{"AUTHORS"}},
+		{"two-files.tnef", "two files", []string{"AUTHORS", "README"}},
+		{"long-filename.tnef", "RE: license file", []string{"allproductsmar2000.dat"}},
+		{"unicode-mapi-attr.tnef", "example", []string{"example.dat"}},
+	}
+
+	for _, test := range tests {
+		msg, err := Decode(readFixture(t, test.fixture))
+		require.Nil(t, err, "fixture %s should decode", test.fixture)
+
+		assert.Equal(t, test.subject, msg.Subject)
+
+		filenames := make([]string, 0, len(msg.Attachments))
+		for _, attachment := range msg.Attachments {
+			filenames = append(filenames, attachment.Filename)
+			assert.NotEmpty(t, attachment.Data, "attachment %s should have data", attachment.Filename)
+		}
+		assert.Equal(t, test.filenames, filenames)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	msg, err := Decode(readFixture(t, "body.tnef"))
+	require.Nil(t, err, "body fixture should decode")
+	assert.True(t, strings.HasPrefix(string(msg.HTML), "<!DOCTYPE HTML"), "html body should be extracted")
+
+	msg, err = Decode(readFixture(t, "rtf.tnef"))
+	require.Nil(t, err, "rtf fixture should decode")
+	assert.True(t, strings.HasPrefix(string(msg.RTF), `{\rtf1\ansi`), "rtf body should be decompressed")
+	assert.True(t, strings.HasSuffix(string(msg.RTF), "}\r\n"), "rtf body should be complete")
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Decode([]byte("not tnef"))
+	assert.Equal(t, ErrNotTNEF, err)
+
+	// Truncated data should return whatever was decoded instead of failing.
+	data := readFixture(t, "two-files.tnef")
+	msg, err := Decode(data[:len(data)/2])
+	require.Nil(t, err, "truncated data should decode")
+	assert.NotNil(t, msg)
+}
+
+func TestDecompressRTF(t *testing.T) {
+	// Example from MS-OXRTFCP section 4.1.
+	compressed := []byte{
+		0x2d, 0x00, 0x00, 0x00, 0x2b, 0x00, 0x00, 0x00, 0x4c, 0x5a, 0x46, 0x75, 0xf1, 0xc5, 0xc7, 0xa7,
+		0x03, 0x00, 0x0a, 0x00, 0x72, 0x63, 0x70, 0x67, 0x31, 0x32, 0x35, 0x42, 0x32, 0x0a, 0xf3, 0x20,
+		0x68, 0x65, 0x6c, 0x09, 0x00, 0x20, 0x62, 0x77, 0x05, 0xb0, 0x6c, 0x64, 0x7d, 0x0a, 0x80, 0x0f,
+		0xa0,
+	}
+
+	rtf, err := DecompressRTF(compressed)
+	require.Nil(t, err, "example should decompress")
+	assert.Equal(t, "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n", string(rtf))
+
+	// The raw size in the header shouldn't be trusted for allocating, and
+	// output beyond it is discarded.
+	huge := append([]byte{}, compressed...)
+	binary.LittleEndian.PutUint32(huge[4:8], 0xffffffff)
+	rtf, err = DecompressRTF(huge)
+	require.Nil(t, err, "a huge raw size should not be allocated")
+	assert.Equal(t, "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n", string(rtf))
+	assert.LessOrEqual(t, cap(rtf), len(compressed)*9)
+
+	short := append([]byte{}, compressed...)
+	binary.LittleEndian.PutUint32(short[4:8], 6)
+	rtf, err = DecompressRTF(short)
+	require.Nil(t, err)
+	assert.Equal(t, "{\\rtf1", string(rtf), "output should stop at the raw size")
+
+	_, err = DecompressRTF([]byte("short"))
+	assert.Equal(t, ErrTruncated, err)
+}
+
+func TestRTFText(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{\rtf1\ansi{\fonttbl{\f0 Arial;}}\pard Hello\par World}`, "Hello\nWorld"},
+		{`{\rtf1{\*\generator Riched20;}caf\'e9 \u8364?}`, "café €"},
+		{`{\rtf1 a\{b\}\tab c}`, "a{b}\tc"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, RTFText([]byte(test.input)))
+	}
+}
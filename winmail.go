@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/textproto"
+	"path"
+	"strings"
+
+	"github.com/jordan-wright/email"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Syfaro/paperless-mailhook/tnef"
+)
+
+// IsTNEFAttachment checks if an attachment is an Outlook winmail.dat file.
+func IsTNEFAttachment(attachment *email.Attachment) bool {
+	if strings.EqualFold(attachment.Filename, "winmail.dat") {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(attachment.ContentType)
+	return err == nil && (mediaType == "application/ms-tnef" || mediaType == "application/vnd.ms-tnef")
+}
+
+// NewEmailFromTNEF converts a TNEF message into an email so its body and
+// attachments can be processed like any other email.
+//
+// RTF bodies are only used when there was no plain-text or HTML body, and are
+// reduced to their text.
+func NewEmailFromTNEF(msg *tnef.Message) *email.Email {
+	e := email.NewEmail()
+	e.Subject = msg.Subject
+
+	if len(msg.HTML) > 0 {
+		e.HTML = msg.HTML
+	}
+
+	if len(msg.Body) > 0 {
+		e.Text = msg.Body
+	} else if e.HTML == nil && len(msg.RTF) > 0 {
+		e.Text = []byte(tnef.RTFText(msg.RTF))
+	}
+
+	for _, attachment := range msg.Attachments {
+		filename := attachment.Filename
+		if filename == "" {
+			filename = "attachment"
+		}
+
+		contentType := attachment.MIMEType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(path.Ext(filename))
+		}
+
+		e.Attachments = append(e.Attachments, &email.Attachment{
+			Filename:    filename,
+			ContentType: contentType,
+			Header:      textproto.MIMEHeader{},
+			Content:     attachment.Data,
+		})
+	}
+
+	return e
+}
+
+// UploadTNEF decodes a winmail.dat attachment and processes its contents as a
+// new email. If the attachment was not actually TNEF, it is uploaded as-is.
+func (handler *EmailHandler) UploadTNEF(r io.Reader, filename string) error {
+	logCtx := log.WithField("filename", filename)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if !tnef.IsTNEF(data) {
+		logCtx.Warn("attachment was described as tnef but was not, uploading original")
+		return handler.upload(bytes.NewReader(data), handler.attachmentFilename(filename), handler.Tags)
+	}
+
+	msg, err := tnef.Decode(data)
+	if err != nil {
+		return err
+	}
+
+	logCtx.Infof("decoded tnef attachment with %d attachments", len(msg.Attachments))
+	return handler.ProcessEmail(NewEmailFromTNEF(msg))
+}
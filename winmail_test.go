@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/jordan-wright/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Syfaro/paperless-mailhook/tnef"
+)
+
+func TestIsTNEFAttachment(t *testing.T) {
+	assert.True(t, IsTNEFAttachment(&email.Attachment{Filename: "WINMAIL.DAT"}))
+	assert.True(t, IsTNEFAttachment(&email.Attachment{Filename: "file", ContentType: "application/ms-tnef; name=file"}))
+	assert.False(t, IsTNEFAttachment(&email.Attachment{Filename: "bill.pdf", ContentType: "application/pdf"}))
+}
+
+func TestNewEmailFromTNEF(t *testing.T) {
+	msg := &tnef.Message{
+		Subject:     "Bill",
+		RTF:         []byte(`{\rtf1 Total\par 5}`),
+		Attachments: []*tnef.Attachment{{Filename: "bill.pdf", Data: []byte("pdf")}},
+	}
+
+	e := NewEmailFromTNEF(msg)
+	assert.Equal(t, "Bill", e.Subject)
+	assert.Equal(t, "Total\n5", string(e.Text), "rtf body should be used as text")
+	require.Len(t, e.Attachments, 1)
+	assert.Equal(t, "application/pdf", e.Attachments[0].ContentType, "content type should be guessed from extension")
+
+	msg.HTML = []byte("<p>Total</p>")
+	e = NewEmailFromTNEF(msg)
+	assert.Nil(t, e.Text, "rtf should not be used when there is an html body")
+}
+
+func TestUploadTNEF(t *testing.T) {
+	paperless, documents := newTestPaperless(t)
+	handler := EmailHandler{paperless: paperless}
+
+	data, err := os.ReadFile("testdata/tnef/two-files.tnef")
+	require.Nil(t, err, "should be able to read fixture")
+
+	attachment := &email.Attachment{Filename: "winmail.dat", ContentType: "application/ms-tnef", Header: textproto.MIMEHeader{}, Content: data}
+	err = handler.UploadAttachment(attachment)
+	require.Nil(t, err, "tnef attachment should be processed")
+
+	require.Len(t, *documents, 2, "each attachment within tnef should be uploaded")
+	assert.Equal(t, "AUTHORS", (*documents)[0].Filename)
+	assert.Equal(t, "README", (*documents)[1].Filename)
+}